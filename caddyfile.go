@@ -27,8 +27,10 @@ import (
 	"github.com/greenpau/caddy-authorize/pkg/acl"
 	"github.com/greenpau/caddy-authorize/pkg/authz"
 	"github.com/greenpau/caddy-authorize/pkg/kms"
+	"github.com/greenpau/caddy-authorize/pkg/options"
 	"github.com/greenpau/caddy-authorize/pkg/shared/idp"
 	cfgutils "github.com/greenpau/caddy-authorize/pkg/utils/cfg"
+	"github.com/greenpau/caddy-authorize/pkg/validator"
 )
 
 const badRepl string = "ERROR_BAD_REPL"
@@ -45,25 +47,50 @@ func init() {
 //
 //       crypto default token name <TOKEN_NAME>
 //       crypto default token lifetime <SECONDS>
+//       crypto default autogenerate algorithm <ES256|ES384|ES512|RS256|RS384|RS512|EdDSA>
+//       crypto default autogenerate storage file <PATH>
+//       crypto default autogenerate storage caddy
 //
 //       crypto key token name <TOKEN_NAME>
 //       crypto key <ID> token name <TOKEN_NAME>
+//       crypto key <ID> token method <HS256|RS256|PS256|ES256|EdDSA|...>
+//       crypto key <ID> token accept <METHOD...>
+//       crypto key <ID> token eval <EXPR>
+//       crypto key <ID> token type <jwt|paseto>
 //
 //       crypto key <verify|sign|sign-verify|auto> <SHARED_SECRET>
 //       crypto key <verify|sign|sign-verify|auto> from env <ENV_VAR_WITH_KEY>
 //
 //       crypto key <ID> <verify|sign|sign-verify|auto> <SHARED_SECRET>
 //       crypto key <ID> <verify|sign|sign-verify|auto> from <directory|file> <PATH>
+//       crypto key <ID> <sign|sign-verify|auto> from <directory|file> <PATH> passphrase from env <ENV_VAR_WITH_PASSPHRASE>
+//       crypto key <ID> ca bundle <PATH>
+//       crypto key <ID> format <certificate|jwk>
+//
+//       crypto key <ID> decrypt <32_BYTE_SHARED_SECRET>
+//       crypto key <ID> decrypt from file <PATH>
 //
 //       crypto key <ID> <verify|sign|sign-verify|auto> from env <ENV_VAR_WITH_KEY>
 //       crypto key <ID> <verify|sign|sign-verify|auto> from env <ENV_VAR_NAME> as <directory|file>
 //
+//       crypto key <ID> verify from jwks <URL>
+//       crypto key <ID> verify from oidc <ISSUER_URL>
+//       crypto key <ID> jwks refresh <SECONDS>
+//
+//       crypto key <ID> watch interval <SECONDS>
+//       crypto key <ID> watch grace <SECONDS>
+//
+//       crypto key <ID> not before <RFC3339_TIME>
+//       crypto key <ID> not after <RFC3339_TIME>
+//
 //       set auth url <path>
 //       set forbidden url <path>
-//       set token sources <value...>
+//       set token sources <header|cookie|query|websocket|header:<NAME>|form:<NAME>...>
 //       set user identity <claim_field>
 //       set redirect query parameter <value>
 //       set redirect status <3xx>
+//       set token leeway <SECONDS>
+//       set token max age <SECONDS>
 //
 //       disable auth redirect query
 //       disable auth redirect
@@ -84,9 +111,16 @@ func init() {
 //       validate path acl
 //       validate source address
 //       validate bearer header
+//       validate key id
+//       validate audience <value...>
+//       validate issuer <value...>
+//       validate claim <NAME> [type <string|number|bool|list|map>]
+//       validate dpop
+//       validate client certificate
 //
 //       enable js redirect
 //       enable strip token
+//       enable guardian <NAME>[:<ARG>]
 //
 //       bypass uri <exact|partial|prefix|suffix|regex> <uri_path>
 //
@@ -96,6 +130,15 @@ func init() {
 //
 //       with basic auth [realm <realm_name>] [context <context_name>]
 //       with api key auth [realm <realm_name>] [context <context_name>]
+//
+//       introspection endpoint <URL>
+//       introspection client id <CLIENT_ID>
+//       introspection client secret <CLIENT_SECRET>
+//       introspection token name <TOKEN_NAME...>
+//       introspection cache ttl <SECONDS>
+//
+//       revocation file <PATH>
+//       revocation refresh interval <SECONDS>
 //     }
 //
 func parseCaddyfile(h httpcaddyfile.Helper) (*authz.Authorizer, error) {
@@ -284,17 +327,37 @@ func parseCaddyfile(h httpcaddyfile.Helper) (*authz.Authorizer, error) {
 				}
 				p.BypassConfigs = append(p.BypassConfigs, bc)
 			case "validate":
-				args := strings.Join(h.RemainingArgs(), " ")
+				values := h.RemainingArgs()
+				args := strings.Join(values, " ")
 				args = strings.TrimSpace(args)
-				switch args {
-				case "path acl":
+				switch {
+				case args == "path acl":
 					p.ValidateAccessListPathClaim = true
 					p.ValidateMethodPath = true
-				case "source address":
+				case args == "source address":
 					p.ValidateSourceAddress = true
-				case "bearer header":
+				case args == "bearer header":
 					p.ValidateBearerHeader = true
-				case "":
+				case args == "key id":
+					p.ValidateKeyID = true
+				case args == "dpop":
+					p.ValidateDPoP = true
+				case args == "client certificate":
+					p.ValidateClientCertificate = true
+				case len(values) > 1 && values[0] == "audience":
+					p.ValidateAudience = append(p.ValidateAudience, values[1:]...)
+				case len(values) > 1 && values[0] == "issuer":
+					p.ValidateIssuer = append(p.ValidateIssuer, values[1:]...)
+				case len(values) == 2 && values[0] == "claim":
+					p.RequiredClaims = append(p.RequiredClaims, &options.RequiredClaim{Name: values[1]})
+				case len(values) == 4 && values[0] == "claim" && values[2] == "type":
+					switch values[3] {
+					case "string", "number", "bool", "list", "map":
+					default:
+						return nil, h.Errf("%s directive %q has unsupported claim type", rootDirective, args)
+					}
+					p.RequiredClaims = append(p.RequiredClaims, &options.RequiredClaim{Name: values[1], Type: values[3]})
+				case args == "":
 					return nil, h.Errf("%s directive has no value", rootDirective)
 				default:
 					return nil, h.Errf("%s directive %q is unsupported", rootDirective, args)
@@ -320,6 +383,20 @@ func parseCaddyfile(h httpcaddyfile.Helper) (*authz.Authorizer, error) {
 						return nil, h.Errf("%s %s directive contains invalid value", rootDirective, args)
 					}
 					p.AuthRedirectStatusCode = n
+				case strings.HasPrefix(args, "token leeway "), strings.HasPrefix(args, "token max age "):
+					v := strings.TrimPrefix(strings.TrimPrefix(args, "token leeway "), "token max age ")
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						return nil, h.Errf("%s %s directive failed: %v", rootDirective, args, err)
+					}
+					if n < 0 {
+						return nil, h.Errf("%s %s directive contains invalid value", rootDirective, args)
+					}
+					if strings.HasPrefix(args, "token leeway ") {
+						p.TokenLeeway = n
+					} else {
+						p.TokenMaxAge = n
+					}
 				case strings.HasPrefix(args, "user identity "):
 					p.UserIdentityField = strings.TrimPrefix(args, "user identity ")
 				case args == "":
@@ -329,11 +406,13 @@ func parseCaddyfile(h httpcaddyfile.Helper) (*authz.Authorizer, error) {
 				}
 			case "enable":
 				args := strings.Join(h.RemainingArgs(), " ")
-				switch args {
-				case "js redirect":
+				switch {
+				case args == "js redirect":
 					p.RedirectWithJavascript = true
-				case "strip token":
+				case args == "strip token":
 					p.StripTokenEnabled = true
+				case strings.HasPrefix(args, "guardian "):
+					p.Guardians = append(p.Guardians, strings.TrimPrefix(args, "guardian "))
 				default:
 					return nil, h.Errf("unsupported directive for %s: %s", rootDirective, args)
 				}
@@ -373,6 +452,54 @@ func parseCaddyfile(h httpcaddyfile.Helper) (*authz.Authorizer, error) {
 				default:
 					return nil, h.Errf("%s directive %q is unsupported", rootDirective, args)
 				}
+			case "introspection":
+				args := h.RemainingArgs()
+				if len(args) == 0 {
+					return nil, h.Errf("%s directive has no value", rootDirective)
+				}
+				if p.IntrospectionConfig == nil {
+					p.IntrospectionConfig = &validator.IntrospectionConfig{}
+				}
+				encodedArgs := cfgutils.EncodeArgs(args)
+				switch {
+				case args[0] == "endpoint" && len(args) == 2:
+					p.IntrospectionConfig.EndpointURL = args[1]
+				case strings.HasPrefix(encodedArgs, "client id ") && len(args) == 3:
+					p.IntrospectionConfig.ClientID = args[2]
+				case strings.HasPrefix(encodedArgs, "client secret ") && len(args) == 3:
+					p.IntrospectionConfig.ClientSecret = repl.ReplaceAll(args[2], badRepl)
+				case strings.HasPrefix(encodedArgs, "token name ") && len(args) > 2:
+					p.IntrospectionConfig.TokenNames = append(p.IntrospectionConfig.TokenNames, args[2:]...)
+				case strings.HasPrefix(encodedArgs, "cache ttl ") && len(args) == 3:
+					n, err := strconv.Atoi(args[2])
+					if err != nil {
+						return nil, h.Errf("%s %s directive failed: %v", rootDirective, encodedArgs, err)
+					}
+					p.IntrospectionConfig.CacheTTL = n
+				default:
+					return nil, h.Errf("%s directive %q is unsupported", rootDirective, encodedArgs)
+				}
+			case "revocation":
+				args := h.RemainingArgs()
+				if len(args) == 0 {
+					return nil, h.Errf("%s directive has no value", rootDirective)
+				}
+				if p.RevocationConfig == nil {
+					p.RevocationConfig = &validator.RevocationConfig{}
+				}
+				encodedArgs := cfgutils.EncodeArgs(args)
+				switch {
+				case args[0] == "file" && len(args) == 2:
+					p.RevocationConfig.FilePath = args[1]
+				case strings.HasPrefix(encodedArgs, "refresh interval ") && len(args) == 3:
+					n, err := strconv.Atoi(args[2])
+					if err != nil {
+						return nil, h.Errf("%s %s directive failed: %v", rootDirective, encodedArgs, err)
+					}
+					p.RevocationConfig.RefreshInterval = n
+				default:
+					return nil, h.Errf("%s directive %q is unsupported", rootDirective, encodedArgs)
+				}
 			default:
 				return nil, h.Errf("unsupported root directive: %s", rootDirective)
 			}
@@ -399,6 +526,18 @@ func parseCaddyfile(h httpcaddyfile.Helper) (*authz.Authorizer, error) {
 		p.CryptoKeyStoreConfig = configs
 	}
 
+	if p.IntrospectionConfig != nil {
+		if err := p.IntrospectionConfig.Validate(); err != nil {
+			return nil, h.Errf("introspection config error: %v", err)
+		}
+	}
+
+	if p.RevocationConfig != nil {
+		if err := p.RevocationConfig.Validate(); err != nil {
+			return nil, h.Errf("revocation config error: %v", err)
+		}
+	}
+
 	if len(idpConfig) > 0 {
 		config, err := idp.ParseIdentityProviderConfig(idpConfig)
 		if err != nil {
@@ -43,6 +43,69 @@ func TestParser(t *testing.T) {
                 primary yes
             }`,
 		},
+		{
+			name: "auto generate eddsa crypto key",
+			config: `
+            authorize {
+                primary yes
+                crypto default autogenerate algorithm EdDSA
+            }`,
+		},
+		{
+			name: "auto generate rsa crypto key",
+			config: `
+            authorize {
+                primary yes
+                crypto default autogenerate algorithm RS256
+            }`,
+		},
+		{
+			name: "auto generate crypto key with unsupported algorithm",
+			config: `
+            authorize {
+                primary yes
+                crypto default autogenerate algorithm HS256
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:5 - Error during parsing: crypto key store config error: key config entry "default autogenerate algorithm HS256" is invalid: contains unsupported 'crypto default autogenerate' algorithm: HS256`),
+		},
+		{
+			name: "auto generate crypto key with file storage",
+			config: `
+            authorize {
+                primary yes
+                crypto default autogenerate algorithm ES256
+                crypto default autogenerate storage file /var/lib/caddy/authorize/es256.pem
+            }`,
+		},
+		{
+			name: "auto generate crypto key with caddy storage",
+			config: `
+            authorize {
+                primary yes
+                crypto default autogenerate storage caddy
+            }`,
+		},
+		{
+			name: "auto generate crypto key with file storage without path",
+			config: `
+            authorize {
+                primary yes
+                crypto default autogenerate storage file
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:5 - Error during parsing: crypto key store config error: key config entry "default autogenerate storage file" is invalid: 'crypto default autogenerate storage file' must be followed by file path`),
+		},
+		{
+			name: "auto generate crypto key with unsupported storage",
+			config: `
+            authorize {
+                primary yes
+                crypto default autogenerate storage redis
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:5 - Error during parsing: crypto key store config error: key config entry "default autogenerate storage redis" is invalid: contains unsupported 'crypto default autogenerate' storage: redis`),
+		},
 		{
 			name: "default shared key in default context",
 			config: `
@@ -67,6 +130,18 @@ func TestParser(t *testing.T) {
                 crypto key verify foobar
                 crypto key abc123 token name foobar_token
                 crypto key abc123 verify foobar
+            }`,
+		},
+		{
+			name: "shared keys selected per tenant",
+			config: `
+            authorize {
+                context default
+                primary yes
+                crypto key tenant1 verify foobar
+                crypto key tenant1 token eval "request.host == app1.example.com and claims.iss == 'https://app1.example.com'"
+                crypto key tenant2 verify barfoo
+                crypto key tenant2 token eval request.header.X-Tenant-Id == tenant2
             }`,
 		},
 		{
@@ -100,6 +175,8 @@ func TestParser(t *testing.T) {
                 crypto key verify foobar
                 enable js redirect
                 enable strip token
+                enable guardian tenant
+                enable guardian tenant_header:X-Tenant-ID
             }`,
 		},
 		{
@@ -120,6 +197,124 @@ func TestParser(t *testing.T) {
                 inject headers with claims
             }`,
 		},
+		{
+			name: "validate audience and issuer",
+			config: `
+            authorize {
+                primary yes
+                crypto key verify foobar
+                validate audience https://app1.example.com https://app2.example.com
+                validate audience https://app3.example.com
+                validate issuer https://auth.example.com
+            }`,
+		},
+		{
+			name: "set token leeway and max age",
+			config: `
+            authorize {
+                primary yes
+                crypto key verify foobar
+                set token leeway 30
+                set token max age 3600
+            }`,
+		},
+		{
+			name: "set token leeway with invalid value",
+			config: `
+            authorize {
+                set token leeway foo
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:3 - Error during parsing: set token leeway foo directive failed: strconv.Atoi: parsing "foo": invalid syntax`),
+		},
+		{
+			name: "set token max age with negative value",
+			config: `
+            authorize {
+                set token max age -1
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:3 - Error during parsing: set token max age -1 directive contains invalid value`),
+		},
+		{
+			name: "validate required claims",
+			config: `
+            authorize {
+                primary yes
+                crypto key verify foobar
+                validate claim sub
+                validate claim tenant type string
+            }`,
+		},
+		{
+			name: "validate required claim with unsupported type",
+			config: `
+            authorize {
+                validate claim tenant type date
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:3 - Error during parsing: validate directive "claim tenant type date" has unsupported claim type`),
+		},
+		{
+			name: "configure token revocation file",
+			config: `
+            authorize {
+                primary yes
+                crypto key verify foobar
+                revocation file /etc/gatekeeper/revoked_tokens.json
+                revocation refresh interval 10
+            }`,
+		},
+		{
+			name: "configure token revocation without file",
+			config: `
+            authorize {
+                revocation refresh interval 10
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:4 - Error during parsing: revocation config error: revocation: file path not found`),
+		},
+		{
+			name: "validate audience without value",
+			config: `
+            authorize {
+                validate audience
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:3 - Error during parsing: validate directive "audience" is unsupported`),
+		},
+		{
+			name: "configure token introspection",
+			config: `
+            authorize {
+                primary yes
+                introspection endpoint https://auth.example.com/oauth2/introspect
+                introspection client id authorize
+                introspection client secret foobar
+                introspection token name partner_token
+                introspection cache ttl 30
+            }`,
+		},
+		{
+			name: "configure token introspection without client secret",
+			config: `
+            authorize {
+                primary yes
+                introspection endpoint https://auth.example.com/oauth2/introspect
+                introspection client id authorize
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:6 - Error during parsing: introspection config error: introspection: client secret not found for client id "authorize"`),
+		},
+		{
+			name: "configure token introspection with invalid cache ttl",
+			config: `
+            authorize {
+                introspection cache ttl foo
+            }`,
+			shouldErr: true,
+			err:       fmt.Errorf(`Testfile:3 - Error during parsing: introspection cache ttl foo directive failed: strconv.Atoi: parsing "foo": invalid syntax`),
+		},
 		{
 			name: "invalid crypto key config",
 			config: `
@@ -256,6 +451,9 @@ func TestParser(t *testing.T) {
                 validate path acl
                 validate source address
                 validate bearer header
+                validate key id
+                validate dpop
+                validate client certificate
             }`,
 		},
 		{
@@ -285,6 +483,14 @@ func TestParser(t *testing.T) {
                 set auth url /xauth
                 set forbidden url /forbidden.html
                 set user identity mail
+            }`,
+		},
+		{
+			name: "set custom token sources",
+			config: `
+            authorize {
+                primary yes
+                set token sources header:X-Forwarded-Access-Token header form:access_token websocket cookie
             }`,
 		},
 		{
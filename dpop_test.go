@@ -0,0 +1,148 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authorize
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+	jwtlib "github.com/golang-jwt/jwt/v4"
+	"github.com/greenpau/caddy-authorize/internal/testutils"
+	"github.com/greenpau/caddy-authorize/pkg/kms"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+)
+
+func TestDPoPChallenge(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	baseURL := "https://127.0.0.1:3443"
+	rawConfig := `
+	{
+	  local_certs
+	  http_port     3080
+	  https_port    3443
+	}
+
+	127.0.0.1, localhost {
+	  route /app* {
+	    authorize {
+	      primary yes
+	      crypto key verify ` + testutils.GetSharedKey() + `
+	      allow roles anonymous guest admin
+	      validate dpop
+	    }
+	    respond * "app" 200
+	  }
+	}
+	`
+	tester.InitServer(rawConfig, "caddyfile")
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := &kms.JSONWebKey{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(privateKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(privateKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testutils.NewTestUser().AsMap()
+	m["cnf"] = map[string]interface{}{"jkt": thumbprint}
+	usr, err := user.NewUser(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutils.NewTestCryptoKeyStore().SignToken("access_token", "HS512", usr); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte(usr.Token))
+	tkn := jwtlib.NewWithClaims(jwtlib.SigningMethodES256, jwtlib.MapClaims{
+		"htm": "GET",
+		"htu": baseURL + "/app",
+		"iat": time.Now().Unix(),
+		"jti": "a1",
+		"ath": base64.RawURLEncoding.EncodeToString(h[:]),
+	})
+	tkn.Header["typ"] = "dpop+jwt"
+	tkn.Header["jwk"] = jwk
+	proof, err := tkn.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name          string
+		authorization string
+		proof         string
+		want          int
+		challenge     string
+	}{
+		{
+			name:          "token with valid proof",
+			authorization: "DPoP " + usr.Token,
+			proof:         proof,
+			want:          200,
+		},
+		{
+			name:          "token with replayed proof",
+			authorization: "DPoP " + usr.Token,
+			proof:         proof,
+			want:          401,
+			challenge:     `DPoP error="invalid_dpop_proof", algs="ES256 ES384 ES512 PS256 PS384 PS512 RS256 RS384 RS512 EdDSA"`,
+		},
+		{
+			name:          "token without dpop scheme",
+			authorization: "access_token=" + usr.Token,
+			want:          401,
+			challenge:     `DPoP error="invalid_token", algs="ES256 ES384 ES512 PS256 PS384 PS512 RS256 RS384 RS512 EdDSA"`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", baseURL+"/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", tc.authorization)
+			if tc.proof != "" {
+				req.Header.Set("DPoP", tc.proof)
+			}
+			resp, err := tester.Client.Transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("unexpected status code: got %d, want %d", resp.StatusCode, tc.want)
+			}
+			if got := resp.Header.Get("WWW-Authenticate"); got != tc.challenge {
+				t.Fatalf("unexpected challenge: got %q, want %q", got, tc.challenge)
+			}
+		})
+	}
+
+	time.Sleep(1 * time.Second)
+}
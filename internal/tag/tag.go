@@ -132,6 +132,7 @@ func convertFieldToTag(s string) string {
 	s = strcase.ToSnake(s)
 	s = strings.ReplaceAll(s, "_md_5", "_md5")
 	s = strings.ReplaceAll(s, "open_ssh", "openssh")
+	s = strings.ReplaceAll(s, "d_po_p", "dpop")
 	return s
 }
 
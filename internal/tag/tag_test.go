@@ -94,6 +94,26 @@ func TestTagCompliance(t *testing.T) {
 			entry: &kms.CryptoKeyOperator{},
 			opts:  &Options{},
 		},
+		{
+			name:  "test kms.TokenGrantor struct",
+			entry: &kms.TokenGrantor{},
+			opts:  &Options{},
+		},
+		{
+			name:  "test validator.IntrospectionConfig struct",
+			entry: &validator.IntrospectionConfig{},
+			opts:  &Options{},
+		},
+		{
+			name:  "test validator.RevocationConfig struct",
+			entry: &validator.RevocationConfig{},
+			opts:  &Options{},
+		},
+		{
+			name:  "test validator.RevokedToken struct",
+			entry: &validator.RevokedToken{},
+			opts:  &Options{},
+		},
 		{
 			name:  "test options.TokenGrantorOptions struct",
 			entry: &options.TokenGrantorOptions{},
@@ -111,6 +131,16 @@ func TestTagCompliance(t *testing.T) {
 			entry: &authorize.AuthMiddleware{},
 			opts:  &Options{},
 		},
+		{
+			name:  "test authorize.JwksHandler struct",
+			entry: &authorize.JwksHandler{},
+			opts:  &Options{},
+		},
+		{
+			name:  "test authorize.RevocationHandler struct",
+			entry: &authorize.RevocationHandler{},
+			opts:  &Options{},
+		},
 		{
 			name:  "test user.AccessListClaim struct",
 			entry: &user.AccessListClaim{},
@@ -140,6 +170,20 @@ func TestTagCompliance(t *testing.T) {
 			entry: &kms.CryptoKeyTokenOperator{},
 			opts:  &Options{},
 		},
+		{
+			name:  "test kms.JSONWebKey struct",
+			entry: &kms.JSONWebKey{},
+			opts: &Options{
+				DisableTagMismatch: true,
+			},
+		},
+		{
+			name:  "test kms.JSONWebKeySet struct",
+			entry: &kms.JSONWebKeySet{},
+			opts: &Options{
+				DisableTagMismatch: true,
+			},
+		},
 		{
 			name:  "test kms.CryptoKeyStore struct",
 			entry: &kms.CryptoKeyStore{},
@@ -150,6 +194,11 @@ func TestTagCompliance(t *testing.T) {
 			entry: &options.TokenValidatorOptions{},
 			opts:  &Options{},
 		},
+		{
+			name:  "test options.RequiredClaim struct",
+			entry: &options.RequiredClaim{},
+			opts:  &Options{},
+		},
 		{
 			name:  "test authz.BypassConfig struct",
 			entry: &authz.BypassConfig{},
@@ -0,0 +1,105 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authorize
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/greenpau/caddy-authorize/pkg/authz"
+	"net/http"
+)
+
+func init() {
+	caddy.RegisterModule(JwksHandler{})
+	httpcaddyfile.RegisterHandlerDirective("authorize_jwks", getJwksHandlerFromParseCaddyfile)
+}
+
+// JwksHandler serves the public keys with token verification capabilities
+// of the primary authorization instance of a context as JSON Web Key Set.
+type JwksHandler struct {
+	Context string `json:"context,omitempty" xml:"context,omitempty" yaml:"context,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (JwksHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.authorize_jwks",
+		New: func() caddy.Module { return new(JwksHandler) },
+	}
+}
+
+// Provision provisions JWKS handler.
+func (h *JwksHandler) Provision(ctx caddy.Context) error {
+	if h.Context == "" {
+		h.Context = "default"
+	}
+	return nil
+}
+
+// ServeHTTP serves the JSON Web Key Set of the context.
+func (h JwksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	jwks, err := authz.AuthManager.GetJSONWebKeySet(h.Context)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	b, err := json.Marshal(jwks)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(b)
+	return err
+}
+
+// UnmarshalCaddyfile sets up JWKS handler. Syntax:
+//
+//     authorize_jwks [<context>]
+//
+func (h *JwksHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		args := d.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			h.Context = args[0]
+		default:
+			return d.ArgErr()
+		}
+		if d.NextBlock(0) {
+			return d.Err("authorize_jwks directive does not support blocks")
+		}
+	}
+	return nil
+}
+
+func getJwksHandlerFromParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := &JwksHandler{}
+	if err := m.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*JwksHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*JwksHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*JwksHandler)(nil)
+)
@@ -0,0 +1,86 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authorize
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/greenpau/caddy-authorize/pkg/kms"
+)
+
+func TestJwksHandler(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	baseURL := "https://127.0.0.1:3443"
+	curDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConfig := `
+	{
+	  local_certs
+	  http_port     3080
+	  https_port    3443
+	}
+
+	127.0.0.1, localhost {
+	  route /.well-known/jwks.json {
+	    authorize_jwks
+	  }
+	  route /app* {
+	    authorize {
+	      primary yes
+	      crypto key k1 sign-verify from file ` + curDir + `/testdata/rskeys/test_2_pri.pem
+	      crypto key k2 verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+	      allow roles anonymous guest admin
+	    }
+	    respond * "app" 200
+	  }
+	}
+	`
+	tester.InitServer(rawConfig, "caddyfile")
+
+	resp, err := tester.Client.Get(baseURL + "/.well-known/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/jwk-set+json" {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := &kms.JSONWebKeySet{}
+	if err := json.Unmarshal(b, jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("unexpected number of keys: %s", b)
+	}
+	if jwks.Keys[0].KeyID != "k1" || jwks.Keys[0].KeyType != "RSA" || jwks.Keys[0].Use != "sig" {
+		t.Fatalf("unexpected key: %s", b)
+	}
+
+	time.Sleep(1 * time.Second)
+}
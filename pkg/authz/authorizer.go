@@ -16,6 +16,7 @@ package authz
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -28,6 +29,7 @@ import (
 	"github.com/greenpau/caddy-authorize/pkg/kms"
 	"github.com/greenpau/caddy-authorize/pkg/options"
 	"github.com/greenpau/caddy-authorize/pkg/shared/idp"
+	addrutils "github.com/greenpau/caddy-authorize/pkg/utils/addr"
 	urlutils "github.com/greenpau/caddy-authorize/pkg/utils/url"
 	"github.com/greenpau/caddy-authorize/pkg/validator"
 	"go.uber.org/zap"
@@ -60,20 +62,37 @@ type Authorizer struct {
 	HeaderInjectionConfigs []*HeaderInjectionConfig `json:"header_injection_configs,omitempty" xml:"header_injection_configs,omitempty" yaml:"header_injection_configs,omitempty"`
 	AccessListRules        []*acl.RuleConfiguration `json:"access_list_rules,omitempty" xml:"access_list_rules,omitempty" yaml:"access_list_rules,omitempty"`
 	CryptoKeyConfigs       []*kms.CryptoKeyConfig   `json:"crypto_key_configs,omitempty" xml:"crypto_key_configs,omitempty" yaml:"crypto_key_configs,omitempty"`
+	// IntrospectionConfig holds the configuration of the introspection of opaque tokens.
+	IntrospectionConfig *validator.IntrospectionConfig `json:"introspection_config,omitempty" xml:"introspection_config,omitempty" yaml:"introspection_config,omitempty"`
+	// RevocationConfig holds the configuration of the list of revoked tokens.
+	RevocationConfig *validator.RevocationConfig `json:"revocation_config,omitempty" xml:"revocation_config,omitempty" yaml:"revocation_config,omitempty"`
 	// CryptoKeyStoreConfig hold the default configuration for the keys, e.g. token name and lifetime.
-	CryptoKeyStoreConfig        map[string]interface{}      `json:"crypto_key_store_config,omitempty" xml:"crypto_key_store_config,omitempty" yaml:"crypto_key_store_config,omitempty"`
-	IdentityProviderConfig      *idp.IdentityProviderConfig `json:"identity_provider_config,omitempty" xml:"identity_provider_config,omitempty" yaml:"identity_provider_config,omitempty"`
-	AllowedTokenSources         []string                    `json:"allowed_token_sources,omitempty" xml:"allowed_token_sources,omitempty" yaml:"allowed_token_sources,omitempty"`
-	StripTokenEnabled           bool                        `json:"strip_token_enabled,omitempty" xml:"strip_token_enabled,omitempty" yaml:"strip_token_enabled,omitempty"`
-	ForbiddenURL                string                      `json:"forbidden_url,omitempty" xml:"forbidden_url,omitempty" yaml:"forbidden_url,omitempty"`
-	UserIdentityField           string                      `json:"user_identity_field,omitempty" xml:"user_identity_field,omitempty" yaml:"user_identity_field,omitempty"`
-	ValidateBearerHeader        bool                        `json:"validate_bearer_header,omitempty" xml:"validate_bearer_header,omitempty" yaml:"validate_bearer_header,omitempty"`
-	ValidateMethodPath          bool                        `json:"validate_method_path,omitempty" xml:"validate_method_path,omitempty" yaml:"validate_method_path,omitempty"`
-	ValidateAccessListPathClaim bool                        `json:"validate_access_list_path_claim,omitempty" xml:"validate_access_list_path_claim,omitempty" yaml:"validate_access_list_path_claim,omitempty"`
-	ValidateSourceAddress       bool                        `json:"validate_source_address,omitempty" xml:"validate_source_address,omitempty" yaml:"validate_source_address,omitempty"`
-	PassClaimsWithHeaders       bool                        `json:"pass_claims_with_headers,omitempty" xml:"pass_claims_with_headers,omitempty" yaml:"pass_claims_with_headers,omitempty"`
+	CryptoKeyStoreConfig   map[string]interface{}      `json:"crypto_key_store_config,omitempty" xml:"crypto_key_store_config,omitempty" yaml:"crypto_key_store_config,omitempty"`
+	IdentityProviderConfig *idp.IdentityProviderConfig `json:"identity_provider_config,omitempty" xml:"identity_provider_config,omitempty" yaml:"identity_provider_config,omitempty"`
+	AllowedTokenSources    []string                    `json:"allowed_token_sources,omitempty" xml:"allowed_token_sources,omitempty" yaml:"allowed_token_sources,omitempty"`
+	// Guardians holds the names of the guardians registered by the plugins,
+	// see validator.RegisterGuardian.
+	Guardians                   []string                 `json:"guardians,omitempty" xml:"guardians,omitempty" yaml:"guardians,omitempty"`
+	StripTokenEnabled           bool                     `json:"strip_token_enabled,omitempty" xml:"strip_token_enabled,omitempty" yaml:"strip_token_enabled,omitempty"`
+	ForbiddenURL                string                   `json:"forbidden_url,omitempty" xml:"forbidden_url,omitempty" yaml:"forbidden_url,omitempty"`
+	UserIdentityField           string                   `json:"user_identity_field,omitempty" xml:"user_identity_field,omitempty" yaml:"user_identity_field,omitempty"`
+	ValidateBearerHeader        bool                     `json:"validate_bearer_header,omitempty" xml:"validate_bearer_header,omitempty" yaml:"validate_bearer_header,omitempty"`
+	ValidateMethodPath          bool                     `json:"validate_method_path,omitempty" xml:"validate_method_path,omitempty" yaml:"validate_method_path,omitempty"`
+	ValidateAccessListPathClaim bool                     `json:"validate_access_list_path_claim,omitempty" xml:"validate_access_list_path_claim,omitempty" yaml:"validate_access_list_path_claim,omitempty"`
+	ValidateSourceAddress       bool                     `json:"validate_source_address,omitempty" xml:"validate_source_address,omitempty" yaml:"validate_source_address,omitempty"`
+	ValidateKeyID               bool                     `json:"validate_key_id,omitempty" xml:"validate_key_id,omitempty" yaml:"validate_key_id,omitempty"`
+	ValidateAudience            []string                 `json:"validate_audience,omitempty" xml:"validate_audience,omitempty" yaml:"validate_audience,omitempty"`
+	ValidateIssuer              []string                 `json:"validate_issuer,omitempty" xml:"validate_issuer,omitempty" yaml:"validate_issuer,omitempty"`
+	TokenLeeway                 int                      `json:"token_leeway,omitempty" xml:"token_leeway,omitempty" yaml:"token_leeway,omitempty"`
+	TokenMaxAge                 int                      `json:"token_max_age,omitempty" xml:"token_max_age,omitempty" yaml:"token_max_age,omitempty"`
+	RequiredClaims              []*options.RequiredClaim `json:"required_claims,omitempty" xml:"required_claims,omitempty" yaml:"required_claims,omitempty"`
+	ValidateDPoP                bool                     `json:"validate_dpop,omitempty" xml:"validate_dpop,omitempty" yaml:"validate_dpop,omitempty"`
+	ValidateClientCertificate   bool                     `json:"validate_client_certificate,omitempty" xml:"validate_client_certificate,omitempty" yaml:"validate_client_certificate,omitempty"`
+	PassClaimsWithHeaders       bool                     `json:"pass_claims_with_headers,omitempty" xml:"pass_claims_with_headers,omitempty" yaml:"pass_claims_with_headers,omitempty"`
 	tokenValidator              *validator.TokenValidator
+	revocations                 *validator.RevocationList
 	opts                        *options.TokenValidatorOptions
+	keystore                    *kms.CryptoKeyStore
 	accessList                  *acl.AccessList
 	// Enable authorization bypass for specific URIs.
 	bypassEnabled bool
@@ -82,6 +101,8 @@ type Authorizer struct {
 	logger              *zap.Logger
 	startedAt           time.Time
 	primaryInstanceName string
+	// The storage provided by the upstream, e.g. Caddy storage.
+	storage kms.CryptoKeyStorage
 }
 
 // Provision provisions JWT authorization provider instances.
@@ -91,6 +112,11 @@ func (m *Authorizer) Provision(upstreamOptions map[string]interface{}) error {
 		return fmt.Errorf("configuration requires valid logger")
 	}
 	m.logger = upstreamOptions["logger"].(*zap.Logger)
+	if v, exists := upstreamOptions["storage"]; exists {
+		if storage, ok := v.(kms.CryptoKeyStorage); ok {
+			m.storage = storage
+		}
+	}
 	m.startedAt = time.Now().UTC()
 	if err := AuthManager.Register(ctx, m); err != nil {
 		return err
@@ -116,6 +142,15 @@ func (m *Authorizer) Validate() error {
 	return nil
 }
 
+// Cleanup stops the background activities of an Authorizer instance, i.e.
+// the refresh of the keys fetched from remote JSON Web Key Sets.
+func (m *Authorizer) Cleanup() error {
+	if m.keystore != nil {
+		m.keystore.Close()
+	}
+	return nil
+}
+
 // Authenticate authorizes access based on the presense and content of JWT token.
 func (m Authorizer) Authenticate(w http.ResponseWriter, r *http.Request, upstreamOptions map[string]interface{}) (map[string]interface{}, bool, error) {
 	var sessionID string
@@ -136,6 +171,16 @@ func (m Authorizer) Authenticate(w http.ResponseWriter, r *http.Request, upstrea
 
 	usr, err := m.tokenValidator.Authorize(ctx, r)
 	if err != nil {
+		if stderrors.Is(err, errors.ErrCryptoKeyStoreAlgorithmNotAllowed) {
+			// The token is signed with an algorithm none of the keys accept,
+			// e.g. "none" or HMAC with a public key, which is likely an attack.
+			m.logger.Warn(
+				"token signing algorithm rejected",
+				zap.String("session_id", sessionID),
+				zap.String("src_ip", addrutils.GetSourceAddress(r)),
+				zap.String("error", err.Error()),
+			)
+		}
 		m.logger.Debug(
 			"token validation error",
 			zap.String("session_id", sessionID),
@@ -165,6 +210,16 @@ func (m Authorizer) Authenticate(w http.ResponseWriter, r *http.Request, upstrea
 			}
 			w.Write([]byte(`Forbidden`))
 			return nil, false, err
+		case stderrors.Is(err, errors.ErrValidatorInvalidDPoPProof), stderrors.Is(err, errors.ErrValidatorInvalidDPoPToken):
+			// The challenge with DPoP scheme, see RFC 9449, section 7.1.
+			errCode := "invalid_token"
+			if stderrors.Is(err, errors.ErrValidatorInvalidDPoPProof) {
+				errCode = "invalid_dpop_proof"
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`DPoP error=%q, algs=%q`, errCode, strings.Join(validator.GetDPoPSigningMethods(), " ")))
+			w.WriteHeader(401)
+			w.Write([]byte(`401 Unauthorized`))
+			return nil, false, err
 		case (err == errors.ErrBasicAuthFailed) || (err == errors.ErrAPIKeyAuthFailed):
 			w.WriteHeader(401)
 			w.Write([]byte(`401 Unauthorized`))
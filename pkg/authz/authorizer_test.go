@@ -22,10 +22,97 @@ import (
 		"github.com/greenpau/caddy-authorize/pkg/kms"
 		"github.com/greenpau/caddy-authorize/pkg/validator"
 	*/
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	//"time"
+
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/internal/testutils"
+	"github.com/greenpau/caddy-authorize/pkg/acl"
+	"github.com/greenpau/caddy-authorize/pkg/kms"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+	logutils "github.com/greenpau/caddy-authorize/pkg/utils/log"
+	"github.com/greenpau/caddy-authorize/pkg/validator"
 )
 
 func TestAuthorizer(t *testing.T) {
 	return
 }
+
+func TestAuthorizerRegisteredGuardian(t *testing.T) {
+	errTenantMismatch := fmt.Errorf("tenant mismatch")
+	var calls int
+	if err := validator.RegisterGuardian("authz_test_tenant", func(arg string) (validator.Guardian, error) {
+		return validator.GuardianFunc(func(ctx context.Context, r *http.Request, usr *user.User) error {
+			calls++
+			if r.Header.Get("X-Tenant") != arg {
+				return errTenantMismatch
+			}
+			return nil
+		}), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	keyConfigs, err := kms.ParseCryptoKeyConfigs("crypto key verify " + testutils.GetSharedKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Authorizer{
+		Context:          "authz_test_guardian",
+		PrimaryInstance:  true,
+		CryptoKeyConfigs: keyConfigs,
+		AccessListRules: []*acl.RuleConfiguration{
+			{
+				Conditions: []string{"match roles anonymous guest"},
+				Action:     "allow",
+			},
+		},
+		Guardians:            []string{"authz_test_tenant:acme"},
+		AuthRedirectDisabled: true,
+	}
+	if err := m.Provision(map[string]interface{}{"logger": logutils.NewLogger()}); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	usr := testutils.NewTestUser()
+	if err := testutils.NewTestCryptoKeyStore().SignToken("access_token", "HS512", usr); err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name      string
+		tenant    string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:   "request allowed by registered guardian",
+			tenant: "acme",
+		},
+		{
+			name:      "request denied by registered guardian",
+			tenant:    "contoso",
+			shouldErr: true,
+			err:       errTenantMismatch,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			calls = 0
+			r := httptest.NewRequest("GET", "/protected/path", nil)
+			r.Header.Set("Authorization", "access_token="+usr.Token)
+			r.Header.Set("X-Tenant", tc.tenant)
+			w := httptest.NewRecorder()
+			_, authenticated, err := m.Authenticate(w, r, nil)
+			tests.EvalErrWithLog(t, err, "authenticate", tc.shouldErr, tc.err, msgs)
+			tests.EvalObjectsWithLog(t, "authenticated", !tc.shouldErr, authenticated, msgs)
+			tests.EvalObjectsWithLog(t, "guardian calls", 1, calls, msgs)
+		})
+	}
+}
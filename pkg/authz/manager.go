@@ -25,6 +25,7 @@ import (
 	"go.uber.org/zap"
 	"strings"
 	"sync"
+	"time"
 )
 
 // InstanceStatus is the state of an Instance.
@@ -50,6 +51,11 @@ type InstanceManager struct {
 	PrimaryInstances map[string]*Authorizer `json:"primary_instances,omitempty" xml:"primary_instances,omitempty" yaml:"primary_instances,omitempty"`
 	MemberCount      map[string]int         `json:"member_count,omitempty" xml:"member_count,omitempty" yaml:"member_count,omitempty"`
 	backlog          map[string]string
+	// revocationLists are the lists of revoked tokens of the instances of
+	// the context, and revokedTokens are the revocations pushed to the
+	// context. The pushed revocations are carried over the reloads.
+	revocationLists map[string][]*validator.RevocationList
+	revokedTokens   map[string][]*validator.RevokedToken
 }
 
 // AuthManager is the global authorization provider pool.
@@ -67,6 +73,8 @@ func NewInstanceManager() *InstanceManager {
 		PrimaryInstances: make(map[string]*Authorizer),
 		MemberCount:      make(map[string]int),
 		backlog:          make(map[string]string),
+		revocationLists:  make(map[string][]*validator.RevocationList),
+		revokedTokens:    make(map[string][]*validator.RevokedToken),
 	}
 	return mgr
 }
@@ -117,6 +125,7 @@ func (mgr *InstanceManager) Register(ctx context.Context, m *Authorizer) error {
 		m.logger.Debug("Primary instance registration", zap.String("instance_name", m.Name))
 		mgr.PrimaryInstances[m.Context] = m
 		mgr.Members[m.Name] = m
+		mgr.revocationLists[m.Context] = nil
 	default:
 		// This is BootstrapSecondary.
 		m.logger.Debug("Non-primary instance registration", zap.String("instance_name", m.Name))
@@ -230,6 +239,70 @@ func (mgr *InstanceManager) Register(ctx context.Context, m *Authorizer) error {
 		}
 	}
 
+	if m.ValidateKeyID {
+		m.opts.ValidateKeyID = true
+	} else {
+		if !m.PrimaryInstance {
+			m.opts.ValidateKeyID = primaryInstance.opts.ValidateKeyID
+		}
+	}
+
+	if len(m.ValidateAudience) > 0 {
+		m.opts.ValidateAudience = m.ValidateAudience
+	} else {
+		if !m.PrimaryInstance {
+			m.opts.ValidateAudience = primaryInstance.opts.ValidateAudience
+		}
+	}
+
+	if len(m.ValidateIssuer) > 0 {
+		m.opts.ValidateIssuer = m.ValidateIssuer
+	} else {
+		if !m.PrimaryInstance {
+			m.opts.ValidateIssuer = primaryInstance.opts.ValidateIssuer
+		}
+	}
+
+	if m.TokenLeeway > 0 {
+		m.opts.TokenLeeway = m.TokenLeeway
+	} else {
+		if !m.PrimaryInstance {
+			m.opts.TokenLeeway = primaryInstance.opts.TokenLeeway
+		}
+	}
+
+	if m.TokenMaxAge > 0 {
+		m.opts.TokenMaxAge = m.TokenMaxAge
+	} else {
+		if !m.PrimaryInstance {
+			m.opts.TokenMaxAge = primaryInstance.opts.TokenMaxAge
+		}
+	}
+
+	if len(m.RequiredClaims) > 0 {
+		m.opts.RequiredClaims = m.RequiredClaims
+	} else {
+		if !m.PrimaryInstance {
+			m.opts.RequiredClaims = primaryInstance.opts.RequiredClaims
+		}
+	}
+
+	if m.ValidateDPoP {
+		m.opts.ValidateDPoP = true
+	} else {
+		if !m.PrimaryInstance {
+			m.opts.ValidateDPoP = primaryInstance.opts.ValidateDPoP
+		}
+	}
+
+	if m.ValidateClientCertificate {
+		m.opts.ValidateClientCertificate = true
+	} else {
+		if !m.PrimaryInstance {
+			m.opts.ValidateClientCertificate = primaryInstance.opts.ValidateClientCertificate
+		}
+	}
+
 	// Load token configuration into key managers, extract token verification
 	// keys and add them to token validator.
 	if m.CryptoKeyStoreConfig == nil && !m.PrimaryInstance {
@@ -241,6 +314,14 @@ func (mgr *InstanceManager) Register(ctx context.Context, m *Authorizer) error {
 	}
 
 	ks := kms.NewCryptoKeyStore()
+	ks.SetLogger(m.logger)
+	// When the registration fails, the keystore is not assigned to the
+	// instance, and the background refresh of its keys is stopped here.
+	defer func() {
+		if m.keystore != ks {
+			ks.Close()
+		}
+	}()
 
 	if m.CryptoKeyStoreConfig != nil {
 		// Add default token name, lifetime, etc.
@@ -250,7 +331,22 @@ func (mgr *InstanceManager) Register(ctx context.Context, m *Authorizer) error {
 	}
 
 	if len(m.CryptoKeyConfigs) == 0 {
-		if err := ks.AutoGenerate("default", "ES512"); err != nil {
+		algo := "ES512"
+		if v, exists := m.CryptoKeyStoreConfig["autogenerate_algorithm"]; exists {
+			algo = v.(string)
+		}
+		if v, exists := m.CryptoKeyStoreConfig["autogenerate_storage"]; exists {
+			switch v.(string) {
+			case "file":
+				ks.SetStorage(kms.NewFileCryptoKeyStorage(m.CryptoKeyStoreConfig["autogenerate_storage_path"].(string)))
+			case "caddy":
+				if m.storage == nil {
+					return errors.ErrInvalidConfiguration.WithArgs(m.Name, "caddy storage is not available")
+				}
+				ks.SetStorage(m.storage)
+			}
+		}
+		if err := ks.AutoGenerate("default", algo); err != nil {
 			return errors.ErrInvalidConfiguration.WithArgs(m.Name, err)
 		}
 	} else {
@@ -286,10 +382,46 @@ func (mgr *InstanceManager) Register(ctx context.Context, m *Authorizer) error {
 	}
 
 	// Configure token validator with keys and access list.
-	if err := m.tokenValidator.Configure(ctx, ks.GetVerifyKeys(), accessList, m.opts); err != nil {
+	m.tokenValidator.SetLogger(m.logger)
+	var keys []*kms.CryptoKey
+	keys = append(keys, ks.GetVerifyKeys()...)
+	keys = append(keys, ks.GetDecryptKeys()...)
+	if err := m.tokenValidator.Configure(ctx, keys, accessList, m.opts); err != nil {
 		return errors.ErrInvalidConfiguration.WithArgs(m.Name, err)
 	}
 
+	// Add token introspection endpoint to the token validator.
+	if m.IntrospectionConfig == nil && !m.PrimaryInstance {
+		m.IntrospectionConfig = primaryInstance.IntrospectionConfig
+	}
+	if m.IntrospectionConfig != nil {
+		if err := m.tokenValidator.RegisterIntrospectionEndpoint(m.IntrospectionConfig); err != nil {
+			return errors.ErrInvalidConfiguration.WithArgs(m.Name, err)
+		}
+	}
+
+	// Add the list of revoked tokens to the token validator. The non-primary
+	// instances without revocation config share the list of the primary
+	// instance. The revocations pushed to the context prior to the reload
+	// are added to the new lists.
+	if m.RevocationConfig == nil && !m.PrimaryInstance {
+		m.revocations = primaryInstance.revocations
+	} else {
+		revocations, err := validator.NewRevocationList(m.RevocationConfig)
+		if err != nil {
+			return errors.ErrInvalidConfiguration.WithArgs(m.Name, err)
+		}
+		revocations.SetLogger(m.logger)
+		if entries := mgr.revokedTokens[m.Context]; len(entries) > 0 {
+			if err := revocations.Revoke(entries); err != nil {
+				return errors.ErrInvalidConfiguration.WithArgs(m.Name, err)
+			}
+		}
+		mgr.revocationLists[m.Context] = append(mgr.revocationLists[m.Context], revocations)
+		m.revocations = revocations
+	}
+	m.tokenValidator.SetRevocationList(m.revocations)
+
 	// Set allow token sources and their priority.
 	if len(m.AllowedTokenSources) == 0 && !m.PrimaryInstance {
 		m.AllowedTokenSources = primaryInstance.AllowedTokenSources
@@ -300,6 +432,18 @@ func (mgr *InstanceManager) Register(ctx context.Context, m *Authorizer) error {
 		}
 	}
 
+	// Enable the guardians registered by the plugins.
+	if len(m.Guardians) == 0 && !m.PrimaryInstance {
+		m.Guardians = primaryInstance.Guardians
+	}
+	if len(m.Guardians) > 0 {
+		if err := m.tokenValidator.SetGuardians(m.Guardians); err != nil {
+			return errors.ErrInvalidConfiguration.WithArgs(m.Name, err)
+		}
+	}
+
+	m.keystore = ks
+
 	m.logger.Debug(
 		"JWT token configuration provisioned",
 		zap.String("instance_name", m.Name),
@@ -312,6 +456,81 @@ func (mgr *InstanceManager) Register(ctx context.Context, m *Authorizer) error {
 	return nil
 }
 
+// GetJSONWebKeySet returns the public verification keys of the primary
+// instance of the provided context as JSON Web Key Set.
+func (mgr *InstanceManager) GetJSONWebKeySet(ctxName string) (*kms.JSONWebKeySet, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if ctxName == "" {
+		ctxName = "default"
+	}
+	m, exists := mgr.PrimaryInstances[ctxName]
+	if !exists || m.keystore == nil {
+		return nil, errors.ErrInstanceManagerContextNotFound.WithArgs(ctxName)
+	}
+	return m.keystore.GetJSONWebKeySet(), nil
+}
+
+// RevokeTokens adds the revoked tokens to the lists of revoked tokens of all
+// instances of the provided context. The revoked tokens are retained by the
+// manager and added to the lists created upon the reload of the config.
+func (mgr *InstanceManager) RevokeTokens(ctxName string, entries []*validator.RevokedToken) error {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if ctxName == "" {
+		ctxName = "default"
+	}
+	lists := mgr.revocationLists[ctxName]
+	if len(lists) == 0 {
+		return errors.ErrInstanceManagerContextNotFound.WithArgs(ctxName)
+	}
+	for _, e := range entries {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, revocations := range lists {
+		if err := revocations.Revoke(entries); err != nil {
+			return err
+		}
+	}
+
+	// Drop the expired revocations prior to adding the new ones.
+	now := time.Now().Unix()
+	var revokedTokens []*validator.RevokedToken
+	for _, e := range mgr.revokedTokens[ctxName] {
+		if e.ExpiresAt > 0 && e.ExpiresAt < now {
+			continue
+		}
+		revokedTokens = append(revokedTokens, e)
+	}
+	mgr.revokedTokens[ctxName] = append(revokedTokens, entries...)
+	return nil
+}
+
+// GetRevokedTokens returns the revoked tokens of the primary instance of the
+// provided context.
+func (mgr *InstanceManager) GetRevokedTokens(ctxName string) ([]*validator.RevokedToken, error) {
+	revocations, err := mgr.getRevocationList(ctxName)
+	if err != nil {
+		return nil, err
+	}
+	return revocations.GetRevokedTokens(), nil
+}
+
+func (mgr *InstanceManager) getRevocationList(ctxName string) (*validator.RevocationList, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if ctxName == "" {
+		ctxName = "default"
+	}
+	m, exists := mgr.PrimaryInstances[ctxName]
+	if !exists || m.revocations == nil {
+		return nil, errors.ErrInstanceManagerContextNotFound.WithArgs(ctxName)
+	}
+	return m.revocations, nil
+}
+
 func (mgr *InstanceManager) incrementMemberCount(ctxName string) int {
 	if _, exists := mgr.MemberCount[ctxName]; exists {
 		mgr.MemberCount[ctxName]++
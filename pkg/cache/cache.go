@@ -25,12 +25,19 @@ import (
 type TokenCache struct {
 	mu      sync.RWMutex
 	Entries map[string]*user.User `json:"entries,omitempty" xml:"entries,omitempty" yaml:"entries,omitempty"`
+	// expiresAt holds the expiry of the entries cached for a shorter time
+	// than the lifetime of their tokens, see AddWithExpiry.
+	expiresAt map[string]int64
+	// leeway is the tolerated clock skew when validating the expiry of the
+	// cached tokens.
+	leeway time.Duration
 }
 
 // NewTokenCache returns TokenCache instance.
 func NewTokenCache(i int) *TokenCache {
 	c := &TokenCache{
-		Entries: make(map[string]*user.User),
+		Entries:   make(map[string]*user.User),
+		expiresAt: make(map[string]int64),
 	}
 	go manageTokenCache(i, c)
 	return c
@@ -53,8 +60,16 @@ func manageTokenCache(i int, cache *TokenCache) {
 		}
 		cache.mu.RUnlock()
 		cache.mu.Lock()
+		now := time.Now()
 		for k, usr := range cache.Entries {
-			if err := usr.Claims.Valid(); err != nil {
+			if expiresAt, exists := cache.expiresAt[k]; exists {
+				if expiresAt < now.Unix() {
+					delete(cache.Entries, k)
+					delete(cache.expiresAt, k)
+				}
+				continue
+			}
+			if usr.Claims.ExpiresAt < now.Add(-cache.leeway).Unix() {
 				delete(cache.Entries, k)
 			}
 		}
@@ -62,6 +77,14 @@ func manageTokenCache(i int, cache *TokenCache) {
 	}
 }
 
+// SetLeeway sets the tolerated clock skew when validating the expiry of the
+// cached tokens.
+func (c *TokenCache) SetLeeway(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leeway = d
+}
+
 // Add adds a token and the associated claim to cache.
 func (c *TokenCache) Add(usr *user.User) error {
 	if usr == nil {
@@ -74,6 +97,27 @@ func (c *TokenCache) Add(usr *user.User) error {
 	defer c.mu.Unlock()
 	usr.Cached = true
 	c.Entries[usr.Token] = usr
+	delete(c.expiresAt, usr.Token)
+	return nil
+}
+
+// AddWithExpiry adds a token and the associated claim to cache. The entry
+// expires at the provided time, as opposed to the expiry of the token.
+func (c *TokenCache) AddWithExpiry(usr *user.User, expiresAt int64) error {
+	if usr == nil {
+		return errors.ErrCacheNilUser
+	}
+	if usr.Token == "" {
+		return errors.ErrCacheEmptyToken
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	usr.Cached = true
+	c.Entries[usr.Token] = usr
+	if c.expiresAt == nil {
+		c.expiresAt = make(map[string]int64)
+	}
+	c.expiresAt[usr.Token] = expiresAt
 	return nil
 }
 
@@ -82,20 +126,42 @@ func (c *TokenCache) Delete(token string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	delete(c.Entries, token)
+	delete(c.expiresAt, token)
 	return nil
 }
 
+// DeleteMatching removes the cached tokens matched by the provided function,
+// and returns the number of the removed tokens.
+func (c *TokenCache) DeleteMatching(match func(token string, usr *user.User) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for token, usr := range c.Entries {
+		if match(token, usr) {
+			delete(c.Entries, token)
+			delete(c.expiresAt, token)
+			n++
+		}
+	}
+	return n
+}
+
 // Get returns User instance if the token associated with
 // the claim exists in cache. If the token is expired, it
 // will be removed from the cache.
 func (c *TokenCache) Get(token string) *user.User {
 	c.mu.RLock()
 	usr, exists := c.Entries[token]
+	expiresAt, overridden := c.expiresAt[token]
+	leeway := c.leeway
 	c.mu.RUnlock()
 	if !exists {
 		return nil
 	}
-	if usr.Claims.ExpiresAt < time.Now().Unix() {
+	if !overridden {
+		expiresAt = usr.Claims.ExpiresAt + int64(leeway/time.Second)
+	}
+	if expiresAt < time.Now().Unix() {
 		c.Delete(token)
 		return nil
 	}
@@ -132,3 +132,42 @@ func TestTokenCache(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenCacheWithExpiry(t *testing.T) {
+	c := NewTokenCache(100)
+	testcases := []struct {
+		name      string
+		expiresAt int64
+		tokenExp  int64
+		want      bool
+	}{
+		{
+			name:      "entry expiring before token",
+			expiresAt: time.Now().Add(-time.Minute).Unix(),
+			tokenExp:  time.Now().Add(10 * time.Minute).Unix(),
+		},
+		{
+			name:      "entry of token without expiry",
+			expiresAt: time.Now().Add(time.Minute).Unix(),
+			want:      true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			usr := testutils.NewTestUser()
+			usr.Token = tc.name
+			usr.Claims.ExpiresAt = tc.tokenExp
+			if err := c.AddWithExpiry(usr, tc.expiresAt); err != nil {
+				t.Fatal(err)
+			}
+			tests.EvalObjectsWithLog(t, "cached", tc.want, c.Get(usr.Token) != nil, msgs)
+			// The cache manager removes expired entries only.
+			time.Sleep(time.Millisecond * time.Duration(200))
+			c.mu.RLock()
+			_, exists := c.Entries[usr.Token]
+			c.mu.RUnlock()
+			tests.EvalObjectsWithLog(t, "managed", tc.want, exists, msgs)
+		})
+	}
+}
@@ -80,11 +80,16 @@ const (
 	ErrPrivateSigningKeyNotFound          StandardError = "private key for signing not found"
 	ErrNoBackends                         StandardError = "no token backends available"
 	ErrExpiredToken                       StandardError = "expired token"
+	ErrTokenNotYetValid                   StandardError = "token is not valid yet"
+	ErrTokenIssuedInFuture                StandardError = "token is issued in the future"
 	ErrNoAccessList                       StandardError = "user role is valid, but denied by default deny on empty access list"
 	ErrAccessNotAllowed                   StandardError = "user role is valid, but not allowed by access list"
 	ErrAccessNotAllowedByPathACL          StandardError = "user role is valid, but not allowed by path access list"
 	ErrSourceAddressNotFound              StandardError = "source ip validation is enabled, but no ip address claim found"
 	ErrSourceAddressMismatch              StandardError = "source ip address mismatch between the claim %s and request %s"
+	ErrClientCertificateNotFound          StandardError = "client certificate validation is enabled, but no client certificate found"
+	ErrClientCertificateClaimNotFound     StandardError = "client certificate validation is enabled, but no certificate thumbprint claim found"
+	ErrClientCertificateMismatch          StandardError = "client certificate thumbprint mismatch between the claim %s and request %s"
 	ErrNoParsedClaims                     StandardError = "failed to extract claims"
 	ErrNoTokenFound                       StandardError = "no token found"
 	ErrInvalidParsedClaims                StandardError = "failed to extract claims: %s"
@@ -133,5 +138,6 @@ const (
 	ErrFailed                             StandardError = "encountered error: %v"
 
 	// InstanceManager errors.
-	ErrInstanceManagerValidate StandardError = "instance %q validation failed: %v"
+	ErrInstanceManagerValidate        StandardError = "instance %q validation failed: %v"
+	ErrInstanceManagerContextNotFound StandardError = "no primary instance found for %q context"
 )
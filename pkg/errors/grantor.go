@@ -22,4 +22,6 @@ const (
 	ErrTokenGrantorKeyNoSigningCapability StandardError = "token grantor: key has no signing capability"
 	ErrTokenGrantorKeyTokenNameNotSet     StandardError = "token grantor: key has no token name set"
 	ErrTokenGrantorKeyMaxLifetimeNotSet   StandardError = "token grantor: key has no max token lifetime set"
+	ErrTokenGrantorSourceAddressNotFound  StandardError = "token grantor: source address not provided"
+	ErrTokenGrantorExpiryNotInFuture      StandardError = "token grantor: expiry %d is not in the future"
 )
@@ -30,20 +30,60 @@ const (
 	ErrCryptoKeyConfigEntryInvalid              StandardError = "key config entry %q is invalid: %v"
 	ErrCryptoKeyConfigNoConfigFound             StandardError = "no key configs found"
 	ErrCryptoKeyConfigKeyInvalid                StandardError = "key config %d is invalid: %v"
+	ErrCryptoKeyConfigSignMethodUnsupported     StandardError = "kms: key %q does not support %q token signing method"
+	ErrCryptoKeyConfigVerifyMethodUnsupported   StandardError = "kms: key %q does not support %q token verification method"
+	ErrCryptoKeyConfigEvalExprInvalid           StandardError = "kms: key eval expression %q is invalid: %v"
+
+	// Token signing algorithm allow-list
+	ErrCryptoKeyAlgorithmNotAllowed      StandardError = "kms: key %q does not accept %q token signing algorithm"
+	ErrCryptoKeyStoreAlgorithmNotAllowed StandardError = "keystore: token signing algorithm %q is not allowed"
+
+	// JSON Web Key Set
+	ErrJSONWebKeyParamInvalid          StandardError = "kms: jwk %q has invalid %q parameter: %v"
+	ErrJSONWebKeyUnsupportedKeyType    StandardError = "kms: jwk %q has unsupported key type %q"
+	ErrJSONWebKeyAlgorithmMismatch     StandardError = "kms: jwk %q algorithm %q does not match key type %q"
+	ErrJSONWebKeyAlgorithmNotAllowed   StandardError = "kms: jwk %q algorithms are not allowed by key config"
+	ErrJSONWebKeyNoVerifyKey           StandardError = "kms: jwk requires a key with verification capabilities"
+	ErrJSONWebKeyThumbprintFailed      StandardError = "kms: jwk %q thumbprint failed: %v"
+	ErrCryptoKeyJwksFetch              StandardError = "kms: failed to fetch jwks from %q: %v"
+	ErrCryptoKeyJwksParse              StandardError = "kms: failed to parse jwks from %q: %v"
+	ErrCryptoKeyJwksNoKeysFound        StandardError = "kms: jwks has no signature verification keys"
+	ErrCryptoKeyJwksKeyNotFound        StandardError = "kms: key id %q not found in jwks %q"
+	ErrCryptoKeyJwksKeyIDNotProvided   StandardError = "kms: token has no key id and jwks %q has multiple keys"
+	ErrCryptoKeyCertificateNotFound    StandardError = "kms: no certificates found"
+	ErrCryptoKeyCertificateInvalid     StandardError = "kms: certificate of key %q failed verification: %v"
+	ErrCryptoKeyCABundleInvalid        StandardError = "kms: failed to load ca bundle %q: %v"
+	ErrCryptoKeyPublicKeyUsage         StandardError = "kms: public key does not support %q key usage"
+	ErrCryptoKeyPassphraseNotFound     StandardError = "kms: private key is encrypted, but passphrase is not configured"
+	ErrCryptoKeyPassphraseIncorrect    StandardError = "kms: failed to decrypt private key: incorrect passphrase"
+	ErrCryptoKeyDecryptFailed          StandardError = "kms: failed to decrypt private key: %v"
+	ErrCryptoKeyOidcDiscovery          StandardError = "kms: failed oidc discovery for %q: %v"
+	ErrCryptoKeyOidcIssuerMismatch     StandardError = "kms: oidc issuer %q does not match discovered issuer %q"
+	ErrCryptoKeyDecryptKeyNotPrivate   StandardError = "kms: key %q with decrypt usage requires private key or shared secret"
+	ErrCryptoKeyDecryptSecretLength    StandardError = "kms: key %q with decrypt usage requires 32-byte shared secret, got %d bytes"
+	ErrCryptoKeyDecryptUnsupportedAlgo StandardError = "kms: key %q with %q algorithm does not support decryption"
 
 	// KeyManager
 	ErrKeyManagerAddKeyNil                  StandardError = "kms: failed adding nil key to key manager"
 	ErrKeyManagerCryptoKeyConfigInvalidType StandardError = "kms: failed key manager with invalid token config type: %T"
 	// Keystore
-	ErrKeystoreAddKeyNil                      StandardError = "keystore: failed adding nil key to keystore"
-	ErrCryptoKeyStoreAddKeyNil                StandardError = "keystore: failed adding nil key to keystore"
-	ErrCryptoKeyStoreParseTokenFailed         StandardError = "keystore: failed to parse token"
-	ErrCryptoKeyStoreSignTokenFailed          StandardError = "keystore: failed to sign token"
-	ErrCryptoKeyStoreNoVerifyKeysFound        StandardError = "keystore: no verification keys found"
-	ErrCryptoKeyStoreNoSignKeysFound          StandardError = "keystore: no signing keys found"
-	ErrCryptoKeyStoreAutoGenerateNotAvailable StandardError = "auto-generate not available when keystore is not empty"
-	ErrCryptoKeyStoreAutoGenerateFailed       StandardError = "failed to auto-generate keystore keypair: %v"
-	ErrCryptoKeyStoreAutoGenerateAlgo         StandardError = "auto-generate does not support %q algorithm"
+	ErrKeystoreAddKeyNil                        StandardError = "keystore: failed adding nil key to keystore"
+	ErrCryptoKeyStoreAddKeyNil                  StandardError = "keystore: failed adding nil key to keystore"
+	ErrCryptoKeyStoreParseTokenFailed           StandardError = "keystore: failed to parse token"
+	ErrCryptoKeyStoreTokenKeyIDNotFound         StandardError = "keystore: token has no key id"
+	ErrCryptoKeyStoreSignTokenFailed            StandardError = "keystore: failed to sign token"
+	ErrCryptoKeyStoreNoVerifyKeysFound          StandardError = "keystore: no verification keys found"
+	ErrCryptoKeyStoreNoSignKeysFound            StandardError = "keystore: no signing keys found"
+	ErrCryptoKeyStoreNoActiveSignKeyFound       StandardError = "keystore: no signing keys active at %s"
+	ErrCryptoKeyStoreTokenKeyExpired            StandardError = "keystore: token verified by key %q expired at %s"
+	ErrCryptoKeyStoreNoDecryptKeysFound         StandardError = "keystore: no decryption keys found"
+	ErrCryptoKeyStoreTokenDecryptFailed         StandardError = "keystore: failed to decrypt token: %v"
+	ErrCryptoKeyStoreTokenEncryptionUnsupported StandardError = "keystore: token encryption algorithm %q is not supported"
+	ErrCryptoKeyStorePasetoTokenUnsupported     StandardError = "keystore: PASETO token %q is not supported"
+	ErrCryptoKeyStorePasetoTokenMalformed       StandardError = "keystore: malformed PASETO token: %v"
+	ErrCryptoKeyStoreAutoGenerateNotAvailable   StandardError = "auto-generate not available when keystore is not empty"
+	ErrCryptoKeyStoreAutoGenerateFailed         StandardError = "failed to auto-generate keystore keypair: %v"
+	ErrCryptoKeyStoreAutoGenerateAlgo           StandardError = "auto-generate does not support %q algorithm"
 	// Signing
 	ErrUnsupportedSigningMethod StandardError = "kms: grantor does not support %s token signing method"
 )
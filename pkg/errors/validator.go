@@ -22,9 +22,75 @@ const (
 	ErrInvalidSourcePriority               StandardError = "token validator: invalid token source priority"
 	ErrInvalidSourceName                   StandardError = "token validator: invalid token source name: %s"
 	ErrDuplicateSourceName                 StandardError = "token validator: duplicate token source name: %s"
+	ErrInvalidSourceConfig                 StandardError = "token validator: invalid token source %s: %v"
+	ErrTokenSourceArgNotFound              StandardError = "%s not found"
+	ErrTokenSourceRegistered               StandardError = "token validator: token source %s is already registered"
 	ErrTokenNamesNotFound                  StandardError = "token validator: allowed token names not provided"
 	ErrEmptyTokenName                      StandardError = "token validator: a token name is empty"
 	ErrDuplicateTokenName                  StandardError = "token validator: duplicate allowed token name: %s"
 	ErrTokenValidatorOptionsNotFound       StandardError = "token validator: options not found"
 	ErrValidatorIdentityProvider           StandardError = "token validator: identity provider config is nil"
+	ErrValidatorIntrospectionConfig        StandardError = "token validator: introspection config is nil"
+	ErrValidatorAudienceNotFound           StandardError = "token validator: token has no audience"
+	ErrValidatorAudienceNotAllowed         StandardError = "token validator: token audience %v is not allowed"
+	ErrValidatorIssuerNotFound             StandardError = "token validator: token has no issuer"
+	ErrValidatorIssuerNotAllowed           StandardError = "token validator: token issuer %q is not allowed"
+	ErrValidatorIssuedAtNotFound           StandardError = "token validator: token has no issued at time"
+	ErrValidatorTokenMaxAgeExceeded        StandardError = "token validator: token issued at %s exceeds max age of %d seconds"
+	ErrValidatorRequiredClaimNotFound      StandardError = "token validator: required claim %q not found"
+	ErrValidatorRequiredClaimTypeMismatch  StandardError = "token validator: required claim %q is not %s"
+	ErrValidatorRequiredClaimTypeInvalid   StandardError = "token validator: required claim %q has unsupported type %q"
+	ErrValidatorTokenRevoked               StandardError = "token validator: token is revoked"
+	ErrValidatorInvalidDPoPProof           StandardError = "token validator: invalid DPoP proof: %v"
+	ErrValidatorInvalidDPoPToken           StandardError = "token validator: invalid DPoP token: %v"
+	ErrValidatorGuardianNil                StandardError = "token validator: guardian is nil"
+	ErrInvalidGuardianName                 StandardError = "token validator: invalid guardian name: %s"
+	ErrDuplicateGuardianName               StandardError = "token validator: duplicate guardian name: %s"
+	ErrInvalidGuardianConfig               StandardError = "token validator: invalid guardian %s: %v"
+	ErrGuardianRegistered                  StandardError = "token validator: guardian %s is already registered"
+)
+
+// Token Introspection Errors
+const (
+	ErrIntrospectionEndpointNotFound     StandardError = "introspection: endpoint url not found"
+	ErrIntrospectionEndpointInvalid      StandardError = "introspection: endpoint url %q is invalid"
+	ErrIntrospectionClientSecretNotFound StandardError = "introspection: client secret not found for client id %q"
+	ErrIntrospectionCacheTTLInvalid      StandardError = "introspection: cache ttl %d is invalid"
+	ErrIntrospectionRequestFailed        StandardError = "introspection: request failed: %v"
+	ErrIntrospectionResponseStatus       StandardError = "introspection: unexpected response status: %s"
+	ErrIntrospectionResponseMalformed    StandardError = "introspection: malformed response: %v"
+	ErrIntrospectionTokenInactive        StandardError = "introspection: token is not active"
+	ErrIntrospectionTokenExpired         StandardError = "introspection: token is expired"
+)
+
+// Token Revocation Errors
+const (
+	ErrRevocationFilePathNotFound       StandardError = "revocation: file path not found"
+	ErrRevocationRefreshIntervalInvalid StandardError = "revocation: refresh interval %d is invalid"
+	ErrRevocationEntryEmpty             StandardError = "revocation: entry has no token id, subject, or token hash"
+	ErrRevocationFileRead               StandardError = "revocation: failed reading %q: %v"
+	ErrRevocationFileMalformed          StandardError = "revocation: malformed file %q: %v"
+)
+
+// DPoP Errors
+const (
+	ErrDPoPProofNotFound            StandardError = "dpop: proof not found"
+	ErrDPoPProofMultiple            StandardError = "dpop: multiple proofs found"
+	ErrDPoPProofMalformed           StandardError = "dpop: malformed proof: %v"
+	ErrDPoPProofTypeInvalid         StandardError = "dpop: proof type %q is invalid"
+	ErrDPoPProofAlgorithmNotAllowed StandardError = "dpop: proof algorithm %q is not allowed"
+	ErrDPoPProofKeyNotFound         StandardError = "dpop: proof has no jwk header"
+	ErrDPoPProofKeyInvalid          StandardError = "dpop: proof jwk header is invalid: %v"
+	ErrDPoPProofKeyPrivate          StandardError = "dpop: proof jwk header contains private key"
+	ErrDPoPProofSignatureInvalid    StandardError = "dpop: proof signature is invalid: %v"
+	ErrDPoPProofMethodMismatch      StandardError = "dpop: proof method %q does not match request method %q"
+	ErrDPoPProofURLMismatch         StandardError = "dpop: proof url %q does not match request url %q"
+	ErrDPoPProofIssuedAtNotFound    StandardError = "dpop: proof has no issued at time"
+	ErrDPoPProofIssuedAtInvalid     StandardError = "dpop: proof issued at %s is outside of the acceptable window"
+	ErrDPoPProofTokenIDNotFound     StandardError = "dpop: proof has no token id"
+	ErrDPoPProofReplayed            StandardError = "dpop: proof with token id %q was already used"
+	ErrDPoPProofTokenHashMismatch   StandardError = "dpop: proof access token hash does not match"
+	ErrDPoPTokenNotBound            StandardError = "dpop: token is not bound to a key"
+	ErrDPoPTokenThumbprintMismatch  StandardError = "dpop: token key thumbprint does not match proof key"
+	ErrDPoPTokenNotPresentedAsDPoP  StandardError = "dpop: token bound to a key is not presented with DPoP scheme"
 )
@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -39,18 +40,26 @@ var (
 		"verify":      true,
 		"sign-verify": true,
 		"auto":        true,
+		"decrypt":     true,
 		"and":         true,
 		"token":       true,
 		"lifetime":    true,
 		"from":        true,
 		"env":         true,
 		"as":          true,
+		"jwks":        true,
+		"watch":       true,
+		"not":         true,
+		"ca":          true,
+		"passphrase":  true,
+		"format":      true,
 	}
 	reservedUsageKeywords = map[string]bool{
 		"sign":        true,
 		"verify":      true,
 		"sign-verify": true,
 		"auto":        true,
+		"decrypt":     true,
 	}
 )
 
@@ -65,9 +74,14 @@ type CryptoKeyConfig struct {
 	Usage string `json:"usage,omitempty" xml:"usage,omitempty" yaml:"usage,omitempty"`
 	// TokenName is the token name associated with the key.
 	TokenName string `json:"token_name,omitempty" xml:"token_name,omitempty" yaml:"token_name,omitempty"`
+	// TokenType is the type of the tokens verified by the key. The values
+	// are: jwt, the default, or paseto. The shared keys decrypt PASETO
+	// v4.local tokens only when the type is paseto, and the keys of that
+	// type are not used with JWT tokens.
+	TokenType string `json:"token_type,omitempty" xml:"token_type,omitempty" yaml:"token_type,omitempty"`
 	// Source is either config or env.
 	Source string `json:"source,omitempty" xml:"source,omitempty" yaml:"source,omitempty"`
-	// Algorithm is either hmac, rsa, or ecdsa.
+	// Algorithm is either hmac, rsa, ecdsa, or eddsa.
 	Algorithm string `json:"algorithm,omitempty" xml:"algorithm,omitempty" yaml:"algorithm,omitempty"`
 	// EnvVarName is the name of environment variables holding either the value of
 	// a key or the path a directory or file containing a key.
@@ -82,6 +96,42 @@ type CryptoKeyConfig struct {
 	FilePath string `json:"file_path,omitempty" xml:"file_path,omitempty" yaml:"file_path,omitempty"`
 	// DirPath is the path to a directory containing crypto keys.
 	DirPath string `json:"dir_path,omitempty" xml:"dir_path,omitempty" yaml:"dir_path,omitempty"`
+	// PassphraseEnvVarName is the name of the environment variable holding
+	// the passphrase of an encrypted private key.
+	PassphraseEnvVarName string `json:"passphrase_env_var_name,omitempty" xml:"passphrase_env_var_name,omitempty" yaml:"passphrase_env_var_name,omitempty"`
+	// CABundlePath is the path to a file with PEM encoded CA certificates.
+	// When set, the chain and the expiry of the X.509 certificates holding
+	// the keys are verified against the CA certificates.
+	CABundlePath string `json:"ca_bundle_path,omitempty" xml:"ca_bundle_path,omitempty" yaml:"ca_bundle_path,omitempty"`
+	// FileFormats are the formats of the key files, in addition to PEM
+	// encoded keys, i.e. "certificate" for X.509 certificates in .crt and
+	// .cer files, and "jwk" for JSON Web Keys in .jwk, .jwks, and .json
+	// files. The certificates are enabled by CABundlePath as well.
+	FileFormats []string `json:"file_formats,omitempty" xml:"file_formats,omitempty" yaml:"file_formats,omitempty"`
+	// JwksURL is the URL of a remote JSON Web Key Set with verification keys.
+	JwksURL string `json:"jwks_url,omitempty" xml:"jwks_url,omitempty" yaml:"jwks_url,omitempty"`
+	// JwksRefreshInterval is the interval in seconds after which the keys
+	// fetched from JwksURL are refreshed.
+	JwksRefreshInterval int `json:"jwks_refresh_interval,omitempty" xml:"jwks_refresh_interval,omitempty" yaml:"jwks_refresh_interval,omitempty"`
+	// WatchInterval is the interval in seconds at which the file or the
+	// directory with the keys is checked for changes. When the keys change,
+	// they are reloaded without a server reload. By default, the keys are
+	// loaded once.
+	WatchInterval int `json:"watch_interval,omitempty" xml:"watch_interval,omitempty" yaml:"watch_interval,omitempty"`
+	// WatchGracePeriod is the period in seconds during which the keys
+	// replaced by reloaded keys remain valid for token verification.
+	// The default is 300 seconds.
+	WatchGracePeriod int `json:"watch_grace_period,omitempty" xml:"watch_grace_period,omitempty" yaml:"watch_grace_period,omitempty"`
+	// NotBefore is the time before which the key is not used for signing
+	// tokens. It allows pre-staging a signing key.
+	NotBefore time.Time `json:"not_before,omitempty" xml:"not_before,omitempty" yaml:"not_before,omitempty"`
+	// NotAfter is the time after which the key is neither used for signing
+	// nor for verifying tokens. It allows retiring a key on a date.
+	NotAfter time.Time `json:"not_after,omitempty" xml:"not_after,omitempty" yaml:"not_after,omitempty"`
+	// OidcIssuerURL is the issuer URL of an OpenID Connect provider. The
+	// verification keys and the expected token issuer are discovered via
+	// the provider's metadata.
+	OidcIssuerURL string `json:"oidc_issuer_url,omitempty" xml:"oidc_issuer_url,omitempty" yaml:"oidc_issuer_url,omitempty"`
 	// TokenLifetime is the expected token grant lifetime in seconds.
 	TokenLifetime int `json:"token_lifetime,omitempty" xml:"token_lifetime,omitempty" yaml:"token_lifetime,omitempty"`
 	// Secret is the shared key used with HMAC algorithm.
@@ -89,10 +139,19 @@ type CryptoKeyConfig struct {
 	// PreferredSignMethod is the preferred method to sign tokens, e.g.
 	// all HMAC keys could use HS256, HS384, and HS512 methods. By default,
 	// the preferred method is HS512. However, one may prefer using HS256.
+	// Similarly, RSA keys default to RS512, but could use PS256.
 	PreferredSignMethod string `json:"token_sign_method,omitempty" xml:"token_sign_method,omitempty" yaml:"token_sign_method,omitempty"`
+	// VerifyMethods is the list of the token signing algorithms the key
+	// accepts when verifying tokens. By default, a key accepts all the
+	// methods of its algorithm, e.g. RS256, RS384, RS512, PS256, etc.
+	VerifyMethods []string `json:"token_verify_methods,omitempty" xml:"token_verify_methods,omitempty" yaml:"token_verify_methods,omitempty"`
 	// EvalExpr is a list of expressions evaluated whether a specific key
-	// should be used for signing and verification.
+	// should be used for token verification. The key is used when all the
+	// expressions match the request and the claims of the token, e.g. to
+	// select the keys of a tenant. See evalExpr for the syntax.
 	EvalExpr []string `json:"token_eval_expr,omitempty" xml:"token_eval_expr" yaml:"token_eval_expr"`
+	// evalExprs holds the compiled EvalExpr expressions.
+	evalExprs []*evalExpr
 	// parsed indicated whether the key was parsed via config.
 	parsed bool
 	// validated indicated whether the key config was validated.
@@ -124,6 +183,33 @@ func (k *CryptoKeyConfig) ToString() string {
 	if k.DirPath != "" {
 		sb.WriteString(", dir path: " + k.DirPath)
 	}
+	if k.CABundlePath != "" {
+		sb.WriteString(", ca bundle path: " + k.CABundlePath)
+	}
+	if len(k.FileFormats) > 0 {
+		sb.WriteString(", file formats: " + strings.Join(k.FileFormats, " "))
+	}
+	if k.PassphraseEnvVarName != "" {
+		sb.WriteString(", passphrase env var: " + k.PassphraseEnvVarName)
+	}
+	if k.JwksURL != "" {
+		sb.WriteString(", jwks url: " + k.JwksURL)
+	}
+	if k.OidcIssuerURL != "" {
+		sb.WriteString(", oidc issuer url: " + k.OidcIssuerURL)
+	}
+	if k.WatchInterval > 0 {
+		sb.WriteString(fmt.Sprintf(", watch interval: %d", k.WatchInterval))
+	}
+	if k.WatchGracePeriod > 0 {
+		sb.WriteString(fmt.Sprintf(", watch grace period: %d", k.WatchGracePeriod))
+	}
+	if !k.NotBefore.IsZero() {
+		sb.WriteString(", not before: " + k.NotBefore.Format(time.RFC3339))
+	}
+	if !k.NotAfter.IsZero() {
+		sb.WriteString(", not after: " + k.NotAfter.Format(time.RFC3339))
+	}
 	if k.validated || k.parsed {
 		sb.WriteString(", flags:")
 		if k.parsed {
@@ -136,12 +222,55 @@ func (k *CryptoKeyConfig) ToString() string {
 	if k.TokenName != "" {
 		sb.WriteString(", token name=" + k.TokenName)
 	}
+	if k.TokenType != "" {
+		sb.WriteString(" type=" + k.TokenType)
+	}
 	if k.TokenLifetime != 0 {
 		sb.WriteString(fmt.Sprintf(" lifetime=%d", k.TokenLifetime))
 	}
+	if k.PreferredSignMethod != "" {
+		sb.WriteString(" method=" + k.PreferredSignMethod)
+	}
+	if len(k.VerifyMethods) > 0 {
+		sb.WriteString(" accept=" + strings.Join(k.VerifyMethods, ","))
+	}
+	if len(k.EvalExpr) > 0 {
+		sb.WriteString(" eval=" + strings.Join(k.EvalExpr, ";"))
+	}
 	return sb.String()
 }
 
+// hasFileFormat returns true when the key files in the format are enabled.
+func (k *CryptoKeyConfig) hasFileFormat(format string) bool {
+	if format == "certificate" && k.CABundlePath != "" {
+		return true
+	}
+	for _, s := range k.FileFormats {
+		if s == format {
+			return true
+		}
+	}
+	return false
+}
+
+// getFileExtensions returns the extensions of the key files, i.e. the
+// extensions of PEM encoded keys and of the enabled file formats.
+func (k *CryptoKeyConfig) getFileExtensions() map[string]bool {
+	exts := make(map[string]bool)
+	for ext := range keyFileExtensions {
+		exts[ext] = true
+	}
+	for format, arr := range keyFileFormatExtensions {
+		if !k.hasFileFormat(format) {
+			continue
+		}
+		for _, ext := range arr {
+			exts[ext] = true
+		}
+	}
+	return exts
+}
+
 func (k *CryptoKeyConfig) loadEnvVar() error {
 	v := os.Getenv(k.EnvVarName)
 	v = strings.TrimSpace(v)
@@ -154,7 +283,7 @@ func (k *CryptoKeyConfig) loadEnvVar() error {
 
 func (k *CryptoKeyConfig) validate() error {
 	switch k.Usage {
-	case "verify", "sign", "sign-verify", "auto":
+	case "verify", "sign", "sign-verify", "auto", "decrypt":
 	case "":
 		return fmt.Errorf("key usage is not set")
 	default:
@@ -177,8 +306,66 @@ func (k *CryptoKeyConfig) validate() error {
 		return fmt.Errorf("key source %q is invalid", k.Source)
 	}
 
+	if k.JwksURL != "" && k.Usage != "verify" {
+		return fmt.Errorf("key usage %q is not supported with jwks", k.Usage)
+	}
+	if k.OidcIssuerURL != "" && k.Usage != "verify" {
+		return fmt.Errorf("key usage %q is not supported with oidc", k.Usage)
+	}
+
+	switch k.TokenType {
+	case "", "jwt":
+	case "paseto":
+		if k.Usage != "verify" {
+			return fmt.Errorf("key usage %q is not supported with paseto tokens", k.Usage)
+		}
+		if k.JwksURL != "" || k.OidcIssuerURL != "" {
+			return fmt.Errorf("key token type %q is not supported with remote keys", k.TokenType)
+		}
+	default:
+		return fmt.Errorf("key token type %q is invalid", k.TokenType)
+	}
+
+	if k.WatchInterval > 0 || k.WatchGracePeriod > 0 {
+		if k.FilePath == "" && k.DirPath == "" && k.EnvVarType != "file" && k.EnvVarType != "directory" {
+			return fmt.Errorf("key watch is supported with file and directory keys only")
+		}
+		if k.WatchInterval == 0 {
+			return fmt.Errorf("key watch interval is not set")
+		}
+	}
+
+	if k.PassphraseEnvVarName != "" && (k.Algorithm == "hmac" || k.JwksURL != "" || k.OidcIssuerURL != "") {
+		return fmt.Errorf("key passphrase is supported with private keys only")
+	}
+
+	if k.CABundlePath != "" {
+		if k.FilePath == "" && k.DirPath == "" && k.EnvVarType != "file" && k.EnvVarType != "directory" {
+			return fmt.Errorf("key ca bundle is supported with file and directory keys only")
+		}
+	}
+
+	for _, format := range k.FileFormats {
+		if _, exists := keyFileFormatExtensions[format]; !exists {
+			return fmt.Errorf("key file format %q is invalid", format)
+		}
+		if k.FilePath == "" && k.DirPath == "" && k.EnvVarType != "file" && k.EnvVarType != "directory" {
+			return fmt.Errorf("key file format is supported with file and directory keys only")
+		}
+	}
+
+	if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotAfter.After(k.NotBefore) {
+		return fmt.Errorf("key not after time must be later than not before time")
+	}
+
+	for _, expr := range k.EvalExpr {
+		if _, err := parseEvalExpr(expr); err != nil {
+			return fmt.Errorf("key eval expression %q is invalid: %v", expr, err)
+		}
+	}
+
 	switch k.Algorithm {
-	case "hmac", "rsa", "ecdsa", "":
+	case "hmac", "rsa", "ecdsa", "eddsa", "":
 	default:
 		return fmt.Errorf("key algorithm %q is invalid", k.Algorithm)
 	}
@@ -215,6 +402,29 @@ func ParseCryptoKeyStoreConfig(cfg string) (map[string]interface{}, error) {
 			default:
 				return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "contains unsupported 'crypto default token' parameter: %s", args[2])
 			}
+		case "autogenerate":
+			switch args[2] {
+			case "algorithm":
+				if _, exists := autoGenerateAlgorithms[args[3]]; !exists {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, fmt.Sprintf("contains unsupported 'crypto default autogenerate' algorithm: %s", args[3]))
+				}
+				m["autogenerate_algorithm"] = args[3]
+			case "storage":
+				switch args[3] {
+				case "file":
+					if len(args) != 5 {
+						return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "'crypto default autogenerate storage file' must be followed by file path")
+					}
+					m["autogenerate_storage"] = args[3]
+					m["autogenerate_storage_path"] = args[4]
+				case "caddy":
+					m["autogenerate_storage"] = args[3]
+				default:
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, fmt.Sprintf("contains unsupported 'crypto default autogenerate' storage: %s", args[3]))
+				}
+			default:
+				return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, fmt.Sprintf("contains unsupported 'crypto default autogenerate' parameter: %s", args[2]))
+			}
 		default:
 			return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, fmt.Sprintf("contains unsupported 'crypto default' keyword: %s", args[1]))
 		}
@@ -277,6 +487,8 @@ func ParseCryptoKeyConfigs(cfg string) ([]*CryptoKeyConfig, error) {
 				default:
 					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unknown default token setting")
 				}
+			case "autogenerate":
+				// The setting applies to the key store, see ParseCryptoKeyStoreConfig.
 			default:
 				return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unknown default setting")
 			}
@@ -293,6 +505,10 @@ func ParseCryptoKeyConfigs(cfg string) ([]*CryptoKeyConfig, error) {
 		}
 
 		for _, arg := range args {
+			if arg == "eval" {
+				// The expression may contain the usage keywords.
+				break
+			}
 			if _, exists := reservedUsageKeywords[arg]; exists {
 				keyUsage = arg
 				break
@@ -360,17 +576,122 @@ func ParseCryptoKeyConfigs(cfg string) ([]*CryptoKeyConfig, error) {
 				switch args[i+1] {
 				case "name":
 					key.TokenName = args[i+2]
+				case "type":
+					switch args[i+2] {
+					case "jwt", "paseto":
+						key.TokenType = args[i+2]
+					default:
+						return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unsupported token type")
+					}
 				case "lifetime":
 					i, err := strconv.Atoi(args[i+2])
 					if err != nil {
 						return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, err)
 					}
 					key.TokenLifetime = i
+				case "method":
+					if _, exists := signingMethods[args[i+2]]; !exists {
+						return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unsupported token signing method")
+					}
+					key.PreferredSignMethod = args[i+2]
+				case "accept":
+					for _, m := range args[i+2:] {
+						if _, exists := signingMethods[m]; !exists {
+							return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unsupported token signing method")
+						}
+						key.VerifyMethods = append(key.VerifyMethods, m)
+					}
+					// Consume all the methods, except the last one.
+					i += len(args[i+2:]) - 1
+				case "eval":
+					key.EvalExpr = append(key.EvalExpr, strings.Join(args[i+2:], " "))
+					// Consume the expression, except the last argument.
+					i += len(args[i+2:]) - 1
 				default:
 					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unknown key token setting")
 				}
 				i += 2
-			case "verify", "sign", "sign-verify", "auto":
+			case "jwks":
+				if remainder < 2 {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "jwks must be followed by its attributes")
+				}
+				switch args[i+1] {
+				case "refresh":
+					n, err := strconv.Atoi(args[i+2])
+					if err != nil {
+						return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, err)
+					}
+					key.JwksRefreshInterval = n
+				default:
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unknown key jwks setting")
+				}
+				i += 2
+			case "watch":
+				if remainder < 2 {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "watch must be followed by its attributes")
+				}
+				n, err := strconv.Atoi(args[i+2])
+				if err != nil {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, err)
+				}
+				if n < 1 {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "watch setting must be a positive number of seconds")
+				}
+				switch args[i+1] {
+				case "interval":
+					key.WatchInterval = n
+				case "grace":
+					key.WatchGracePeriod = n
+				default:
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unknown key watch setting")
+				}
+				i += 2
+			case "not":
+				if remainder < 2 {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "not must be followed by its attributes")
+				}
+				ts, err := time.Parse(time.RFC3339, args[i+2])
+				if err != nil {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, err)
+				}
+				switch args[i+1] {
+				case "before":
+					key.NotBefore = ts
+				case "after":
+					key.NotAfter = ts
+				default:
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unknown key validity setting")
+				}
+				i += 2
+			case "ca":
+				if remainder < 2 {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "ca must be followed by its attributes")
+				}
+				switch args[i+1] {
+				case "bundle":
+					key.CABundlePath = args[i+2]
+				default:
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unknown key ca setting")
+				}
+				i += 2
+			case "format":
+				if remainder < 1 {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "format must be followed by key file format")
+				}
+				switch args[i+1] {
+				case "certificate", "jwk":
+					key.FileFormats = append(key.FileFormats, args[i+1])
+				default:
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "unknown key file format")
+				}
+				i++
+			case "passphrase":
+				if remainder != 3 || args[i+1] != "from" || args[i+2] != "env" {
+					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "passphrase must be followed by from env <VAR>")
+				}
+				key.PassphraseEnvVarName = args[i+3]
+				i += 3
+			case "verify", "sign", "sign-verify", "auto", "decrypt":
 				if key.Usage != "" {
 					return nil, errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(line, "duplicate key id")
 				}
@@ -385,7 +706,15 @@ func ParseCryptoKeyConfigs(cfg string) ([]*CryptoKeyConfig, error) {
 					i++
 					break
 				}
-				switch remainder {
+				// The key source may be followed by its passphrase.
+				n := remainder
+				for j := i + 1; j < len(args); j++ {
+					if args[j] == "passphrase" {
+						n = j - i - 1
+						break
+					}
+				}
+				switch n {
 				case 3:
 					switch args[i+2] {
 					case "file":
@@ -394,6 +723,12 @@ func ParseCryptoKeyConfigs(cfg string) ([]*CryptoKeyConfig, error) {
 					case "directory":
 						key.Source = "config"
 						key.DirPath = args[i+3]
+					case "jwks":
+						key.Source = "config"
+						key.JwksURL = args[i+3]
+					case "oidc":
+						key.Source = "config"
+						key.OidcIssuerURL = args[i+3]
 					case "env":
 						key.Source = "env"
 						key.EnvVarName = args[i+3]
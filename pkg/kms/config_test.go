@@ -21,6 +21,7 @@ import (
 	"github.com/greenpau/caddy-authorize/pkg/errors"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestValidateCryptoKeyConfig(t *testing.T) {
@@ -781,6 +782,449 @@ func TestParseCryptoKeyConfigs(t *testing.T) {
 			shouldErr: true,
 			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, "key usage is not set"),
 		},
+		{
+			name: "load verify keys from jwks with refresh interval",
+			config: `
+                crypto key k9738a405e99 verify from jwks https://localhost/oauth2/jwks
+                crypto key k9738a405e99 jwks refresh 600
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:                  "k9738a405e99",
+						Usage:               "verify",
+						TokenName:           "access_token",
+						Source:              "config",
+						JwksURL:             "https://localhost/oauth2/jwks",
+						JwksRefreshInterval: 600,
+						TokenLifetime:       900,
+						parsed:              true,
+						validated:           true,
+					},
+				},
+			},
+		},
+		{
+			name: "load verify keys from oidc provider",
+			config: `
+                crypto key verify from oidc https://localhost/oauth2
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:            "0",
+						Usage:         "verify",
+						TokenName:     "access_token",
+						Source:        "config",
+						OidcIssuerURL: "https://localhost/oauth2",
+						TokenLifetime: 900,
+						parsed:        true,
+						validated:     true,
+					},
+				},
+			},
+		},
+		{
+			name: "load sign keys from jwks",
+			config: `
+                crypto key k9738a405e99 sign-verify from jwks https://localhost/oauth2/jwks
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, `key usage "sign-verify" is not supported with jwks`),
+		},
+		{
+			name: "rsa key with preferred token signing method",
+			config: `
+                crypto key k9738a405e99 token method PS256
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:                  "k9738a405e99",
+						Usage:               "sign-verify",
+						TokenName:           "access_token",
+						Source:              "config",
+						FilePath:            "./../../testdata/rskeys/test_2_pri.pem",
+						TokenLifetime:       900,
+						PreferredSignMethod: "PS256",
+						parsed:              true,
+						validated:           true,
+					},
+				},
+			},
+		},
+		{
+			name: "rsa key with accepted token signing methods",
+			config: `
+                crypto key k9738a405e99 token accept RS256 PS256
+                crypto key k9738a405e99 verify from file ./../../testdata/rskeys/test_2_pub.pem
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:            "k9738a405e99",
+						Usage:         "verify",
+						TokenName:     "access_token",
+						Source:        "config",
+						FilePath:      "./../../testdata/rskeys/test_2_pub.pem",
+						TokenLifetime: 900,
+						VerifyMethods: []string{"RS256", "PS256"},
+						parsed:        true,
+						validated:     true,
+					},
+				},
+			},
+		},
+		{
+			name: "watched rsa key directory",
+			config: `
+                crypto key k9738a405e99 sign-verify from directory ./../../testdata/rskeys
+                crypto key k9738a405e99 watch interval 30
+                crypto key k9738a405e99 watch grace 600
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:               "k9738a405e99",
+						Usage:            "sign-verify",
+						TokenName:        "access_token",
+						Source:           "config",
+						DirPath:          "./../../testdata/rskeys",
+						TokenLifetime:    900,
+						WatchInterval:    30,
+						WatchGracePeriod: 600,
+						parsed:           true,
+						validated:        true,
+					},
+				},
+			},
+		},
+		{
+			name: "watched shared secret",
+			config: `
+                crypto key k9738a405e99 sign-verify foobar
+                crypto key k9738a405e99 watch interval 30
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, "key watch is supported with file and directory keys only"),
+		},
+		{
+			name: "watch grace period without watch interval",
+			config: `
+                crypto key k9738a405e99 verify from file ./../../testdata/rskeys/test_2_pub.pem
+                crypto key k9738a405e99 watch grace 600
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, "key watch interval is not set"),
+		},
+		{
+			name: "invalid watch setting",
+			config: `
+                crypto key k9738a405e99 watch period 30
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k9738a405e99 watch period 30`,
+				`unknown key watch setting`,
+			),
+		},
+		{
+			name: "non-positive watch interval",
+			config: `
+                crypto key k9738a405e99 watch interval 0
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k9738a405e99 watch interval 0`,
+				`watch setting must be a positive number of seconds`,
+			),
+		},
+		{
+			name: "key with validity window",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+                crypto key k9738a405e99 not before 2021-01-01T00:00:00Z
+                crypto key k9738a405e99 not after 2022-01-01T00:00:00Z
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:            "k9738a405e99",
+						Usage:         "sign-verify",
+						TokenName:     "access_token",
+						Source:        "config",
+						FilePath:      "./../../testdata/rskeys/test_2_pri.pem",
+						TokenLifetime: 900,
+						NotBefore:     time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+						NotAfter:      time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+						parsed:        true,
+						validated:     true,
+					},
+				},
+			},
+		},
+		{
+			name: "key with not after time preceding not before time",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+                crypto key k9738a405e99 not before 2022-01-01T00:00:00Z
+                crypto key k9738a405e99 not after 2021-01-01T00:00:00Z
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, "key not after time must be later than not before time"),
+		},
+		{
+			name: "key with malformed not after time",
+			config: `
+                crypto key k9738a405e99 not after 2022-01-01
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k9738a405e99 not after 2022-01-01`,
+				`parsing time "2022-01-01" as "2006-01-02T15:04:05Z07:00": cannot parse "" as "T"`,
+			),
+		},
+		{
+			name: "x509 certificate with ca bundle",
+			config: `
+                crypto key k9738a405e99 verify from file ./../../testdata/certs/rsa_test_2.crt
+                crypto key k9738a405e99 ca bundle ./../../testdata/certs/ca.pem
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:            "k9738a405e99",
+						Usage:         "verify",
+						TokenName:     "access_token",
+						Source:        "config",
+						FilePath:      "./../../testdata/certs/rsa_test_2.crt",
+						CABundlePath:  "./../../testdata/certs/ca.pem",
+						TokenLifetime: 900,
+						parsed:        true,
+						validated:     true,
+					},
+				},
+			},
+		},
+		{
+			name: "ca bundle with jwks",
+			config: `
+                crypto key k9738a405e99 verify from jwks https://localhost/oauth2/jwks
+                crypto key k9738a405e99 ca bundle ./../../testdata/certs/ca.pem
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, "key ca bundle is supported with file and directory keys only"),
+		},
+		{
+			name: "key directory with certificate and jwk formats",
+			config: `
+                crypto key k9738a405e99 verify from directory ./../../testdata/certs
+                crypto key k9738a405e99 format certificate
+                crypto key k9738a405e99 format jwk
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:            "k9738a405e99",
+						Usage:         "verify",
+						TokenName:     "access_token",
+						Source:        "config",
+						DirPath:       "./../../testdata/certs",
+						FileFormats:   []string{"certificate", "jwk"},
+						TokenLifetime: 900,
+						parsed:        true,
+						validated:     true,
+					},
+				},
+			},
+		},
+		{
+			name: "unknown key file format",
+			config: `
+                crypto key k9738a405e99 verify from file ./../../testdata/certs/rsa_test_2.crt
+                crypto key k9738a405e99 format der
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k9738a405e99 format der`,
+				"unknown key file format",
+			),
+		},
+		{
+			name: "key file format with jwks",
+			config: `
+                crypto key k9738a405e99 verify from jwks https://localhost/oauth2/jwks
+                crypto key k9738a405e99 format jwk
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, "key file format is supported with file and directory keys only"),
+		},
+		{
+			name: "encrypted private key with passphrase from env",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_legacy.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:                   "k9738a405e99",
+						Usage:                "sign-verify",
+						TokenName:            "access_token",
+						Source:               "config",
+						FilePath:             "./../../testdata/encrypted/rsa_test_2_legacy.pem",
+						PassphraseEnvVarName: "JWT_KEY_PASSPHRASE",
+						TokenLifetime:        900,
+						parsed:               true,
+						validated:            true,
+					},
+				},
+			},
+		},
+		{
+			name: "passphrase without env var",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_legacy.pem passphrase foobar
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_legacy.pem passphrase foobar`,
+				`passphrase must be followed by from env <VAR>`,
+			),
+		},
+		{
+			name: "passphrase with shared secret",
+			config: `
+                crypto key k9738a405e99 sign-verify foobar
+                crypto key k9738a405e99 passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, "key passphrase is supported with private keys only"),
+		},
+		{
+			name: "unsupported accepted token signing method",
+			config: `
+                crypto key k9738a405e99 token accept RS256 none
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k9738a405e99 token accept RS256 none`,
+				`unsupported token signing method`,
+			),
+		},
+		{
+			name: "unsupported token signing method",
+			config: `
+                crypto key k9738a405e99 token method PS1024
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k9738a405e99 token method PS1024`,
+				`unsupported token signing method`,
+			),
+		},
+		{
+			name: "key with token eval expressions",
+			config: `
+                crypto key tenant1 verify foobar
+                crypto key tenant1 token eval "request.host == app1.example.com and claims.iss == 'https://app1.example.com'"
+                crypto key tenant1 token eval claims.aud == app1
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:            "tenant1",
+						Usage:         "verify",
+						TokenName:     "access_token",
+						Source:        "config",
+						Algorithm:     "hmac",
+						TokenLifetime: 900,
+						Secret:        "foobar",
+						EvalExpr: []string{
+							"request.host == app1.example.com and claims.iss == 'https://app1.example.com'",
+							"claims.aud == app1",
+						},
+						parsed:    true,
+						validated: true,
+					},
+				},
+			},
+		},
+		{
+			name: "key with invalid token eval expression",
+			config: `
+                crypto key tenant1 verify foobar
+                crypto key tenant1 token eval request.ip == 10.0.0.1
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, `key eval expression "request.ip == 10.0.0.1" is invalid: unsupported operand "request.ip"`),
+		},
+		{
+			name: "key with paseto token type",
+			config: `
+                crypto key k1 verify 3f1c9b2e7a6d4e8f0b5a2c7d9e1f4a6b
+                crypto key k1 token type paseto
+            `,
+			want: map[string]interface{}{
+				"config_count": 1,
+				"configs": []*CryptoKeyConfig{
+					{
+						ID:            "k1",
+						Usage:         "verify",
+						TokenName:     "access_token",
+						TokenType:     "paseto",
+						Source:        "config",
+						Algorithm:     "hmac",
+						TokenLifetime: 900,
+						Secret:        "3f1c9b2e7a6d4e8f0b5a2c7d9e1f4a6b",
+						parsed:        true,
+						validated:     true,
+					},
+				},
+			},
+		},
+		{
+			name: "unsupported token type",
+			config: `
+                crypto key k1 verify foobar
+                crypto key k1 token type jwe
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k1 token type jwe`,
+				`unsupported token type`,
+			),
+		},
+		{
+			name: "paseto token type with sign key",
+			config: `
+                crypto key k1 sign-verify foobar
+                crypto key k1 token type paseto
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigKeyInvalid.WithArgs(0, `key usage "sign-verify" is not supported with paseto tokens`),
+		},
+		{
+			name: "invalid jwks setting",
+			config: `
+                crypto key k9738a405e99 jwks foo 600
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigEntryInvalid.WithArgs(
+				`crypto key k9738a405e99 jwks foo 600`,
+				`unknown key jwks setting`,
+			),
+		},
 		{
 			name: "load mix static and private keys",
 			config: `
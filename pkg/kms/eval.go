@@ -0,0 +1,434 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"fmt"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// evalExpr is a compiled key selection expression, see CryptoKeyConfig.EvalExpr.
+//
+// The expression compares request and token claim data with literals, e.g.
+//
+//     request.host == app1.example.com and claims.iss == "https://app1.example.com"
+//     request.header.X-Tenant-Id =~ "^(acme|contoso)$" or not claims.aud == internal
+//
+// The supported operands are request.host, request.path, request.method,
+// request.header.<NAME>, and claims.<NAME>. The nested claims are referenced
+// with dots, e.g. claims.app_metadata.tenant. The supported operators are
+// == (equals), != (not equals), and =~ (matches regular expression). When a
+// claim has multiple values, e.g. aud, the == and =~ operators match any of
+// the values, and the != operator matches none of them. The comparisons are
+// combined with "and", "or", "not", and parentheses. The literals with
+// spaces, parentheses, quotes, or "=" and "!" characters must be quoted
+// with single or double quotes.
+type evalExpr struct {
+	root        evalNode
+	usesRequest bool
+}
+
+// evalInput is the data the expressions are evaluated against.
+type evalInput struct {
+	request *http.Request
+	claims  map[string]interface{}
+}
+
+type evalNode interface {
+	eval(in *evalInput) bool
+}
+
+type evalAnd struct {
+	left, right evalNode
+}
+
+type evalOr struct {
+	left, right evalNode
+}
+
+type evalNot struct {
+	node evalNode
+}
+
+type evalComparison struct {
+	operand string
+	op      string
+	value   string
+	re      *regexp.Regexp
+}
+
+func (n *evalAnd) eval(in *evalInput) bool {
+	return n.left.eval(in) && n.right.eval(in)
+}
+
+func (n *evalOr) eval(in *evalInput) bool {
+	return n.left.eval(in) || n.right.eval(in)
+}
+
+func (n *evalNot) eval(in *evalInput) bool {
+	return !n.node.eval(in)
+}
+
+func (n *evalComparison) eval(in *evalInput) bool {
+	values := in.getValues(n.operand)
+	switch n.op {
+	case "==":
+		for _, v := range values {
+			if v == n.value {
+				return true
+			}
+		}
+		return false
+	case "!=":
+		for _, v := range values {
+			if v == n.value {
+				return false
+			}
+		}
+		return true
+	case "=~":
+		for _, v := range values {
+			if n.re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (in *evalInput) getValues(operand string) []string {
+	switch {
+	case strings.HasPrefix(operand, "request."):
+		if in.request == nil {
+			return nil
+		}
+		switch operand {
+		case "request.host":
+			host := in.request.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return []string{host}
+		case "request.path":
+			return []string{in.request.URL.Path}
+		case "request.method":
+			return []string{in.request.Method}
+		}
+		return in.request.Header.Values(strings.TrimPrefix(operand, "request.header."))
+	case strings.HasPrefix(operand, "claims."):
+		name := strings.TrimPrefix(operand, "claims.")
+		if v, exists := in.claims[name]; exists {
+			return getClaimValues(v)
+		}
+		// Walk the nested claims, e.g. app_metadata.tenant.
+		var v interface{} = in.claims
+		for _, k := range strings.Split(name, ".") {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			if v, ok = m[k]; !ok {
+				return nil
+			}
+		}
+		return getClaimValues(v)
+	}
+	return nil
+}
+
+func getClaimValues(v interface{}) []string {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{val}
+	case float64:
+		return []string{strconv.FormatFloat(val, 'f', -1, 64)}
+	case []string:
+		return val
+	case []interface{}:
+		var arr []string
+		for _, entry := range val {
+			arr = append(arr, getClaimValues(entry)...)
+		}
+		return arr
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// evalToken is a lexical token of an expression.
+type evalToken struct {
+	kind  int
+	value string
+}
+
+const (
+	evalTokenWord = iota
+	evalTokenString
+	evalTokenOperator
+	evalTokenLeftParen
+	evalTokenRightParen
+)
+
+func tokenizeEvalExpr(s string) ([]*evalToken, error) {
+	var tokens []*evalToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(':
+			tokens = append(tokens, &evalToken{kind: evalTokenLeftParen, value: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, &evalToken{kind: evalTokenRightParen, value: ")"})
+			i++
+		case c == '=' || c == '!':
+			if i+1 < len(s) {
+				op := s[i : i+2]
+				if op == "==" || op == "!=" || op == "=~" {
+					tokens = append(tokens, &evalToken{kind: evalTokenOperator, value: op})
+					i += 2
+					continue
+				}
+			}
+			return nil, fmt.Errorf("unsupported operator at position %d", i)
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				// The backslash escapes the quote, e.g. 'O\'Reilly'.
+				if s[j] == '\\' && j+1 < len(s) && s[j+1] == c {
+					j++
+				}
+				sb.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, &evalToken{kind: evalTokenString, value: sb.String()})
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(s) && !strings.ContainsRune(" \t()\"'=!", rune(s[j])); j++ {
+			}
+			tokens = append(tokens, &evalToken{kind: evalTokenWord, value: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// evalParser is a recursive descent parser of the expressions.
+type evalParser struct {
+	tokens      []*evalToken
+	pos         int
+	usesRequest bool
+}
+
+func parseEvalExpr(s string) (*evalExpr, error) {
+	tokens, err := tokenizeEvalExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	p := &evalParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, fmt.Errorf("unexpected %q", t.value)
+	}
+	return &evalExpr{root: root, usesRequest: p.usesRequest}, nil
+}
+
+func (p *evalParser) peek() *evalToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *evalParser) next() *evalToken {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+	return t
+}
+
+func (p *evalParser) isKeyword(s string) bool {
+	t := p.peek()
+	return t != nil && t.kind == evalTokenWord && t.value == s
+}
+
+func (p *evalParser) parseOr() (evalNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &evalOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *evalParser) parseAnd() (evalNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &evalAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *evalParser) parseUnary() (evalNode, error) {
+	if p.isKeyword("not") {
+		p.next()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &evalNot{node: node}, nil
+	}
+	t := p.peek()
+	if t != nil && t.kind == evalTokenLeftParen {
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t == nil || t.kind != evalTokenRightParen {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return node, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *evalParser) parseComparison() (evalNode, error) {
+	t := p.next()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	if t.kind != evalTokenWord {
+		return nil, fmt.Errorf("expected operand, got %q", t.value)
+	}
+	if err := p.validateOperand(t.value); err != nil {
+		return nil, err
+	}
+	n := &evalComparison{operand: t.value}
+
+	t = p.next()
+	if t == nil || t.kind != evalTokenOperator {
+		return nil, fmt.Errorf("operand %q must be followed by an operator", n.operand)
+	}
+	n.op = t.value
+
+	t = p.next()
+	if t == nil || (t.kind != evalTokenWord && t.kind != evalTokenString) {
+		return nil, fmt.Errorf("operator %q must be followed by a value", n.op)
+	}
+	n.value = t.value
+	if n.op == "=~" {
+		re, err := regexp.Compile(n.value)
+		if err != nil {
+			return nil, err
+		}
+		n.re = re
+	}
+	return n, nil
+}
+
+func (p *evalParser) validateOperand(s string) error {
+	switch {
+	case s == "request.host", s == "request.path", s == "request.method":
+	case strings.HasPrefix(s, "request.header.") && len(s) > len("request.header."):
+	case strings.HasPrefix(s, "claims.") && len(s) > len("claims."):
+		return nil
+	default:
+		return fmt.Errorf("unsupported operand %q", s)
+	}
+	p.usesRequest = true
+	return nil
+}
+
+// compileEvalExpr compiles the key selection expressions of the config.
+func (k *CryptoKeyConfig) compileEvalExpr() error {
+	if len(k.evalExprs) == len(k.EvalExpr) {
+		return nil
+	}
+	var exprs []*evalExpr
+	for _, s := range k.EvalExpr {
+		expr, err := parseEvalExpr(s)
+		if err != nil {
+			return errors.ErrCryptoKeyConfigEvalExprInvalid.WithArgs(s, err)
+		}
+		exprs = append(exprs, expr)
+	}
+	k.evalExprs = exprs
+	return nil
+}
+
+// matchEvalExpr returns true when all the key selection expressions of the
+// key match the input. The keys without the expressions always match.
+func (k *CryptoKey) matchEvalExpr(in *evalInput) bool {
+	if k.Config == nil || len(k.Config.EvalExpr) == 0 {
+		return true
+	}
+	if len(k.Config.evalExprs) != len(k.Config.EvalExpr) {
+		// The expressions were not compiled, see GetKeysFromConfig.
+		return false
+	}
+	for _, expr := range k.Config.evalExprs {
+		if !expr.root.eval(in) {
+			return false
+		}
+	}
+	return true
+}
+
+// usesRequest returns true when the key selection depends on the request.
+func (k *CryptoKey) usesRequest() bool {
+	if k.Config == nil {
+		return false
+	}
+	for _, expr := range k.Config.evalExprs {
+		if expr.usesRequest {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"fmt"
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEvalExpr(t *testing.T) {
+	claims := map[string]interface{}{
+		"iss": "https://app1.example.com",
+		"aud": []interface{}{"app1", "app2"},
+		"exp": float64(1640995200),
+		"app_metadata": map[string]interface{}{
+			"tenant": "acme",
+		},
+	}
+	var testcases = []struct {
+		name      string
+		expr      string
+		noRequest bool
+		want      bool
+		usesReq   bool
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:    "match request host",
+			expr:    `request.host == app1.example.com`,
+			want:    true,
+			usesReq: true,
+		},
+		{
+			name:      "request host without request",
+			expr:      `request.host == app1.example.com`,
+			noRequest: true,
+			usesReq:   true,
+		},
+		{
+			name:    "match request path and header",
+			expr:    `request.path =~ "^/api/" and request.header.X-Tenant-Id == acme`,
+			want:    true,
+			usesReq: true,
+		},
+		{
+			name: "match issuer claim",
+			expr: `claims.iss == "https://app1.example.com"`,
+			want: true,
+		},
+		{
+			name: "match any audience",
+			expr: `claims.aud == app2`,
+			want: true,
+		},
+		{
+			name: "match no audience",
+			expr: `claims.aud != app3`,
+			want: true,
+		},
+		{
+			name: "match nested claim",
+			expr: `claims.app_metadata.tenant == acme`,
+			want: true,
+		},
+		{
+			name: "match numeric claim",
+			expr: `claims.exp == 1640995200`,
+			want: true,
+		},
+		{
+			name: "missing claim",
+			expr: `claims.tenant == acme`,
+		},
+		{
+			name:    "precedence of and over or",
+			expr:    `claims.aud == app3 and claims.iss == foo or request.method == GET`,
+			want:    true,
+			usesReq: true,
+		},
+		{
+			name: "grouping with parentheses and negation",
+			expr: `not (claims.aud == app1 or claims.aud == app3)`,
+		},
+		{
+			name:      "unsupported operand",
+			expr:      `request.ip == 10.0.0.1`,
+			shouldErr: true,
+			err:       fmt.Errorf(`unsupported operand "request.ip"`),
+		},
+		{
+			name:      "unsupported operator",
+			expr:      `claims.iss = foo`,
+			shouldErr: true,
+			err:       fmt.Errorf(`unsupported operator at position 11`),
+		},
+		{
+			name:      "missing value",
+			expr:      `claims.iss ==`,
+			shouldErr: true,
+			err:       fmt.Errorf(`operator "==" must be followed by a value`),
+		},
+		{
+			name:      "missing closing parenthesis",
+			expr:      `(claims.iss == foo`,
+			shouldErr: true,
+			err:       fmt.Errorf(`missing closing parenthesis`),
+		},
+		{
+			name:      "unterminated string",
+			expr:      `claims.iss == "foo`,
+			shouldErr: true,
+			err:       fmt.Errorf(`unterminated string at position 14`),
+		},
+		{
+			name:      "invalid regular expression",
+			expr:      `claims.iss =~ "(foo"`,
+			shouldErr: true,
+			err:       fmt.Errorf("error parsing regexp: missing closing ): `(foo`"),
+		},
+		{
+			name:      "trailing tokens",
+			expr:      `claims.iss == foo bar`,
+			shouldErr: true,
+			err:       fmt.Errorf(`unexpected "bar"`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			msgs = append(msgs, fmt.Sprintf("expr: %s", tc.expr))
+			expr, err := parseEvalExpr(tc.expr)
+			if tests.EvalErrWithLog(t, err, "parse", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			in := &evalInput{claims: claims}
+			if !tc.noRequest {
+				r := httptest.NewRequest("GET", "http://app1.example.com:8443/api/v1", nil)
+				r.Header.Set("X-Tenant-Id", "acme")
+				in.request = r
+			}
+			got := map[string]interface{}{
+				"match":        expr.root.eval(in),
+				"uses_request": expr.usesRequest,
+			}
+			want := map[string]interface{}{
+				"match":        tc.want,
+				"uses_request": tc.usesReq,
+			}
+			tests.EvalObjectsWithLog(t, "eval", want, got, msgs)
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/options"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+)
+
+// TokenGrantor issues tokens signed by the keys of CryptoKeyStore, e.g.
+// for service-to-service authentication.
+type TokenGrantor struct {
+	keystore *CryptoKeyStore
+	opts     *options.TokenGrantorOptions
+}
+
+// NewTokenGrantor returns an instance of TokenGrantor.
+func NewTokenGrantor(ks *CryptoKeyStore, opts *options.TokenGrantorOptions) (*TokenGrantor, error) {
+	if ks == nil || ks.HasSignKeys() != nil {
+		return nil, errors.ErrTokenGrantorNoSigningKeysFound
+	}
+	if opts == nil {
+		opts = options.NewTokenGrantorOptions()
+	}
+	g := &TokenGrantor{
+		keystore: ks,
+		opts:     opts,
+	}
+	return g, nil
+}
+
+// GrantToken returns a token with the claims of the user, see
+// GrantTokenWithClaims. The token is also added to the user.
+func (g *TokenGrantor) GrantToken(usr *user.User, addr string) (string, error) {
+	if usr == nil {
+		return "", errors.ErrTokenGrantorNoClaimsFound
+	}
+	token, tokenName, err := g.grant(usr.AsMap(), addr)
+	if err != nil {
+		return "", err
+	}
+	usr.Token = token
+	usr.TokenName = tokenName
+	return token, nil
+}
+
+// GrantTokenWithClaims returns a token with the provided claims. The
+// "iat", "nbf", and "jti" claims are set by the grantor. The "iss" and "aud"
+// claims default to the issuer and the audience in the options. The "exp"
+// claim defaults to the max token lifetime of the signing key, and it is
+// capped by it. The provided "exp" claim must be in the future. When source
+// address is enabled in the options, the address is added to the "addr"
+// claim.
+func (g *TokenGrantor) GrantTokenWithClaims(claims map[string]interface{}, addr string) (string, error) {
+	token, _, err := g.grant(claims, addr)
+	return token, err
+}
+
+func (g *TokenGrantor) grant(data map[string]interface{}, addr string) (string, string, error) {
+	if len(data) == 0 {
+		return "", "", errors.ErrTokenGrantorNoClaimsFound
+	}
+	now := time.Now()
+	k, err := g.keystore.getSignKey(nil, now)
+	if err != nil {
+		return "", "", err
+	}
+	g.keystore.warnKeyExpiry(k, now)
+	if k.watch != nil {
+		// The watched keys hold the token settings, see newWatchedCryptoKey.
+		if wk := k.watch.getSignKey(); wk != nil {
+			k = wk
+		}
+	}
+	if !k.Sign.Capable {
+		return "", "", errors.ErrTokenGrantorKeyNoSigningCapability
+	}
+	if k.Sign.Token.Name == "" {
+		return "", "", errors.ErrTokenGrantorKeyTokenNameNotSet
+	}
+	if k.Sign.Token.MaxLifetime == 0 {
+		return "", "", errors.ErrTokenGrantorKeyMaxLifetimeNotSet
+	}
+
+	claims := make(map[string]interface{})
+	for name, v := range data {
+		claims[name] = v
+	}
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	maxExpiresAt := now.Add(time.Duration(k.Sign.Token.MaxLifetime) * time.Second).Unix()
+	exp, ok := getNumericClaim(claims["exp"])
+	switch {
+	case !ok || exp > maxExpiresAt:
+		claims["exp"] = maxExpiresAt
+	case exp <= now.Unix():
+		return "", "", errors.ErrTokenGrantorExpiryNotInFuture.WithArgs(exp)
+	}
+	jti, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	claims["jti"] = jti
+	if _, exists := claims["iss"]; !exists && g.opts.Issuer != "" {
+		claims["iss"] = g.opts.Issuer
+	}
+	if _, exists := claims["aud"]; !exists && len(g.opts.Audience) > 0 {
+		if len(g.opts.Audience) == 1 {
+			claims["aud"] = g.opts.Audience[0]
+		} else {
+			claims["aud"] = g.opts.Audience
+		}
+	}
+	if g.opts.EnableSourceAddress {
+		if addr == "" {
+			return "", "", errors.ErrTokenGrantorSourceAddressNotFound
+		}
+		claims["addr"] = addr
+	}
+
+	response, err := k.sign(nil, claims)
+	if err != nil {
+		return "", "", err
+	}
+	return response.(string), k.Sign.Token.Name, nil
+}
+
+// newTokenID returns a random token id for the "jti" claim.
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func getNumericClaim(v interface{}) (int64, bool) {
+	switch val := v.(type) {
+	case int:
+		return int64(val), true
+	case int64:
+		return val, true
+	case float64:
+		return int64(val), true
+	case json.Number:
+		i, err := val.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
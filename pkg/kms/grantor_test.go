@@ -0,0 +1,218 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"fmt"
+	jwtlib "github.com/golang-jwt/jwt/v4"
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/options"
+	"testing"
+	"time"
+)
+
+func TestTokenGrantor(t *testing.T) {
+	config := `
+		crypto key k1 token lifetime 600
+		crypto key k1 sign-verify from file ./../../testdata/ecdsakeys/test_1_pri.pem
+	`
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+
+	var testcases = []struct {
+		name      string
+		opts      *options.TokenGrantorOptions
+		claims    map[string]interface{}
+		addr      string
+		want      map[string]interface{}
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "grant token with default claims",
+			opts: &options.TokenGrantorOptions{
+				Issuer:   "https://auth.example.com",
+				Audience: []string{"https://app.example.com"},
+			},
+			claims: map[string]interface{}{
+				"sub":   "svc-billing",
+				"roles": []string{"service"},
+			},
+			want: map[string]interface{}{
+				"sub": "svc-billing",
+				"iss": "https://auth.example.com",
+				"aud": "https://app.example.com",
+				"exp": now + 600,
+			},
+		},
+		{
+			name: "grant token with provided claims",
+			opts: &options.TokenGrantorOptions{
+				Issuer:   "https://auth.example.com",
+				Audience: []string{"https://app1.example.com", "https://app2.example.com"},
+			},
+			claims: map[string]interface{}{
+				"sub": "svc-billing",
+				"iss": "https://billing.example.com",
+				"exp": now + 60,
+			},
+			want: map[string]interface{}{
+				"sub": "svc-billing",
+				"iss": "https://billing.example.com",
+				"aud": []interface{}{"https://app1.example.com", "https://app2.example.com"},
+				"exp": now + 60,
+			},
+		},
+		{
+			name: "grant token with expiry capped by max lifetime",
+			claims: map[string]interface{}{
+				"sub": "svc-billing",
+				"exp": now + 3600,
+			},
+			want: map[string]interface{}{
+				"sub": "svc-billing",
+				"exp": now + 600,
+			},
+		},
+		{
+			name: "grant token with past expiry",
+			claims: map[string]interface{}{
+				"sub": "svc-billing",
+				"exp": now - 60,
+			},
+			shouldErr: true,
+			err:       errors.ErrTokenGrantorExpiryNotInFuture.WithArgs(now - 60),
+		},
+		{
+			name: "grant token with zero lifetime",
+			claims: map[string]interface{}{
+				"sub": "svc-billing",
+				"exp": now,
+			},
+			shouldErr: true,
+			err:       errors.ErrTokenGrantorExpiryNotInFuture.WithArgs(now),
+		},
+		{
+			name: "grant token with source address",
+			opts: &options.TokenGrantorOptions{
+				EnableSourceAddress: true,
+			},
+			claims: map[string]interface{}{
+				"sub": "svc-billing",
+			},
+			addr: "10.0.2.15",
+			want: map[string]interface{}{
+				"sub":  "svc-billing",
+				"addr": "10.0.2.15",
+				"exp":  now + 600,
+			},
+		},
+		{
+			name: "grant token without source address",
+			opts: &options.TokenGrantorOptions{
+				EnableSourceAddress: true,
+			},
+			claims: map[string]interface{}{
+				"sub": "svc-billing",
+			},
+			shouldErr: true,
+			err:       errors.ErrTokenGrantorSourceAddressNotFound,
+		},
+		{
+			name:      "grant token without claims",
+			shouldErr: true,
+			err:       errors.ErrTokenGrantorNoClaimsFound,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			g, err := NewTokenGrantor(ks, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := g.GrantTokenWithClaims(tc.claims, tc.addr)
+			if tests.EvalErrWithLog(t, err, "grant", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			if _, err := ks.ParseToken("access_token", token); err != nil {
+				t.Fatalf("expected the granted token to be accepted: %v", err)
+			}
+			parsedToken, _, err := new(jwtlib.Parser).ParseUnverified(token, jwtlib.MapClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := parsedToken.Claims.(jwtlib.MapClaims)
+			for _, name := range []string{"iat", "nbf", "jti"} {
+				if _, exists := claims[name]; !exists {
+					t.Fatalf("expected %q claim in the granted token", name)
+				}
+			}
+			got := make(map[string]interface{})
+			for name := range tc.want {
+				got[name] = claims[name]
+			}
+			// The numeric claims are decoded as float64. The expiry may
+			// differ by a second when the test crosses the second boundary.
+			exp := int64(claims["exp"].(float64))
+			if d := exp - tc.want["exp"].(int64); d == 1 || d == -1 {
+				exp = tc.want["exp"].(int64)
+			}
+			got["exp"] = exp
+			tests.EvalObjectsWithLog(t, "claims", tc.want, got, msgs)
+		})
+	}
+}
+
+func TestTokenGrantorWithUser(t *testing.T) {
+	ks := NewCryptoKeyStore()
+	if _, err := NewTokenGrantor(ks, nil); err != errors.ErrTokenGrantorNoSigningKeysFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ks.AutoGenerate("grantor-test", "ES256"); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewTokenGrantor(ks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr := newTestUser()
+	token, err := g.GrantToken(usr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.Token != token || usr.TokenName != "access_token" {
+		t.Fatalf("expected the token to be added to the user: %s %s", usr.TokenName, usr.Token)
+	}
+	parsedUser, err := ks.ParseToken("access_token", token)
+	if err != nil {
+		t.Fatalf("expected the granted token to be accepted: %v", err)
+	}
+	if parsedUser.Claims.Subject != usr.Claims.Subject || parsedUser.Claims.ID == "" {
+		t.Fatalf("unexpected claims: %v", parsedUser.AsMap())
+	}
+}
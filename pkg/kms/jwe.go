@@ -0,0 +1,165 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	jose "gopkg.in/square/go-jose.v2"
+	"strings"
+)
+
+var (
+	// supportedKeyEncryptionAlgorithms are the supported "alg" header
+	// values of the encrypted tokens per key algorithm. RSA1_5 is not
+	// supported, because it is vulnerable to padding oracle attacks.
+	supportedKeyEncryptionAlgorithms = map[string]map[string]bool{
+		"rsa": {
+			"RSA-OAEP":     true,
+			"RSA-OAEP-256": true,
+		},
+		"ecdsa": {
+			"ECDH-ES": true,
+		},
+		"hmac": {
+			"dir": true,
+		},
+	}
+	// supportedContentEncryptionAlgorithms are the supported "enc" header
+	// values of the encrypted tokens.
+	supportedContentEncryptionAlgorithms = map[string]bool{
+		"A256GCM": true,
+	}
+)
+
+// jweHeader is the protected header of an encrypted token.
+type jweHeader struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc"`
+	KeyID       string `json:"kid"`
+	ContentType string `json:"cty"`
+}
+
+// isEncryptedToken returns true when the token is in JWE compact
+// serialization, i.e. it has five parts, as opposed to three parts of JWS.
+func isEncryptedToken(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+func isSupportedKeyEncryptionAlgorithm(alg string) bool {
+	for _, algs := range supportedKeyEncryptionAlgorithms {
+		if algs[alg] {
+			return true
+		}
+	}
+	return false
+}
+
+// configureDecrypt moves the private key or the shared secret of a key with
+// "decrypt" usage to the key decryption operator. The key neither signs nor
+// verifies tokens.
+func (k *CryptoKey) configureDecrypt() error {
+	if !k.Sign.Capable {
+		return errors.ErrCryptoKeyDecryptKeyNotPrivate.WithArgs(k.Config.ID)
+	}
+	switch secret := k.Sign.Secret.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	case []byte:
+		// The shared secret is the content encryption key, see "dir".
+		if len(secret) != 32 {
+			return errors.ErrCryptoKeyDecryptSecretLength.WithArgs(k.Config.ID, len(secret))
+		}
+	default:
+		return errors.ErrCryptoKeyDecryptUnsupportedAlgo.WithArgs(k.Config.ID, k.Config.Algorithm)
+	}
+	k.Decrypt.Capable = true
+	k.Decrypt.Secret = k.Sign.Secret
+	k.Sign = NewCryptoKeyOperator()
+	k.Verify = NewCryptoKeyOperator()
+	return nil
+}
+
+// decryptToken returns the nested signed token of an encrypted token. When
+// the encrypted token has key id, i.e. "kid" header, only the decryption keys
+// having the key id are used, see getDecryptKeys.
+func (ks *CryptoKeyStore) decryptToken(token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs(err)
+	}
+	var hdr jweHeader
+	if err := json.Unmarshal(b, &hdr); err != nil {
+		return "", errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs(err)
+	}
+	if !isSupportedKeyEncryptionAlgorithm(hdr.Algorithm) {
+		return "", errors.ErrCryptoKeyStoreTokenEncryptionUnsupported.WithArgs(hdr.Algorithm)
+	}
+	if !supportedContentEncryptionAlgorithms[hdr.Encryption] {
+		return "", errors.ErrCryptoKeyStoreTokenEncryptionUnsupported.WithArgs(hdr.Encryption)
+	}
+	if hdr.ContentType != "" && !strings.EqualFold(hdr.ContentType, "JWT") {
+		return "", errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs("unsupported content type " + hdr.ContentType)
+	}
+	obj, err := jose.ParseEncrypted(token)
+	if err != nil {
+		return "", errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs(err)
+	}
+	if len(ks.decryptKeys) == 0 {
+		return "", errors.ErrCryptoKeyStoreNoDecryptKeysFound
+	}
+
+	for _, k := range ks.getDecryptKeys(hdr.KeyID) {
+		if !supportedKeyEncryptionAlgorithms[k.Config.Algorithm][hdr.Algorithm] {
+			continue
+		}
+		payload, err := obj.Decrypt(k.Decrypt.Secret)
+		if err != nil {
+			continue
+		}
+		// The payload must be a signed token, i.e. nested JWT.
+		if strings.Count(string(payload), ".") != 2 {
+			return "", errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs("payload is not a signed token")
+		}
+		return string(payload), nil
+	}
+	return "", errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs("no matching decryption key")
+}
+
+// getDecryptKeys returns the keys eligible for the decryption of a token with
+// the provided key id. When the key id matches the keys with key id, only
+// these keys are returned. When it does not, only the keys without key id are
+// returned. When the token has no key id, all the keys are returned.
+func (ks *CryptoKeyStore) getDecryptKeys(kid string) []*CryptoKey {
+	if kid == "" {
+		return ks.decryptKeys
+	}
+	var matched, unidentified []*CryptoKey
+	for _, k := range ks.decryptKeys {
+		switch {
+		case !k.hasKeyID():
+			unidentified = append(unidentified, k)
+		case k.Config.ID == kid:
+			matched = append(matched, k)
+		}
+	}
+	if len(matched) > 0 {
+		return matched
+	}
+	return unidentified
+}
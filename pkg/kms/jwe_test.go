@@ -0,0 +1,265 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	jose "gopkg.in/square/go-jose.v2"
+	"testing"
+)
+
+const testDecryptSecret = "e2f8c0d1a9b74c6d8e5f3a2b1c0d9e8f"
+
+func newTestEncryptedToken(t *testing.T, payload string, alg jose.KeyAlgorithm, enc jose.ContentEncryption, key interface{}, kid string) string {
+	opts := (&jose.EncrypterOptions{}).WithContentType("JWT")
+	encrypter, err := jose.NewEncrypter(enc, jose.Recipient{Algorithm: alg, Key: key, KeyID: kid}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := encrypter.Encrypt([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestCryptoKeyStoreDecryptToken(t *testing.T) {
+	config := `
+		crypto key k1 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+		crypto key enc-rsa decrypt from file ./../../testdata/rskeys/test_1_pri.pem
+		crypto key enc-ec decrypt from file ./../../testdata/ecdsakeys/test_1_pri.pem
+		crypto key enc-dir decrypt ` + testDecryptSecret + `
+	`
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.GetDecryptKeys()) != 3 || len(ks.GetVerifyKeys()) != 1 {
+		t.Fatalf("unexpected keys: %d decrypt keys, %d verify keys", len(ks.GetDecryptKeys()), len(ks.GetVerifyKeys()))
+	}
+
+	usr := newTestUser()
+	if err := ks.SignToken(nil, nil, usr); err != nil {
+		t.Fatal(err)
+	}
+	rsaPubKey := ks.GetDecryptKeys()[0].Decrypt.Secret.(*rsa.PrivateKey).Public()
+	ecPubKey := ks.GetDecryptKeys()[1].Decrypt.Secret.(*ecdsa.PrivateKey).Public()
+	unknownKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownSignKey, err := GetKeysFromConfig(&CryptoKeyConfig{
+		ID:            "k2",
+		Usage:         "sign-verify",
+		TokenName:     "access_token",
+		Source:        "config",
+		FilePath:      "./../../testdata/ecdsakeys/test_2_pri.pem",
+		TokenLifetime: 900,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownUsr := newTestUser()
+	if err := unknownSignKey[0].SignToken(nil, unknownUsr); err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name      string
+		token     string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:  "token encrypted with rsa-oaep",
+			token: newTestEncryptedToken(t, usr.Token, jose.RSA_OAEP, jose.A256GCM, rsaPubKey, ""),
+		},
+		{
+			name:  "token encrypted with rsa-oaep-256 and key id",
+			token: newTestEncryptedToken(t, usr.Token, jose.RSA_OAEP_256, jose.A256GCM, rsaPubKey, "enc-rsa"),
+		},
+		{
+			name:  "token encrypted with ecdh-es",
+			token: newTestEncryptedToken(t, usr.Token, jose.ECDH_ES, jose.A256GCM, ecPubKey, "enc-ec"),
+		},
+		{
+			name:  "token encrypted with shared key",
+			token: newTestEncryptedToken(t, usr.Token, jose.DIRECT, jose.A256GCM, []byte(testDecryptSecret), ""),
+		},
+		{
+			name:      "token encrypted with rsa1_5",
+			token:     newTestEncryptedToken(t, usr.Token, jose.RSA1_5, jose.A256GCM, rsaPubKey, ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreTokenEncryptionUnsupported.WithArgs("RSA1_5"),
+		},
+		{
+			name:      "token encrypted with unsupported content encryption",
+			token:     newTestEncryptedToken(t, usr.Token, jose.RSA_OAEP, jose.A128GCM, rsaPubKey, ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreTokenEncryptionUnsupported.WithArgs("A128GCM"),
+		},
+		{
+			name:      "token encrypted with key id of another key",
+			token:     newTestEncryptedToken(t, usr.Token, jose.RSA_OAEP, jose.A256GCM, rsaPubKey, "enc-ec"),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs("no matching decryption key"),
+		},
+		{
+			name:      "token encrypted with unknown key",
+			token:     newTestEncryptedToken(t, usr.Token, jose.RSA_OAEP, jose.A256GCM, unknownKey.Public(), ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs("no matching decryption key"),
+		},
+		{
+			name:      "encrypted payload is not a token",
+			token:     newTestEncryptedToken(t, `{"sub":"smithj@outlook.com"}`, jose.RSA_OAEP, jose.A256GCM, rsaPubKey, ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs("payload is not a signed token"),
+		},
+		{
+			name:      "nested token signed by unknown key",
+			token:     newTestEncryptedToken(t, unknownUsr.Token, jose.RSA_OAEP, jose.A256GCM, rsaPubKey, ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			parsedUser, err := ks.ParseToken("access_token", tc.token)
+			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			tests.EvalObjectsWithLog(t, "claims", usr.AsMap(), parsedUser.AsMap(), msgs)
+		})
+	}
+}
+
+func TestCryptoKeyStoreDecryptTokenWithoutKeyID(t *testing.T) {
+	config := `
+		crypto key k1 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+		crypto key decrypt from file ./../../testdata/rskeys/test_1_pri.pem
+		crypto key enc-ec decrypt from file ./../../testdata/ecdsakeys/test_1_pri.pem
+	`
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeysWithConfigs(configs); err != nil {
+		t.Fatal(err)
+	}
+	usr := newTestUser()
+	if err := ks.SignToken(nil, nil, usr); err != nil {
+		t.Fatal(err)
+	}
+	rsaPubKey := ks.GetDecryptKeys()[0].Decrypt.Secret.(*rsa.PrivateKey).Public()
+
+	var testcases = []struct {
+		name      string
+		token     string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:  "token with key id decrypted by key without key id",
+			token: newTestEncryptedToken(t, usr.Token, jose.RSA_OAEP, jose.A256GCM, rsaPubKey, "enc-rsa"),
+		},
+		{
+			name:      "token with key id of key having key id",
+			token:     newTestEncryptedToken(t, usr.Token, jose.RSA_OAEP, jose.A256GCM, rsaPubKey, "enc-ec"),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreTokenDecryptFailed.WithArgs("no matching decryption key"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			parsedUser, err := ks.ParseToken("access_token", tc.token)
+			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			tests.EvalObjectsWithLog(t, "claims", usr.AsMap(), parsedUser.AsMap(), msgs)
+		})
+	}
+}
+
+func TestGetDecryptKeysFromConfig(t *testing.T) {
+	var testcases = []struct {
+		name      string
+		config    *CryptoKeyConfig
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "decrypt key with short shared secret",
+			config: &CryptoKeyConfig{
+				ID:        "enc-dir",
+				Usage:     "decrypt",
+				Source:    "config",
+				Algorithm: "hmac",
+				Secret:    "foobar",
+			},
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyDecryptSecretLength.WithArgs("enc-dir", 6),
+		},
+		{
+			name: "decrypt key with eddsa private key",
+			config: &CryptoKeyConfig{
+				ID:       "enc-ed",
+				Usage:    "decrypt",
+				Source:   "config",
+				FilePath: "./../../testdata/eddsakeys/test_1_pri.pem",
+			},
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyDecryptUnsupportedAlgo.WithArgs("enc-ed", "eddsa"),
+		},
+		{
+			name: "decrypt key with public key",
+			config: &CryptoKeyConfig{
+				ID:       "enc-rsa",
+				Usage:    "decrypt",
+				Source:   "config",
+				FilePath: "./../../testdata/rskeys/test_2_pub.pem",
+			},
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyDecryptKeyNotPrivate.WithArgs("enc-rsa"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			_, err := GetKeysFromConfig(tc.config)
+			tests.EvalErrWithLog(t, err, "config", tc.shouldErr, tc.err, msgs)
+		})
+	}
+}
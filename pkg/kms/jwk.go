@@ -0,0 +1,288 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"math/big"
+)
+
+// JSONWebKey is a public key represented as JSON Web Key (JWK), see RFC 7517.
+type JSONWebKey struct {
+	KeyID     string `json:"kid,omitempty" xml:"kid,omitempty" yaml:"kid,omitempty"`
+	KeyType   string `json:"kty,omitempty" xml:"kty,omitempty" yaml:"kty,omitempty"`
+	Algorithm string `json:"alg,omitempty" xml:"alg,omitempty" yaml:"alg,omitempty"`
+	Use       string `json:"use,omitempty" xml:"use,omitempty" yaml:"use,omitempty"`
+	Curve     string `json:"crv,omitempty" xml:"crv,omitempty" yaml:"crv,omitempty"`
+	Modulus   string `json:"n,omitempty" xml:"n,omitempty" yaml:"n,omitempty"`
+	Exponent  string `json:"e,omitempty" xml:"e,omitempty" yaml:"e,omitempty"`
+	X         string `json:"x,omitempty" xml:"x,omitempty" yaml:"x,omitempty"`
+	Y         string `json:"y,omitempty" xml:"y,omitempty" yaml:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of JSON Web Keys (JWKS), see RFC 7517.
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys" xml:"keys" yaml:"keys"`
+}
+
+// GetPublicKey returns the public key encoded in JSON Web Key.
+func (jwk *JSONWebKey) GetPublicKey() (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeJSONWebKeyParam(jwk.Modulus)
+		if err != nil {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "n", err)
+		}
+		e, err := decodeJSONWebKeyParam(jwk.Exponent)
+		if err != nil {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "e", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "e", "exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.ErrUnsupportedECDSACurve.WithArgs(jwk.Curve)
+		}
+		x, err := decodeJSONWebKeyParam(jwk.X)
+		if err != nil {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "x", err)
+		}
+		y, err := decodeJSONWebKeyParam(jwk.Y)
+		if err != nil {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "y", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "x,y", "point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "crv", "unsupported curve "+jwk.Curve)
+		}
+		x, err := decodeJSONWebKeyBytes(jwk.X)
+		if err != nil {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "x", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.ErrJSONWebKeyParamInvalid.WithArgs(jwk.KeyID, "x", "invalid key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.ErrJSONWebKeyUnsupportedKeyType.WithArgs(jwk.KeyID, jwk.KeyType)
+}
+
+// Thumbprint returns the base64url-encoded SHA-256 thumbprint of the JSON
+// Web Key, see RFC 7638. The thumbprint covers the required members of the
+// key type only.
+func (jwk *JSONWebKey) Thumbprint() (string, error) {
+	var m map[string]string
+	switch jwk.KeyType {
+	case "RSA":
+		m = map[string]string{"e": jwk.Exponent, "kty": jwk.KeyType, "n": jwk.Modulus}
+	case "EC":
+		m = map[string]string{"crv": jwk.Curve, "kty": jwk.KeyType, "x": jwk.X, "y": jwk.Y}
+	case "OKP":
+		m = map[string]string{"crv": jwk.Curve, "kty": jwk.KeyType, "x": jwk.X}
+	default:
+		return "", errors.ErrJSONWebKeyUnsupportedKeyType.WithArgs(jwk.KeyID, jwk.KeyType)
+	}
+	for k, v := range m {
+		if v == "" {
+			return "", errors.ErrJSONWebKeyThumbprintFailed.WithArgs(jwk.KeyID, fmt.Sprintf("%q parameter is empty", k))
+		}
+	}
+	// The keys of the map are marshaled in lexicographic order, without
+	// whitespace, as the thumbprint requires.
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.ErrJSONWebKeyThumbprintFailed.WithArgs(jwk.KeyID, err)
+	}
+	h := sha256.Sum256(b)
+	return encodeJSONWebKeyParam(h[:]), nil
+}
+
+// NewJSONWebKey returns the public key of the provided CryptoKey with key
+// verification capabilities as JSON Web Key. The alg parameter is the default
+// signing method of the key.
+func NewJSONWebKey(k *CryptoKey) (*JSONWebKey, error) {
+	if k == nil || k.Verify == nil || !k.Verify.Capable {
+		return nil, errors.ErrJSONWebKeyNoVerifyKey
+	}
+	jwk := &JSONWebKey{
+		KeyID:     k.Verify.Token.ID,
+		Algorithm: k.Verify.Token.DefaultMethod,
+		Use:       "sig",
+	}
+	if k.Sign != nil && k.Sign.Token.Capable {
+		// The key pair advertises the method it signs tokens with.
+		jwk.Algorithm = k.Sign.Token.DefaultMethod
+	}
+	switch pubKey := k.Verify.Secret.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.Modulus = encodeJSONWebKeyParam(pubKey.N.Bytes())
+		jwk.Exponent = encodeJSONWebKeyParam(big.NewInt(int64(pubKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		params := pubKey.Curve.Params()
+		size := (params.BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = params.Name
+		jwk.X = encodeJSONWebKeyParam(pubKey.X.FillBytes(make([]byte, size)))
+		jwk.Y = encodeJSONWebKeyParam(pubKey.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encodeJSONWebKeyParam(pubKey)
+	default:
+		return nil, errors.ErrJSONWebKeyUnsupportedKeyType.WithArgs(jwk.KeyID, fmt.Sprintf("%T", pubKey))
+	}
+	return jwk, nil
+}
+
+func encodeJSONWebKeyParam(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJSONWebKeyParam(s string) (*big.Int, error) {
+	b, err := decodeJSONWebKeyBytes(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func decodeJSONWebKeyBytes(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.ErrEmptyValue
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// newCryptoKeyFromJSONWebKey returns an instance of CryptoKey with the public
+// key of the provided JSON Web Key. The key id of the JSON Web Key, when
+// present, overrides the key id in the config.
+func newCryptoKeyFromJSONWebKey(jwk *JSONWebKey, cfg *CryptoKeyConfig) (*CryptoKey, error) {
+	pubKey, err := jwk.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	k := newCryptoKey()
+	kcfg := *cfg
+	k.Config = &kcfg
+	if jwk.KeyID != "" {
+		k.Config.ID = jwk.KeyID
+	}
+	k.Verify.Capable = true
+	k.Verify.Secret = pubKey
+	switch pubKey := pubKey.(type) {
+	case *rsa.PublicKey:
+		k.Config.Algorithm = "rsa"
+	case *ecdsa.PublicKey:
+		k.Config.Algorithm = "ecdsa"
+		method, err := getMethodPerCurve(pubKey.Curve.Params().Name)
+		if err != nil {
+			return nil, err
+		}
+		k.Verify.Token.PreferredMethods = []string{method}
+	case ed25519.PublicKey:
+		k.Config.Algorithm = "eddsa"
+	}
+
+	if jwk.Algorithm != "" {
+		if getSigningMethodAlias(jwk.Algorithm) != k.Config.Algorithm {
+			return nil, errors.ErrJSONWebKeyAlgorithmMismatch.WithArgs(jwk.KeyID, jwk.Algorithm, jwk.KeyType)
+		}
+		k.Verify.Token.PreferredMethods = []string{jwk.Algorithm}
+	}
+	return k, nil
+}
+
+// newVerifyCryptoKeyFromJSONWebKey returns an instance of CryptoKey capable
+// of token verification from the provided JSON Web Key of a remote key set.
+// The methods not accepted by the config are removed from the methods of the
+// key.
+func newVerifyCryptoKeyFromJSONWebKey(jwk *JSONWebKey, cfg *CryptoKeyConfig) (*CryptoKey, error) {
+	k, err := newCryptoKeyFromJSONWebKey(jwk, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.VerifyMethods) > 0 {
+		methods := k.Verify.Token.PreferredMethods
+		if len(methods) == 0 {
+			methods = getMethodsPerAlgo(k.Config.Algorithm)
+		}
+		k.Verify.Token.PreferredMethods = filterMethods(methods, cfg.VerifyMethods)
+		if len(k.Verify.Token.PreferredMethods) == 0 {
+			return nil, errors.ErrJSONWebKeyAlgorithmNotAllowed.WithArgs(jwk.KeyID)
+		}
+	}
+	k.enableUsage()
+	return k, nil
+}
+
+// extractKeysFromJSONWebKeys returns the keys from the provided JSON Web Key
+// or JSON Web Key Set document, e.g. exported by an identity provider. The
+// keys not intended for signature verification are skipped.
+func extractKeysFromJSONWebKeys(b []byte, cfg *CryptoKeyConfig) ([]*CryptoKey, error) {
+	var keys []*CryptoKey
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	jwks := &JSONWebKeySet{}
+	if _, exists := doc["keys"]; exists {
+		if err := json.Unmarshal(b, jwks); err != nil {
+			return nil, err
+		}
+	} else {
+		jwk := &JSONWebKey{}
+		if err := json.Unmarshal(b, jwk); err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := newCryptoKeyFromJSONWebKey(jwk, cfg)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.ErrCryptoKeyJwksNoKeysFound
+	}
+	return keys, nil
+}
@@ -0,0 +1,310 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	jwtlib "github.com/golang-jwt/jwt/v4"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJwksRefreshInterval    int = 3600
+	defaultJwksMinRefreshInterval     = 30 * time.Second
+	defaultJwksFetchTimeout           = 10 * time.Second
+	maxJwksResponseSize               = 1 << 20
+	// minJwksRetryInterval is the min interval between the background
+	// fetches, regardless of the min refresh interval.
+	minJwksRetryInterval = time.Second
+)
+
+// jwksKeySet holds the verification keys fetched from a remote JSON Web Key
+// Set endpoint. The keys are indexed by key id. Once the set is added to
+// CryptoKeyStore, the keys are refreshed in background until the set is
+// stopped.
+type jwksKeySet struct {
+	mu     sync.RWMutex
+	url    string
+	cfg    *CryptoKeyConfig
+	client *http.Client
+	keys   []*CryptoKey
+	index  map[string]*CryptoKey
+	// fetchedAt is the time of the last successful fetch.
+	fetchedAt time.Time
+	// attemptedAt is the time of the last fetch attempt.
+	attemptedAt time.Time
+	// fetchErr is the error of the last fetch attempt.
+	fetchErr error
+	// inflight is closed when the fetch in progress completes.
+	inflight chan struct{}
+	// refreshInterval is the interval after which the keys are considered stale.
+	refreshInterval time.Duration
+	// minRefreshInterval limits how often a key id miss triggers a fetch.
+	minRefreshInterval time.Duration
+	done               chan struct{}
+	startOnce          sync.Once
+	stopOnce           sync.Once
+	logger             *zap.Logger
+}
+
+func newJwksKeySet(url string, cfg *CryptoKeyConfig) *jwksKeySet {
+	s := &jwksKeySet{
+		url:                url,
+		cfg:                cfg,
+		client:             &http.Client{Timeout: defaultJwksFetchTimeout},
+		index:              make(map[string]*CryptoKey),
+		refreshInterval:    time.Duration(defaultJwksRefreshInterval) * time.Second,
+		minRefreshInterval: defaultJwksMinRefreshInterval,
+		done:               make(chan struct{}),
+		logger:             zap.NewNop(),
+	}
+	if cfg.JwksRefreshInterval > 0 {
+		s.refreshInterval = time.Duration(cfg.JwksRefreshInterval) * time.Second
+	}
+	return s
+}
+
+// newJwksCryptoKey returns an instance of CryptoKey backed by a remote JSON
+// Web Key Set. The initial set of keys is fetched synchronously. When the
+// fetch fails, e.g. the endpoint is unreachable, the key is returned without
+// keys, and the fetch is retried in background once the key is added to
+// CryptoKeyStore, see CryptoKeyStore.AddKey.
+func newJwksCryptoKey(url string, cfg *CryptoKeyConfig) (*CryptoKey, error) {
+	k := newCryptoKey()
+	k.Config = cfg
+	k.jwks = newJwksKeySet(url, cfg)
+	k.jwks.update()
+	k.Verify.Capable = true
+	for _, algo := range []string{"rsa", "ecdsa", "eddsa"} {
+		k.Verify.Token.PreferredMethods = append(k.Verify.Token.PreferredMethods, getMethodsPerAlgo(algo)...)
+	}
+	return k, nil
+}
+
+func (s *jwksKeySet) setLogger(logger *zap.Logger) {
+	s.mu.Lock()
+	s.logger = logger
+	err := s.fetchErr
+	s.mu.Unlock()
+	if err != nil {
+		logger.Warn("failed fetching json web key set, retrying", zap.String("url", s.url), zap.Error(err))
+	}
+}
+
+// fetch retrieves the JSON Web Key Set and, when successful, replaces
+// the current set of keys. When it fails, the last good set remains.
+func (s *jwksKeySet) fetch() error {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return errors.ErrCryptoKeyJwksFetch.WithArgs(s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.ErrCryptoKeyJwksFetch.WithArgs(s.url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxJwksResponseSize))
+	if err != nil {
+		return errors.ErrCryptoKeyJwksFetch.WithArgs(s.url, err)
+	}
+	keys, err := getKeysFromJSONWebKeySet(b, s.cfg)
+	if err != nil {
+		return errors.ErrCryptoKeyJwksParse.WithArgs(s.url, err)
+	}
+
+	index := make(map[string]*CryptoKey)
+	for _, k := range keys {
+		if k.Config.ID != "" {
+			index[k.Config.ID] = k
+		}
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.index = index
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// update fetches the keys. When a fetch is already in progress, it waits
+// for the fetch to complete instead, i.e. the concurrent updates result in
+// a single fetch.
+func (s *jwksKeySet) update() error {
+	s.mu.Lock()
+	if ch := s.inflight; ch != nil {
+		s.mu.Unlock()
+		<-ch
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.fetchErr
+	}
+	ch := make(chan struct{})
+	s.inflight = ch
+	s.attemptedAt = time.Now()
+	s.mu.Unlock()
+
+	err := s.fetch()
+
+	s.mu.Lock()
+	s.fetchErr = err
+	s.inflight = nil
+	s.mu.Unlock()
+	close(ch)
+	return err
+}
+
+// run refreshes the keys in background, after the refresh interval since
+// the last successful fetch. The failed fetches are retried after the min
+// refresh interval.
+func (s *jwksKeySet) run() {
+	for {
+		s.mu.RLock()
+		next := s.fetchedAt.Add(s.refreshInterval)
+		if retryAt := s.attemptedAt.Add(s.minRefreshInterval); retryAt.After(next) {
+			next = retryAt
+		}
+		s.mu.RUnlock()
+		d := time.Until(next)
+		if d < minJwksRetryInterval {
+			d = minJwksRetryInterval
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := s.update(); err != nil {
+			s.mu.RLock()
+			logger := s.logger
+			s.mu.RUnlock()
+			logger.Warn("failed refreshing json web key set", zap.String("url", s.url), zap.Error(err))
+		}
+	}
+}
+
+// start starts the background refresh of the keys, unless it has already
+// been started.
+func (s *jwksKeySet) start() {
+	s.startOnce.Do(func() {
+		go s.run()
+	})
+}
+
+// stop stops the background refresh of the keys.
+func (s *jwksKeySet) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// getKey returns the key associated with the provided key id. When the key
+// id is unknown, the set is re-fetched, at most once per min refresh
+// interval. The concurrent misses share the fetch.
+func (s *jwksKeySet) getKey(kid string) (*CryptoKey, error) {
+	s.mu.RLock()
+	k, found := s.lookup(kid)
+	canFetch := s.inflight != nil || time.Since(s.attemptedAt) >= s.minRefreshInterval
+	s.mu.RUnlock()
+
+	if found {
+		return k, nil
+	}
+
+	if kid == "" {
+		return nil, errors.ErrCryptoKeyJwksKeyIDNotProvided.WithArgs(s.url)
+	}
+
+	if canFetch {
+		if err := s.update(); err == nil {
+			s.mu.RLock()
+			k, found = s.lookup(kid)
+			s.mu.RUnlock()
+			if found {
+				return k, nil
+			}
+		}
+	}
+	return nil, errors.ErrCryptoKeyJwksKeyNotFound.WithArgs(kid, s.url)
+}
+
+func (s *jwksKeySet) lookup(kid string) (*CryptoKey, bool) {
+	if kid == "" {
+		if len(s.keys) == 1 {
+			return s.keys[0], true
+		}
+		return nil, false
+	}
+	k, found := s.index[kid]
+	return k, found
+}
+
+// provideKey returns the verification key for the provided token.
+func (s *jwksKeySet) provideKey(token *jwtlib.Token) (interface{}, error) {
+	var kid string
+	if v, exists := token.Header["kid"]; exists {
+		kid, _ = v.(string)
+	}
+	k, err := s.getKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	return k.ProvideKey(token)
+}
+
+// getKeysFromJSONWebKeySet returns verification keys from the provided JSON
+// Web Key Set document. The keys not intended for signature verification
+// and the keys of unsupported types are skipped.
+func getKeysFromJSONWebKeySet(b []byte, cfg *CryptoKeyConfig) ([]*CryptoKey, error) {
+	var keys []*CryptoKey
+	jwks := &JSONWebKeySet{}
+	if err := json.Unmarshal(b, jwks); err != nil {
+		return nil, err
+	}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.KeyType {
+		case "RSA", "EC":
+		case "OKP":
+			// X25519 and X448 keys are used for key agreement only.
+			if jwk.Curve != "Ed25519" {
+				continue
+			}
+		default:
+			continue
+		}
+		k, err := newVerifyCryptoKeyFromJSONWebKey(jwk, cfg)
+		if err != nil {
+			if stderrors.Is(err, errors.ErrJSONWebKeyAlgorithmNotAllowed) {
+				continue
+			}
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.ErrCryptoKeyJwksNoKeysFound
+	}
+	return keys, nil
+}
@@ -0,0 +1,470 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testJwksServer struct {
+	mu     sync.Mutex
+	keys   []*JSONWebKey
+	status int
+	hits   int
+}
+
+func (srv *testJwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.hits++
+	if srv.status != 0 && srv.status != http.StatusOK {
+		w.WriteHeader(srv.status)
+		return
+	}
+	b, _ := json.Marshal(&JSONWebKeySet{Keys: srv.keys})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (srv *testJwksServer) set(status int, keys ...*JSONWebKey) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.status = status
+	srv.keys = keys
+}
+
+func newTestSignKey(t *testing.T, kid, fp string) *CryptoKey {
+	configs, err := ParseCryptoKeyConfigs(fmt.Sprintf("crypto key %s sign-verify from file %s", kid, fp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys[0]
+}
+
+func newTestJSONWebKey(t *testing.T, k *CryptoKey) *JSONWebKey {
+	jwk, err := NewJSONWebKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwk
+}
+
+func TestJwksCryptoKey(t *testing.T) {
+	rsaKey := newTestSignKey(t, "kid1", "./../../testdata/rskeys/test_2_pri.pem")
+	ecKey := newTestSignKey(t, "kid2", "./../../testdata/ecdsakeys/test_1_pri.pem")
+	rotatedKey := newTestSignKey(t, "kid3", "./../../testdata/ecdsakeys/test_2_pri.pem")
+	unknownKey := newTestSignKey(t, "kid4", "./../../testdata/rskeys/test_1_pri.pem")
+
+	srv := &testJwksServer{}
+	srv.set(http.StatusOK, newTestJSONWebKey(t, rsaKey), newTestJSONWebKey(t, ecKey))
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	configs, err := ParseCryptoKeyConfigs("crypto key jwks_keys verify from jwks " + ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys[0].jwks.mu.Lock()
+	keys[0].jwks.minRefreshInterval = 0
+	keys[0].jwks.mu.Unlock()
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+
+	testcases := []struct {
+		name      string
+		key       *CryptoKey
+		status    int
+		jwks      []*JSONWebKey
+		hits      int
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "verify token signed with rsa key",
+			key:  rsaKey,
+			hits: 1,
+		},
+		{
+			name: "verify token signed with ecdsa key",
+			key:  ecKey,
+			hits: 1,
+		},
+		{
+			name:   "verify token signed with rotated key",
+			key:    rotatedKey,
+			status: http.StatusOK,
+			jwks:   []*JSONWebKey{newTestJSONWebKey(t, rotatedKey)},
+			hits:   2,
+		},
+		{
+			name:   "verify token signed with rotated key when jwks endpoint is down",
+			key:    rotatedKey,
+			status: http.StatusInternalServerError,
+			hits:   2,
+		},
+		{
+			name:      "verify token signed with unknown key when jwks endpoint is down",
+			key:       unknownKey,
+			status:    http.StatusInternalServerError,
+			hits:      3,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "verify token signed with key retired from jwks",
+			key:       rsaKey,
+			status:    http.StatusOK,
+			jwks:      []*JSONWebKey{newTestJSONWebKey(t, rotatedKey)},
+			hits:      4,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			if tc.status != 0 {
+				srv.set(tc.status, tc.jwks...)
+			}
+			usr := newTestUser()
+			if err := tc.key.SignToken(nil, usr); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, fmt.Sprintf("token: %s", usr.Token))
+			_, err := ks.ParseToken("access_token", usr.Token)
+			srv.mu.Lock()
+			hits := srv.hits
+			srv.mu.Unlock()
+			tests.EvalObjectsWithLog(t, "jwks hits", tc.hits, hits, msgs)
+			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+		})
+	}
+}
+
+func TestJwksCryptoKeyUnreachable(t *testing.T) {
+	signKey := newTestSignKey(t, "kid1", "./../../testdata/rskeys/test_2_pri.pem")
+	srv := &testJwksServer{}
+	srv.set(http.StatusServiceUnavailable)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	configs, err := ParseCryptoKeyConfigs("crypto key jwks_keys verify from jwks " + ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The keys are not fetched, but the key is provisioned.
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+
+	usr := newTestUser()
+	if err := signKey.SignToken(nil, usr); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ks.ParseToken("access_token", usr.Token)
+	tests.EvalErrWithLog(t, err, "parse token", true, errors.ErrCryptoKeyStoreParseTokenFailed, nil)
+
+	// The fetch is retried in background.
+	s := newJwksKeySet(ts.URL, configs[0])
+	s.minRefreshInterval = 0
+	s.update()
+	s.start()
+	defer s.stop()
+	srv.set(http.StatusOK, newTestJSONWebKey(t, signKey))
+	for i := 0; i < 50; i++ {
+		s.mu.RLock()
+		_, found := s.lookup("kid1")
+		s.mu.RUnlock()
+		if found {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("keys not fetched in background")
+}
+
+func TestJwksCryptoKeyRefreshStart(t *testing.T) {
+	signKey := newTestSignKey(t, "kid1", "./../../testdata/rskeys/test_2_pri.pem")
+	srv := &testJwksServer{}
+	srv.set(http.StatusOK, newTestJSONWebKey(t, signKey))
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	getHits := func() int {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.hits
+	}
+
+	configs, err := ParseCryptoKeyConfigs("crypto key jwks_keys verify from jwks " + ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := keys[0].jwks
+	s.mu.Lock()
+	s.refreshInterval = 0
+	s.minRefreshInterval = 0
+	s.mu.Unlock()
+
+	// The keys are not refreshed until the key is added to the keystore.
+	time.Sleep(minJwksRetryInterval + 200*time.Millisecond)
+	tests.EvalObjects(t, "jwks hits prior to adding key", 1, getHits())
+
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30 && getHits() < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if getHits() < 2 {
+		t.Fatalf("keys not refreshed in background")
+	}
+
+	// The keys are not refreshed once the keystore is closed.
+	ks.Close()
+	time.Sleep(100 * time.Millisecond)
+	hits := getHits()
+	time.Sleep(minJwksRetryInterval + 200*time.Millisecond)
+	tests.EvalObjects(t, "jwks hits after closing keystore", hits, getHits())
+}
+
+func TestJwksKeySetKeyIDMiss(t *testing.T) {
+	signKey := newTestSignKey(t, "kid1", "./../../testdata/rskeys/test_2_pri.pem")
+	srv := &testJwksServer{}
+	srv.set(http.StatusOK, newTestJSONWebKey(t, signKey))
+	release := make(chan struct{})
+	var blocked bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		b := blocked
+		srv.mu.Unlock()
+		if b {
+			<-release
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	configs, err := ParseCryptoKeyConfigs("crypto key jwks_keys verify from jwks " + ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newJwksKeySet(ts.URL, configs[0])
+	if err := s.update(); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	blocked = true
+	srv.mu.Unlock()
+	s.minRefreshInterval = 0
+
+	// The concurrent misses share a single fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.getKey("kid2")
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	srv.mu.Lock()
+	hits := srv.hits
+	srv.mu.Unlock()
+	tests.EvalObjects(t, "jwks hits after concurrent misses", 2, hits)
+
+	// The misses within the min refresh interval do not fetch the keys.
+	s.minRefreshInterval = time.Minute
+	_, err = s.getKey("kid2")
+	tests.EvalErrWithLog(t, err, "get key", true, errors.ErrCryptoKeyJwksKeyNotFound.WithArgs("kid2", ts.URL), nil)
+	srv.mu.Lock()
+	hits = srv.hits
+	srv.mu.Unlock()
+	tests.EvalObjects(t, "jwks hits after rate limited miss", 2, hits)
+}
+
+func TestGetKeysFromJSONWebKeySet(t *testing.T) {
+	testcases := []struct {
+		name      string
+		data      string
+		accept    []string
+		want      []string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "rsa and ecdsa keys with encryption key",
+			data: `{"keys": [
+			  {"kty": "RSA", "kid": "a", "use": "sig", "alg": "RS256", "n": "sXch", "e": "AQAB"},
+			  {"kty": "RSA", "kid": "b", "use": "enc", "n": "sXch", "e": "AQAB"},
+			  {"kty": "oct", "kid": "c", "k": "Zm9vYmFy"},
+			  {"kty": "EC", "kid": "d", "crv": "P-256",
+			   "x": "MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4",
+			   "y": "4Etl6SRW2YiLUrN5vfvVHuhp7x8PxltmWWlbbM4IFyM"}
+			]}`,
+			want: []string{"a: RS256", "d: ES256"},
+		},
+		{
+			name: "rsa and ecdsa keys restricted to ecdsa methods",
+			data: `{"keys": [
+			  {"kty": "RSA", "kid": "a", "use": "sig", "alg": "RS256", "n": "sXch", "e": "AQAB"},
+			  {"kty": "EC", "kid": "d", "crv": "P-256",
+			   "x": "MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4",
+			   "y": "4Etl6SRW2YiLUrN5vfvVHuhp7x8PxltmWWlbbM4IFyM"}
+			]}`,
+			accept: []string{"ES256", "ES384"},
+			want:   []string{"d: ES256"},
+		},
+		{
+			name: "eddsa key with key agreement key",
+			data: `{"keys": [
+			  {"kty": "OKP", "kid": "e", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"},
+			  {"kty": "OKP", "kid": "f", "crv": "X25519", "x": "hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo"}
+			]}`,
+			want: []string{"e: EdDSA"},
+		},
+		{
+			name: "eddsa key with invalid size",
+			data: `{"keys": [
+			  {"kty": "OKP", "kid": "e", "crv": "Ed25519", "x": "AQAB"}
+			]}`,
+			shouldErr: true,
+			err:       errors.ErrJSONWebKeyParamInvalid.WithArgs("e", "x", "invalid key size"),
+		},
+		{
+			name: "algorithm mismatch",
+			data: `{"keys": [
+			  {"kty": "RSA", "kid": "a", "alg": "ES256", "n": "sXch", "e": "AQAB"}
+			]}`,
+			shouldErr: true,
+			err:       errors.ErrJSONWebKeyAlgorithmMismatch.WithArgs("a", "ES256", "RSA"),
+		},
+		{
+			name: "ecdsa point not on curve",
+			data: `{"keys": [
+			  {"kty": "EC", "kid": "d", "crv": "P-256", "x": "AQAB", "y": "AQAB"}
+			]}`,
+			shouldErr: true,
+			err:       errors.ErrJSONWebKeyParamInvalid.WithArgs("d", "x,y", "point is not on curve"),
+		},
+		{
+			name:      "no signing keys",
+			data:      `{"keys": []}`,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyJwksNoKeysFound,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			cfg := &CryptoKeyConfig{Usage: "verify", TokenName: "access_token", TokenLifetime: 900, VerifyMethods: tc.accept}
+			keys, err := getKeysFromJSONWebKeySet([]byte(tc.data), cfg)
+			if tests.EvalErrWithLog(t, err, "keys", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			var got []string
+			for _, k := range keys {
+				got = append(got, fmt.Sprintf("%s: %s", k.Verify.Token.ID, k.Verify.Token.DefaultMethod))
+			}
+			tests.EvalObjectsWithLog(t, "keys", tc.want, got, msgs)
+		})
+	}
+}
+
+func TestJSONWebKeyThumbprint(t *testing.T) {
+	var testcases = []struct {
+		name      string
+		jwk       *JSONWebKey
+		want      string
+		shouldErr bool
+		err       error
+	}{
+		{
+			// The example in RFC 7638, section 3.1.
+			name: "rsa key",
+			jwk: &JSONWebKey{
+				KeyID:     "2011-04-29",
+				KeyType:   "RSA",
+				Algorithm: "RS256",
+				Modulus:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+				Exponent:  "AQAB",
+			},
+			want: "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		},
+		{
+			name: "key with unsupported key type",
+			jwk: &JSONWebKey{
+				KeyID:   "foo",
+				KeyType: "oct",
+			},
+			shouldErr: true,
+			err:       errors.ErrJSONWebKeyUnsupportedKeyType.WithArgs("foo", "oct"),
+		},
+		{
+			name: "ec key without y coordinate",
+			jwk: &JSONWebKey{
+				KeyID:   "foo",
+				KeyType: "EC",
+				Curve:   "P-256",
+				X:       "f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU",
+			},
+			shouldErr: true,
+			err:       errors.ErrJSONWebKeyThumbprintFailed.WithArgs("foo", `"y" parameter is empty`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			got, err := tc.jwk.Thumbprint()
+			if tests.EvalErrWithLog(t, err, "thumbprint", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			tests.EvalObjectsWithLog(t, "thumbprint", tc.want, got, msgs)
+		})
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
@@ -33,13 +34,33 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// keyFileExtensions are the extensions of the files with PEM encoded keys.
+var keyFileExtensions = map[string]bool{
+	".pem": true,
+	".key": true,
+}
+
+// keyFileFormatExtensions are the extensions of the files with the keys in
+// the formats enabled by key config, see CryptoKeyConfig.FileFormats.
+var keyFileFormatExtensions = map[string][]string{
+	"certificate": {".crt", ".cer"},
+	"jwk":         {".jwk", ".jwks", ".json"},
+}
+
 // CryptoKey contains a crypto graphic key and associated metadata.
 type CryptoKey struct {
 	Config *CryptoKeyConfig   `json:"config,omitempty" xml:"config,omitempty" yaml:"config,omitempty"`
 	Sign   *CryptoKeyOperator `json:"sign,omitempty" xml:"sign,omitempty" yaml:"sign,omitempty"`
 	Verify *CryptoKeyOperator `json:"verify,omitempty" xml:"verify,omitempty" yaml:"verify,omitempty"`
+	// Decrypt holds the key decrypting encrypted tokens, i.e. JWE.
+	Decrypt *CryptoKeyOperator `json:"decrypt,omitempty" xml:"decrypt,omitempty" yaml:"decrypt,omitempty"`
+	// jwks holds the keys fetched from a remote JSON Web Key Set.
+	jwks *jwksKeySet
+	// watch holds the keys loaded from a watched file or directory.
+	watch *watchedKeySet
 }
 
 // CryptoKeyTokenOperator represents CryptoKeyOperator token operator.
@@ -51,6 +72,7 @@ type CryptoKeyTokenOperator struct {
 	PreferredMethods []string               `json:"preferred_methods,omitempty" xml:"preferred_methods,omitempty" yaml:"preferred_methods,omitempty"`
 	DefaultMethod    string                 `json:"default_method,omitempty" xml:"default_method,omitempty" yaml:"default_method,omitempty"`
 	Capable          bool                   `json:"capable,omitempty" xml:"capable,omitempty" yaml:"capable,omitempty"`
+	Issuer           string                 `json:"issuer,omitempty" xml:"issuer,omitempty" yaml:"issuer,omitempty"`
 	injectKeyID      bool
 }
 
@@ -79,6 +101,7 @@ func newCryptoKey() *CryptoKey {
 	k := &CryptoKey{}
 	k.Sign = NewCryptoKeyOperator()
 	k.Verify = NewCryptoKeyOperator()
+	k.Decrypt = NewCryptoKeyOperator()
 	return k
 }
 
@@ -98,9 +121,18 @@ func GetKeysFromConfigs(cfgs []*CryptoKeyConfig) ([]*CryptoKey, error) {
 // GetKeysFromConfig loads keys from a single key config.
 func GetKeysFromConfig(cfg *CryptoKeyConfig) ([]*CryptoKey, error) {
 	var keys []*CryptoKey
+	if err := cfg.compileEvalExpr(); err != nil {
+		return nil, err
+	}
 	switch cfg.Source {
 	case "config":
 		switch {
+		case cfg.WatchInterval > 0 && (cfg.FilePath != "" || cfg.DirPath != ""):
+			k, err := newWatchedCryptoKey(cfg)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
 		case cfg.Algorithm == "hmac":
 			// Discovered shared key
 			k := newCryptoKey()
@@ -118,6 +150,18 @@ func GetKeysFromConfig(cfg *CryptoKeyConfig) ([]*CryptoKey, error) {
 				return nil, err
 			}
 			keys = append(keys, dirKeys...)
+		case cfg.JwksURL != "":
+			k, err := newJwksCryptoKey(cfg.JwksURL, cfg)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		case cfg.OidcIssuerURL != "":
+			k, err := newOidcCryptoKey(cfg.OidcIssuerURL, cfg)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
 		default:
 			return nil, fmt.Errorf("unsupported config")
 		}
@@ -139,6 +183,12 @@ func GetKeysFromConfig(cfg *CryptoKeyConfig) ([]*CryptoKey, error) {
 			k.Config.Algorithm = "hmac"
 			k.Config.Secret = k.Config.EnvVarValue
 			keys = append(keys, k)
+		case cfg.WatchInterval > 0 && (cfg.EnvVarType == "file" || cfg.EnvVarType == "directory"):
+			k, err := newWatchedCryptoKey(cfg)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
 		case cfg.EnvVarType == "file":
 			fileKeys, err := extractKeysFromFile(cfg.EnvVarValue, cfg)
 			if err != nil {
@@ -157,21 +207,95 @@ func GetKeysFromConfig(cfg *CryptoKeyConfig) ([]*CryptoKey, error) {
 	}
 
 	for _, k := range keys {
-		switch k.Config.Algorithm {
-		case "hmac":
-			k.Sign.Capable = true
-			k.Verify.Capable = true
-			k.Sign.Secret = []byte(k.Config.Secret)
-			k.Verify.Secret = []byte(k.Config.Secret)
-		case "rsa", "ecdsa":
-		default:
-			return nil, fmt.Errorf("unsupported config algorithm %s", k.Config.Algorithm)
+		if err := k.configure(); err != nil {
+			return nil, err
 		}
-		k.enableUsage()
 	}
 	return keys, nil
 }
 
+// configure enables the key signing and verification capabilities of the
+// key based on its config.
+func (k *CryptoKey) configure() error {
+	switch k.Config.Algorithm {
+	case "hmac":
+		k.Sign.Capable = true
+		k.Verify.Capable = true
+		k.Sign.Secret = []byte(k.Config.Secret)
+		k.Verify.Secret = []byte(k.Config.Secret)
+	case "rsa", "ecdsa", "eddsa":
+	case "":
+		if k.jwks == nil && k.watch == nil {
+			return fmt.Errorf("unsupported config algorithm %s", k.Config.Algorithm)
+		}
+	default:
+		return fmt.Errorf("unsupported config algorithm %s", k.Config.Algorithm)
+	}
+	if k.Config.Usage == "decrypt" {
+		return k.configureDecrypt()
+	}
+	if len(k.Config.VerifyMethods) > 0 && k.Verify.Capable {
+		methods := k.Verify.Token.PreferredMethods
+		if len(methods) == 0 {
+			methods = getMethodsPerAlgo(k.Config.Algorithm)
+		}
+		for _, m := range k.Config.VerifyMethods {
+			if !hasMethod(methods, m) {
+				return errors.ErrCryptoKeyConfigVerifyMethodUnsupported.WithArgs(k.Config.ID, m)
+			}
+		}
+		k.Verify.Token.PreferredMethods = k.Config.VerifyMethods
+	}
+	k.enableUsage()
+	if k.Config.PreferredSignMethod != "" && k.Sign.Capable {
+		if k.Sign.Token.DefaultMethod != k.Config.PreferredSignMethod {
+			return errors.ErrCryptoKeyConfigSignMethodUnsupported.WithArgs(k.Config.ID, k.Config.PreferredSignMethod)
+		}
+	}
+	return nil
+}
+
+// isActive returns true when the key may sign tokens at the provided time,
+// i.e. the time is within the validity window of the key.
+func (k *CryptoKey) isActive(now time.Time) bool {
+	if notBefore := k.getNotBefore(); !notBefore.IsZero() && now.Before(notBefore) {
+		return false
+	}
+	return !k.isExpired(now)
+}
+
+// getNotBefore returns the time the key becomes active.
+func (k *CryptoKey) getNotBefore() time.Time {
+	if k.Config == nil {
+		return time.Time{}
+	}
+	return k.Config.NotBefore
+}
+
+// isExpired returns true when the key is retired at the provided time.
+func (k *CryptoKey) isExpired(now time.Time) bool {
+	if k.Config == nil || k.Config.NotAfter.IsZero() {
+		return false
+	}
+	return !now.Before(k.Config.NotAfter)
+}
+
+// isPasetoKey returns true when the key is configured for PASETO tokens
+// only, see CryptoKeyConfig.TokenType.
+func (k *CryptoKey) isPasetoKey() bool {
+	return k.Config != nil && k.Config.TokenType == "paseto"
+}
+
+// hasKeyID returns true when the key verifies or decrypts the tokens with
+// its key id, i.e. the key id is configured explicitly. The keys backed by
+// remote key sets and watched files have no key id of their own.
+func (k *CryptoKey) hasKeyID() bool {
+	if k.jwks != nil || k.watch != nil || k.Config == nil {
+		return false
+	}
+	return k.Config.ID != "" && k.Config.ID != defaultKeyID
+}
+
 func (k *CryptoKey) enableUsage() {
 	methods := getMethodsPerAlgo(k.Config.Algorithm)
 	if k.Sign.Capable {
@@ -186,6 +310,9 @@ func (k *CryptoKey) enableUsage() {
 		k.Sign.Token.Name = k.Config.TokenName
 		k.Sign.Token.MaxLifetime = k.Config.TokenLifetime
 		k.Sign.Token.DefaultMethod = k.Sign.Token.PreferredMethods[0]
+		if _, exists := k.Sign.Token.Methods[k.Config.PreferredSignMethod]; exists {
+			k.Sign.Token.DefaultMethod = k.Config.PreferredSignMethod
+		}
 		if k.Config.ID != defaultKeyID && k.Config.ID != "" {
 			k.Sign.Token.injectKeyID = true
 		}
@@ -219,6 +346,13 @@ func (k *CryptoKey) SignToken(signMethod interface{}, usr *user.User) error {
 }
 
 func (k *CryptoKey) sign(signMethod, data interface{}) (interface{}, error) {
+	if k.watch != nil {
+		wk := k.watch.getSignKey()
+		if wk == nil {
+			return nil, errors.ErrSigningKeyNotFound.WithArgs(signMethod)
+		}
+		return wk.sign(signMethod, data)
+	}
 	var method string
 	if signMethod == nil {
 		if k.Sign.Token.DefaultMethod == "" {
@@ -253,6 +387,8 @@ func (k *CryptoKey) sign(signMethod, data interface{}) (interface{}, error) {
 		return k.signRSA(method, s)
 	case "ecdsa":
 		return k.signECDSA(method, s)
+	case "eddsa":
+		return k.signEdDSA(method, s)
 	}
 
 	/*
@@ -270,30 +406,42 @@ func (k *CryptoKey) sign(signMethod, data interface{}) (interface{}, error) {
 	return nil, errors.ErrDataSigningFailed.WithArgs(method, "unsupported method")
 }
 
-// ProvideKey returns the appropriate encryption key.
+// ProvideKey returns the appropriate encryption key. The signing algorithm
+// in the token header must be one of the methods accepted by the key.
 func (k *CryptoKey) ProvideKey(token *jwtlib.Token) (interface{}, error) {
+	if _, allowed := k.Verify.Token.Methods[token.Method.Alg()]; !allowed {
+		return nil, errors.ErrCryptoKeyAlgorithmNotAllowed.WithArgs(k.Verify.Token.ID, token.Method.Alg())
+	}
+	if k.jwks != nil {
+		return k.jwks.provideKey(token)
+	}
 	switch k.Config.Algorithm {
 	case "hmac":
 		if _, validMethod := token.Method.(*jwtlib.SigningMethodHMAC); !validMethod {
 			return nil, errors.ErrUnexpectedSigningMethod.WithArgs("HS", token.Header["alg"])
 		}
 	case "rsa":
-		if _, validMethod := token.Method.(*jwtlib.SigningMethodRSA); !validMethod {
+		switch token.Method.(type) {
+		case *jwtlib.SigningMethodRSA, *jwtlib.SigningMethodRSAPSS:
+		default:
 			return nil, errors.ErrUnexpectedSigningMethod.WithArgs("RS", token.Header["alg"])
 		}
 	case "ecdsa":
 		if _, validMethod := token.Method.(*jwtlib.SigningMethodECDSA); !validMethod {
 			return nil, errors.ErrUnexpectedSigningMethod.WithArgs("ES", token.Header["alg"])
 		}
+	case "eddsa":
+		if _, validMethod := token.Method.(*jwtlib.SigningMethodEd25519); !validMethod {
+			return nil, errors.ErrUnexpectedSigningMethod.WithArgs("EdDSA", token.Header["alg"])
+		}
+	default:
+		return nil, errors.ErrUnexpectedSigningMethod.WithArgs(k.Config.Algorithm, token.Header["alg"])
 	}
 	return k.Verify.Secret, nil
 }
 
-func extractBytesFromFile(fp string) ([]byte, error) {
-	ext := filepath.Ext(fp)
-	switch ext {
-	case ".pem", ".key":
-	default:
+func extractBytesFromFile(fp string, exts map[string]bool) ([]byte, error) {
+	if !exts[filepath.Ext(fp)] {
 		return nil, errors.ErrCryptoKeyConfigFileNotSupported.WithArgs(fp)
 	}
 	b, err := ioutil.ReadFile(fp)
@@ -305,10 +453,20 @@ func extractBytesFromFile(fp string) ([]byte, error) {
 
 func extractKeysFromFile(fp string, cfg *CryptoKeyConfig) ([]*CryptoKey, error) {
 	var keys []*CryptoKey
-	b, err := extractBytesFromFile(fp)
+	b, err := extractBytesFromFile(fp, cfg.getFileExtensions())
 	if err != nil {
 		return nil, err
 	}
+	if cfg.hasFileFormat("jwk") && bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		if err := validatePublicKeyUsage(cfg); err != nil {
+			return nil, errors.ErrCryptoKeyConfigReadFile.WithArgs(fp, err)
+		}
+		keys, err = extractKeysFromJSONWebKeys(b, cfg)
+		if err != nil {
+			return nil, errors.ErrCryptoKeyConfigReadFile.WithArgs(fp, err)
+		}
+		return keys, nil
+	}
 	key, err := extractKey(b, cfg)
 	if err != nil {
 		return nil, errors.ErrCryptoKeyConfigReadFile.WithArgs(fp, err)
@@ -330,8 +488,35 @@ func extractKey(kb []byte, cfg *CryptoKeyConfig) (*CryptoKey, error) {
 	if block, _ = pem.Decode(kb); block == nil {
 		return nil, errors.ErrNotPEMEncodedKey
 	}
+	block, err := decryptPrivateKeyBlock(block, k.Config)
+	if err != nil {
+		return nil, err
+	}
 
 	switch {
+	case block.Type == "CERTIFICATE":
+		if err := validatePublicKeyUsage(k.Config); err != nil {
+			return nil, err
+		}
+		pubKey, err := extractPublicKeyFromCertificates(kb, k.Config)
+		if err != nil {
+			return nil, err
+		}
+		k.Verify.Capable = true
+		switch pubKey := pubKey.(type) {
+		case *rsa.PublicKey:
+			k.Config.Algorithm = "rsa"
+			k.Verify.Secret = pubKey
+		case *ecdsa.PublicKey:
+			k.Config.Algorithm = "ecdsa"
+			k.Verify.Secret = pubKey
+			curveName = pubKey.Curve.Params().Name
+		case ed25519.PublicKey:
+			k.Config.Algorithm = "eddsa"
+			k.Verify.Secret = pubKey
+		default:
+			return nil, errors.ErrCryptoKeyConfigUnsupportedPublicKeyAlgo.WithArgs(pubKey)
+		}
 	case bytes.Contains(kb, []byte("RSA PRIVATE KEY")):
 		k.Config.Algorithm = "rsa"
 		privKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
@@ -396,8 +581,17 @@ func extractKey(kb []byte, cfg *CryptoKeyConfig) (*CryptoKey, error) {
 				k.Verify.Capable = true
 				k.Verify.Secret = privKey.Public()
 			}
+		case ed25519.PrivateKey:
+			k.Config.Algorithm = "eddsa"
+			k.Sign.Capable = true
+			k.Sign.Secret = privKey
+			switch k.Config.Usage {
+			case "sign":
+			default:
+				k.Verify.Capable = true
+				k.Verify.Secret = privKey.Public()
+			}
 		default:
-			// case ed25519.PrivateKey
 			return nil, errors.ErrCryptoKeyConfigUnsupportedPrivateKeyAlgo.WithArgs(privKey)
 		}
 	case bytes.Contains(kb, []byte("RSA PUBLIC KEY")):
@@ -426,9 +620,11 @@ func extractKey(kb []byte, cfg *CryptoKeyConfig) (*CryptoKey, error) {
 				return nil, errors.ErrNoECDSACurveParamsFound
 			}
 			curveName = curve.Name
+		case ed25519.PublicKey:
+			k.Config.Algorithm = "eddsa"
+			k.Verify.Secret = pubKey
 		default:
 			// case *dsa.PublicKey
-			// case ed25519.PublicKey
 			return nil, errors.ErrCryptoKeyConfigUnsupportedPublicKeyAlgo.WithArgs(pubKey)
 		}
 	default:
@@ -436,17 +632,9 @@ func extractKey(kb []byte, cfg *CryptoKeyConfig) (*CryptoKey, error) {
 	}
 
 	if k.Config.Algorithm == "ecdsa" {
-		// See https://golang.org/src/crypto/elliptic/elliptic.go.
-		var method string
-		switch curveName {
-		case "P-256":
-			method = "ES256"
-		case "P-384":
-			method = "ES384"
-		case "P-521":
-			method = "ES512"
-		default:
-			return nil, errors.ErrUnsupportedECDSACurve.WithArgs(curveName)
+		method, err := getMethodPerCurve(curveName)
+		if err != nil {
+			return nil, err
 		}
 		if k.Sign.Capable {
 			k.Sign.Token.PreferredMethods = []string{method}
@@ -458,8 +646,66 @@ func extractKey(kb []byte, cfg *CryptoKeyConfig) (*CryptoKey, error) {
 	return k, nil
 }
 
+// validatePublicKeyUsage returns an error when the key usage requires a
+// private key, because X.509 certificates and JSON Web Keys hold public keys.
+func validatePublicKeyUsage(cfg *CryptoKeyConfig) error {
+	switch cfg.Usage {
+	case "sign", "sign-verify", "decrypt":
+		return errors.ErrCryptoKeyPublicKeyUsage.WithArgs(cfg.Usage)
+	}
+	return nil
+}
+
+// extractPublicKeyFromCertificates returns the public key of the first
+// certificate in the provided PEM encoded certificates. The remaining
+// certificates are intermediate certificates. When the config has a CA
+// bundle, the certificate chain and the expiry of the certificates are
+// verified against the bundle.
+func extractPublicKeyFromCertificates(kb []byte, cfg *CryptoKeyConfig) (interface{}, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(kb); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.ErrCryptoKeyCertificateNotFound
+	}
+	if cfg.CABundlePath == "" {
+		return certs[0].PublicKey, nil
+	}
+
+	b, err := ioutil.ReadFile(cfg.CABundlePath)
+	if err != nil {
+		return nil, errors.ErrCryptoKeyCABundleInvalid.WithArgs(cfg.CABundlePath, err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, errors.ErrCryptoKeyCABundleInvalid.WithArgs(cfg.CABundlePath, "no certificates found")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return nil, errors.ErrCryptoKeyCertificateInvalid.WithArgs(cfg.ID, err)
+	}
+	return certs[0].PublicKey, nil
+}
+
 func extractKeysFromDir(dirPath string, cfg *CryptoKeyConfig) ([]*CryptoKey, error) {
 	var dirKeys []*CryptoKey
+	exts := cfg.getFileExtensions()
 	err := filepath.Walk(dirPath, func(fp string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -468,9 +714,7 @@ func extractKeysFromDir(dirPath string, cfg *CryptoKeyConfig) ([]*CryptoKey, err
 			return nil
 		}
 		ext := filepath.Ext(fp)
-		switch ext {
-		case ".pem", ".key":
-		default:
+		if !exts[ext] {
 			return nil
 		}
 
@@ -552,14 +796,26 @@ func (k *CryptoKey) signECDSA(method, data string) (interface{}, error) {
 	return data + "." + base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+func (k *CryptoKey) signEdDSA(method, data string) (interface{}, error) {
+	if method != "EdDSA" {
+		return nil, errors.ErrDataSigningFailed.WithArgs("EdDSA", "unsupported method")
+	}
+	pk, ok := k.Sign.Secret.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.ErrDataSigningFailed.WithArgs("EdDSA", "unsupported key type")
+	}
+	b := ed25519.Sign(pk, []byte(data))
+	return data + "." + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func (k *CryptoKey) signRSA(method, data string) (interface{}, error) {
 	var h crypto.Hash
 	switch method {
-	case "RS256":
+	case "RS256", "PS256":
 		h = crypto.SHA256
-	case "RS384":
+	case "RS384", "PS384":
 		h = crypto.SHA384
-	case "RS512":
+	case "RS512", "PS512":
 		h = crypto.SHA512
 	default:
 		return nil, errors.ErrDataSigningFailed.WithArgs("RSA", "unsupported method")
@@ -571,7 +827,13 @@ func (k *CryptoKey) signRSA(method, data string) (interface{}, error) {
 	hf.Write([]byte(data))
 
 	pk := k.Sign.Secret.(*rsa.PrivateKey)
-	b, err := rsa.SignPKCS1v15(rand.Reader, pk, h, hf.Sum(nil))
+	var b []byte
+	var err error
+	if strings.HasPrefix(method, "PS") {
+		b, err = rsa.SignPSS(rand.Reader, pk, h, hf.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	} else {
+		b, err = rsa.SignPKCS1v15(rand.Reader, pk, h, hf.Sum(nil))
+	}
 	if err != nil {
 		return nil, errors.ErrDataSigningFailed.WithArgs("RSA", err)
 	}
@@ -15,11 +15,17 @@
 package kms
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/greenpau/caddy-authorize/internal/tests"
 	"github.com/greenpau/caddy-authorize/pkg/errors"
 	"github.com/greenpau/caddy-authorize/pkg/user"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
@@ -52,9 +58,11 @@ func TestGetKeysFromConfig(t *testing.T) {
 		want   map[string]interface{}
 		log    bool
 		// keyPair indicates which keys are being used for sign/verification.
-		keyPair   []int
-		shouldErr bool
-		err       error
+		keyPair []int
+		// signMethod is the expected default token signing method.
+		signMethod string
+		shouldErr  bool
+		err        error
 	}{
 		{
 			name: "default shared key in default context",
@@ -214,6 +222,385 @@ func TestGetKeysFromConfig(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "load private rsa key from file path for both sign and verify with PS256 method",
+			config: `
+                crypto key k9738a405e99 token method PS256
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+            `,
+			keyPair:    []int{0, 0},
+			signMethod: "PS256",
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: *rsa.PrivateKey",
+					"0: verify k9738a405e99: *rsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load private rsa key and x509 certificate verified with ca bundle",
+			config: `
+                crypto key k9738a405e99 sign from file ./../../testdata/rskeys/test_2_pri.pem
+                crypto key k9738a405e99 verify from file ./../../testdata/certs/rsa_test_2.crt
+                crypto key k9738a405e99 ca bundle ./../../testdata/certs/ca.pem
+            `,
+			keyPair: []int{0, 1},
+			want: map[string]interface{}{
+				"config_count": 2,
+				"key_count":    2,
+				"keys": []string{
+					"0: sign   k9738a405e99: *rsa.PrivateKey",
+					"1: verify k9738a405e99: *rsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load private ecdsa key and x509 certificate chain verified with ca bundle",
+			config: `
+                crypto key k9738a405e99 sign from file ./../../testdata/ecdsakeys/test_1_pri.pem
+                crypto key k9738a405e99 verify from file ./../../testdata/certs/ecdsa_test_1_chain.crt
+                crypto key k9738a405e99 ca bundle ./../../testdata/certs/ca.pem
+            `,
+			keyPair: []int{0, 1},
+			want: map[string]interface{}{
+				"config_count": 2,
+				"key_count":    2,
+				"keys": []string{
+					"0: sign   k9738a405e99: *ecdsa.PrivateKey",
+					"1: verify k9738a405e99: *ecdsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load private eddsa key and self-signed x509 certificate",
+			config: `
+                crypto key k9738a405e99 sign from file ./../../testdata/eddsakeys/test_1_pri.pem
+                crypto key k9738a405e99 verify from file ./../../testdata/certs/eddsa_test_1_self_signed.crt
+                crypto key k9738a405e99 format certificate
+            `,
+			keyPair: []int{0, 1},
+			want: map[string]interface{}{
+				"config_count": 2,
+				"key_count":    2,
+				"keys": []string{
+					"0: sign   k9738a405e99: ed25519.PrivateKey",
+					"1: verify k9738a405e99: ed25519.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load private ecdsa key and json web key with key id",
+			config: `
+                crypto key ec1 sign from file ./../../testdata/ecdsakeys/test_1_pri.pem
+                crypto key k9738a405e99 verify from file ./../../testdata/jwks/ecdsa_test_1.jwk
+                crypto key k9738a405e99 format jwk
+            `,
+			keyPair: []int{0, 1},
+			want: map[string]interface{}{
+				"config_count": 2,
+				"key_count":    2,
+				"keys": []string{
+					"0: sign   ec1: *ecdsa.PrivateKey",
+					"1: verify ec1: *ecdsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load private rsa key and json web key set with key ids",
+			config: `
+                crypto key rsa2 sign from file ./../../testdata/rskeys/test_2_pri.pem
+                crypto key k9738a405e99 verify from file ./../../testdata/jwks/test.jwks
+                crypto key k9738a405e99 format jwk
+            `,
+			keyPair: []int{0, 1},
+			want: map[string]interface{}{
+				"config_count": 2,
+				"key_count":    3,
+				"keys": []string{
+					"0: sign   rsa2: *rsa.PrivateKey",
+					"1: verify rsa2: *rsa.PublicKey",
+					"2: verify ed1: ed25519.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load x509 certificate without certificate format",
+			config: `
+                crypto key k9738a405e99 verify from file ./../../testdata/certs/eddsa_test_1_self_signed.crt
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigFileNotSupported.WithArgs("./../../testdata/certs/eddsa_test_1_self_signed.crt"),
+		},
+		{
+			name: "load json web key set without jwk format",
+			config: `
+                crypto key k9738a405e99 verify from file ./../../testdata/jwks/test.jwks
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigFileNotSupported.WithArgs("./../../testdata/jwks/test.jwks"),
+		},
+		{
+			name: "load self-signed x509 certificate not trusted by ca bundle",
+			config: `
+                crypto key k9738a405e99 verify from file ./../../testdata/certs/eddsa_test_1_self_signed.crt
+                crypto key k9738a405e99 ca bundle ./../../testdata/certs/ca.pem
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigReadFile.WithArgs(
+				"./../../testdata/certs/eddsa_test_1_self_signed.crt",
+				errors.ErrCryptoKeyCertificateInvalid.WithArgs("k9738a405e99", "x509: certificate signed by unknown authority"),
+			),
+		},
+		{
+			name: "load rsa key encrypted with pbkdf2 and aes-256-cbc",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "foobar",
+			},
+			keyPair: []int{0, 0},
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: *rsa.PrivateKey",
+					"0: verify k9738a405e99: *rsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load ecdsa key encrypted with scrypt and aes-256-cbc",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/ecdsa_test_1_pkcs8_scrypt.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "foobar",
+			},
+			keyPair: []int{0, 0},
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: *ecdsa.PrivateKey",
+					"0: verify k9738a405e99: *ecdsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load eddsa key encrypted with pbkdf2 and aes-128-cbc",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/eddsa_test_1_pkcs8_pbkdf2.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "foobar",
+			},
+			keyPair: []int{0, 0},
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: ed25519.PrivateKey",
+					"0: verify k9738a405e99: ed25519.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load rsa key in legacy encrypted pem format",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_legacy.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "foobar",
+			},
+			keyPair: []int{0, 0},
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: *rsa.PrivateKey",
+					"0: verify k9738a405e99: *rsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load ecdsa key in legacy encrypted pem format",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/ecdsa_test_1_legacy.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "foobar",
+			},
+			keyPair: []int{0, 0},
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: *ecdsa.PrivateKey",
+					"0: verify k9738a405e99: *ecdsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load encrypted rsa key with incorrect passphrase",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "barfoo",
+			},
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigReadFile.WithArgs(
+				"./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2.pem",
+				errors.ErrCryptoKeyPassphraseIncorrect,
+			),
+		},
+		{
+			name: "load legacy encrypted rsa key with incorrect passphrase",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_legacy.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "barfoo",
+			},
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigReadFile.WithArgs(
+				"./../../testdata/encrypted/rsa_test_2_legacy.pem",
+				errors.ErrCryptoKeyPassphraseIncorrect,
+			),
+		},
+		{
+			name: "load encrypted rsa key with passphrase followed by newline",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "foobar\n",
+			},
+			keyPair: []int{0, 0},
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: *rsa.PrivateKey",
+					"0: verify k9738a405e99: *rsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load encrypted rsa key with passphrase having leading and trailing spaces",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2_spaces.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": " foo bar \n",
+			},
+			keyPair: []int{0, 0},
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: *rsa.PrivateKey",
+					"0: verify k9738a405e99: *rsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load encrypted rsa key with trimmed passphrase",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2_spaces.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			env: map[string]string{
+				"JWT_KEY_PASSPHRASE": "foo bar",
+			},
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigReadFile.WithArgs(
+				"./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2_spaces.pem",
+				errors.ErrCryptoKeyPassphraseIncorrect,
+			),
+		},
+		{
+			name: "load encrypted rsa key without passphrase",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2.pem
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigReadFile.WithArgs(
+				"./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2.pem",
+				errors.ErrCryptoKeyPassphraseNotFound,
+			),
+		},
+		{
+			name: "load encrypted rsa key with empty passphrase",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2.pem passphrase from env JWT_KEY_PASSPHRASE
+            `,
+			shouldErr: true,
+			err: errors.ErrCryptoKeyConfigReadFile.WithArgs(
+				"./../../testdata/encrypted/rsa_test_2_pkcs8_pbkdf2.pem",
+				errors.ErrCryptoKeyConfigEmptyEnvVar.WithArgs("JWT_KEY_PASSPHRASE"),
+			),
+		},
+		{
+			name: "load private and public rsa keys from file path with PS384 method",
+			config: `
+                crypto key k9738a405e99 token method PS384
+                crypto key k9738a405e99 sign from file ./../../testdata/rskeys/test_2_pri.pem
+                crypto key k9738a405e99 verify from file ./../../testdata/rskeys/test_2_pub.pem
+            `,
+			keyPair:    []int{0, 1},
+			signMethod: "PS384",
+			want: map[string]interface{}{
+				"config_count": 2,
+				"key_count":    2,
+				"keys": []string{
+					"0: sign   k9738a405e99: *rsa.PrivateKey",
+					"1: verify k9738a405e99: *rsa.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load private ecdsa key with unsupported signing method",
+			config: `
+                crypto key k9738a405e99 token method ES512
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/ecdsakeys/test_1_pri.pem
+            `,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigSignMethodUnsupported.WithArgs("k9738a405e99", "ES512"),
+		},
+		{
+			name: "load private and public eddsa keys from file path",
+			config: `
+                crypto key k9738a405e99 sign from file ./../../testdata/eddsakeys/test_1_pri.pem
+                crypto key k9738a405e99 verify from file ./../../testdata/eddsakeys/test_1_pub.pem
+            `,
+			keyPair: []int{0, 1},
+			want: map[string]interface{}{
+				"config_count": 2,
+				"key_count":    2,
+				"keys": []string{
+					"0: sign   k9738a405e99: ed25519.PrivateKey",
+					"1: verify k9738a405e99: ed25519.PublicKey",
+				},
+			},
+		},
+		{
+			name: "load private eddsa key from file path for both sign and verify",
+			config: `
+                crypto key k9738a405e99 sign-verify from file ./../../testdata/eddsakeys/test_1_pri.pem
+            `,
+			keyPair: []int{0, 0},
+			want: map[string]interface{}{
+				"config_count": 1,
+				"key_count":    1,
+				"keys": []string{
+					"0: sign   k9738a405e99: ed25519.PrivateKey",
+					"0: verify k9738a405e99: ed25519.PublicKey",
+				},
+			},
+		},
 		{
 			name: "load private ecdsa key from environment variable with file path for both sign and verify",
 			config: `
@@ -375,7 +762,7 @@ func TestGetKeysFromConfig(t *testing.T) {
 			shouldErr: true,
 			err: errors.ErrCryptoKeyConfigReadFile.WithArgs(
 				"./../../testdata/malformed/cert.pem",
-				errors.ErrNotPEMEncodedKey,
+				errors.ErrCryptoKeyPublicKeyUsage.WithArgs("sign-verify"),
 			),
 		},
 	}
@@ -385,7 +772,7 @@ func TestGetKeysFromConfig(t *testing.T) {
 			msgs = append(msgs, fmt.Sprintf("config: %s", tc.config))
 			for k, v := range tc.env {
 				if strings.HasPrefix(v, "file:") {
-					b, err := extractBytesFromFile(strings.TrimPrefix(v, "file:"))
+					b, err := extractBytesFromFile(strings.TrimPrefix(v, "file:"), keyFileExtensions)
 					if err != nil {
 						t.Fatal(err)
 					}
@@ -464,6 +851,10 @@ func TestGetKeysFromConfig(t *testing.T) {
 				t.Logf("%v", usr)
 			}
 
+			if tc.signMethod != "" {
+				tests.EvalObjectsWithLog(t, "sign method", tc.signMethod, privKey.Sign.Token.DefaultMethod, msgs)
+			}
+
 			if err := ks.SignToken(privKey.Sign.Token.Name, privKey.Sign.Token.DefaultMethod, usr); err != nil {
 				t.Fatal(err)
 			}
@@ -558,3 +949,207 @@ func TestGetKeysFromCryptoKeyConfigs(t *testing.T) {
 		})
 	}
 }
+
+func newTestUnsignedToken(alg string, secret []byte) string {
+	h := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT"}`))
+	b, _ := json.Marshal(newTestUser().AsMap())
+	s := h + "." + base64.RawURLEncoding.EncodeToString(b)
+	if secret == nil {
+		return s + "."
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s))
+	return s + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestCryptoKeyVerifyMethods(t *testing.T) {
+	signKey := newTestSignKey(t, "k1", "./../../testdata/rskeys/test_2_pri.pem")
+	pubKeyBytes, err := ioutil.ReadFile("./../../testdata/rskeys/test_2_pub.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testcases = []struct {
+		name       string
+		signMethod string
+		token      string
+		config     string
+		shouldErr  bool
+		err        error
+	}{
+		{
+			name:       "verify PS256 token with key supporting all rsa methods",
+			signMethod: "PS256",
+			config:     `crypto key k1 verify from file ./../../testdata/rskeys/test_2_pub.pem`,
+		},
+		{
+			name:       "verify PS256 token with key restricted to PS256",
+			signMethod: "PS256",
+			config: `
+			  crypto key k1 token accept PS256
+			  crypto key k1 verify from file ./../../testdata/rskeys/test_2_pub.pem
+			`,
+		},
+		{
+			name:       "verify PS256 token with key restricted to RS256",
+			signMethod: "PS256",
+			config: `
+			  crypto key k1 token accept RS256
+			  crypto key k1 verify from file ./../../testdata/rskeys/test_2_pub.pem
+			`,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs("PS256"),
+		},
+		{
+			name:       "verify RS256 token with keys restricted to PS256 and ES256",
+			signMethod: "RS256",
+			config: `
+			  crypto key k1 token accept PS256 PS384
+			  crypto key k1 verify from file ./../../testdata/rskeys/test_2_pub.pem
+			  crypto key k2 verify from file ./../../testdata/ecdsakeys/test_2_pub.pem
+			`,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs("RS256"),
+		},
+		{
+			name:      "verify unsigned token with none algorithm",
+			token:     newTestUnsignedToken("none", nil),
+			config:    `crypto key k1 verify from file ./../../testdata/rskeys/test_2_pub.pem`,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs("none"),
+		},
+		{
+			name:      "verify HS256 token signed with rsa public key",
+			token:     newTestUnsignedToken("HS256", pubKeyBytes),
+			config:    `crypto key k1 verify from file ./../../testdata/rskeys/test_2_pub.pem`,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs("HS256"),
+		},
+		{
+			name:       "verify token with shared key and rsa key rejecting the algorithm",
+			signMethod: "RS256",
+			config: `
+			  crypto key k1 token accept PS256
+			  crypto key k1 verify from file ./../../testdata/rskeys/test_2_pub.pem
+			  crypto key k2 verify foobar
+			`,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs("RS256"),
+		},
+		{
+			name:       "verify token with rsa key accepting ecdsa method",
+			signMethod: "RS256",
+			config: `
+			  crypto key k1 token accept ES256
+			  crypto key k1 verify from file ./../../testdata/rskeys/test_2_pub.pem
+			`,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyConfigVerifyMethodUnsupported.WithArgs("k1", "ES256"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			configs, err := ParseCryptoKeyConfigs(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ks := NewCryptoKeyStore()
+			err = ks.AddKeysWithConfigs(configs)
+			if err != nil {
+				tests.EvalErrWithLog(t, err, "keys", tc.shouldErr, tc.err, msgs)
+				return
+			}
+			token := tc.token
+			if token == "" {
+				usr := newTestUser()
+				if err := signKey.SignToken(tc.signMethod, usr); err != nil {
+					t.Fatal(err)
+				}
+				token = usr.Token
+			}
+			msgs = append(msgs, fmt.Sprintf("token: %s", token))
+			_, err = ks.ParseToken("access_token", token)
+			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+		})
+	}
+}
+
+func TestExtractPublicKeyFromCertificates(t *testing.T) {
+	var testcases = []struct {
+		name      string
+		file      string
+		caBundle  string
+		want      string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "certificate without ca bundle",
+			file: "./../../testdata/certs/rsa_test_2_expired.crt",
+			want: "*rsa.PublicKey",
+		},
+		{
+			name:     "certificate trusted by ca bundle",
+			file:     "./../../testdata/certs/rsa_test_2.crt",
+			caBundle: "./../../testdata/certs/ca.pem",
+			want:     "*rsa.PublicKey",
+		},
+		{
+			name:     "certificate chain trusted by ca bundle",
+			file:     "./../../testdata/certs/ecdsa_test_1_chain.crt",
+			caBundle: "./../../testdata/certs/ca.pem",
+			want:     "*ecdsa.PublicKey",
+		},
+		{
+			name:      "expired certificate",
+			file:      "./../../testdata/certs/rsa_test_2_expired.crt",
+			caBundle:  "./../../testdata/certs/ca.pem",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyCertificateInvalid,
+		},
+		{
+			name:      "certificate not trusted by ca bundle",
+			file:      "./../../testdata/certs/eddsa_test_1_self_signed.crt",
+			caBundle:  "./../../testdata/certs/ca.pem",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyCertificateInvalid,
+		},
+		{
+			name:      "ca bundle without certificates",
+			file:      "./../../testdata/certs/rsa_test_2.crt",
+			caBundle:  "./../../testdata/rskeys/test_2_pub.pem",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyCABundleInvalid,
+		},
+		{
+			name:      "private key instead of certificate",
+			file:      "./../../testdata/rskeys/test_2_pri.pem",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyCertificateNotFound,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			b, err := ioutil.ReadFile(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &CryptoKeyConfig{ID: "k1", Usage: "verify", CABundlePath: tc.caBundle}
+			pubKey, err := extractPublicKeyFromCertificates(b, cfg)
+			if tc.shouldErr {
+				if !stderrors.Is(err, tc.err) {
+					tests.WriteLog(t, msgs)
+					t.Fatalf("unexpected error: %v, expected: %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tests.EvalObjectsWithLog(t, "public key", tc.want, fmt.Sprintf("%T", pubKey), msgs)
+		})
+	}
+}
@@ -15,24 +15,55 @@
 package kms
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	stderrors "errors"
+	"fmt"
 	jwtlib "github.com/golang-jwt/jwt/v4"
 	"github.com/greenpau/caddy-authorize/pkg/errors"
 	"github.com/greenpau/caddy-authorize/pkg/shared"
 	"github.com/greenpau/caddy-authorize/pkg/user"
 	"go.uber.org/zap"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// keyExpiryWarningPeriod is the period before the retirement of a key
+	// during which the warnings about the upcoming retirement are logged.
+	keyExpiryWarningPeriod = 7 * 24 * time.Hour
+	// keyExpiryWarningInterval limits how often the warning is logged.
+	keyExpiryWarningInterval = time.Hour
 )
 
 var (
+	// autoGenerateAlgorithms holds the parameters of the key generation
+	// per supported algorithm.
+	autoGenerateAlgorithms = map[string]struct {
+		curve elliptic.Curve
+		bits  int
+	}{
+		"ES256": {curve: elliptic.P256()},
+		"ES384": {curve: elliptic.P384()},
+		"ES512": {curve: elliptic.P521()},
+		"RS256": {bits: 2048},
+		"RS384": {bits: 3072},
+		"RS512": {bits: 4096},
+		"EdDSA": {},
+	}
 	reservedTokenNames = map[string]bool{
 		"access_token":     true,
 		"jwt_access_token": true,
 		"bearer":           true,
+		"dpop":             true,
 	}
 )
 
@@ -42,20 +73,80 @@ type CryptoKeyStore struct {
 	keys       []*CryptoKey
 	signKeys   []*CryptoKey
 	verifyKeys []*CryptoKey
-	logger     *zap.Logger
-	defaults   map[string]interface{}
+	// verifyKeysByID indexes the keys with key verification capabilities
+	// by key id. The keys without key id are not indexed.
+	verifyKeysByID map[string][]*CryptoKey
+	// verifyKeysByName indexes the keys with key verification capabilities
+	// by token name.
+	verifyKeysByName map[string][]*CryptoKey
+	// requireKeyID indicates whether the tokens without key id are rejected.
+	requireKeyID bool
+	// leeway is the tolerated clock skew when validating the time claims
+	// of the tokens.
+	leeway time.Duration
+	// decryptKeys are the keys decrypting encrypted tokens.
+	decryptKeys []*CryptoKey
+	// usesRequest indicates whether the selection of the verification keys
+	// depends on the request, see CryptoKeyConfig.EvalExpr.
+	usesRequest bool
+	logger      *zap.Logger
+	defaults    map[string]interface{}
+	// expiryWarnings holds the time of the last warning about the upcoming
+	// retirement of a key.
+	expiryWarnings map[*CryptoKey]time.Time
+	mu             sync.Mutex
+	// storage persists the auto-generated keys.
+	storage CryptoKeyStorage
 }
 
 // NewCryptoKeyStore returns a new instance of CryptoKeyStore
 func NewCryptoKeyStore() *CryptoKeyStore {
 	ks := &CryptoKeyStore{}
 	ks.defaults = make(map[string]interface{})
+	ks.verifyKeysByID = make(map[string][]*CryptoKey)
+	ks.verifyKeysByName = make(map[string][]*CryptoKey)
+	ks.expiryWarnings = make(map[*CryptoKey]time.Time)
 	return ks
 }
 
-// SetLogger adds a logger to CryptoKeyStore.
+// SetRequireKeyID enables or disables the rejection of the tokens without
+// key id, i.e. "kid" header.
+func (ks *CryptoKeyStore) SetRequireKeyID(b bool) {
+	ks.requireKeyID = b
+}
+
+// SetLeeway sets the tolerated clock skew when validating "exp", "nbf",
+// and "iat" claims of the tokens.
+func (ks *CryptoKeyStore) SetLeeway(d time.Duration) {
+	ks.leeway = d
+}
+
+// SetLogger adds a logger to CryptoKeyStore. The logger is also used
+// to log the rotation of the keys loaded from watched files.
 func (ks *CryptoKeyStore) SetLogger(logger *zap.Logger) {
 	ks.logger = logger
+	for _, k := range ks.keys {
+		if k.watch != nil {
+			k.watch.setLogger(logger)
+		}
+		if k.jwks != nil {
+			k.jwks.setLogger(logger)
+		}
+	}
+}
+
+// Close stops the background refresh of the keys fetched from remote JSON
+// Web Key Sets and of the keys loaded from watched files. The refresh starts
+// when the keys are added to CryptoKeyStore.
+func (ks *CryptoKeyStore) Close() {
+	for _, k := range ks.keys {
+		if k.watch != nil {
+			k.watch.stop()
+		}
+		if k.jwks != nil {
+			k.jwks.stop()
+		}
+	}
 }
 
 // AddDefaults adds default settings to CryptoKeyStore.
@@ -79,18 +170,25 @@ func (ks *CryptoKeyStore) AddDefaults(m map[string]interface{}) error {
 	return nil
 }
 
+// SetStorage sets the storage where the auto-generated keys are persisted.
+func (ks *CryptoKeyStore) SetStorage(s CryptoKeyStorage) {
+	ks.storage = s
+}
+
 // AutoGenerate auto-generates public-private key pair capable of both
-// signing and verifying tokens.
+// signing and verifying tokens. The supported algorithms are ES256, ES384,
+// ES512, RS256, RS384, RS512 and EdDSA. When the storage is set, the key
+// is loaded from the storage, if present, and otherwise the generated key
+// is written to the storage.
 func (ks *CryptoKeyStore) AutoGenerate(tag, algo string) error {
-	var generated bool
-	var kb string
 	cfg := &CryptoKeyConfig{
-		ID:            "0",
-		Usage:         "sign-verify",
-		TokenName:     "access_token",
-		Source:        "config",
-		TokenLifetime: 900,
-		parsed:        true,
+		ID:                  "0",
+		Usage:               "sign-verify",
+		TokenName:           "access_token",
+		Source:              "config",
+		TokenLifetime:       900,
+		PreferredSignMethod: algo,
+		parsed:              true,
 	}
 
 	if ks.defaults != nil {
@@ -106,49 +204,28 @@ func (ks *CryptoKeyStore) AutoGenerate(tag, algo string) error {
 		return errors.ErrCryptoKeyStoreAutoGenerateNotAvailable
 	}
 
-	for i := 1; i < 5; i++ {
-		switch algo {
-		case "ES512":
-			c := elliptic.P521()
-			priv, err := ecdsa.GenerateKey(c, rand.Reader)
-			if err != nil {
-				break
-			}
-			if !c.IsOnCurve(priv.PublicKey.X, priv.PublicKey.Y) {
-				break
-			}
-			derBytes, err := x509.MarshalECPrivateKey(priv)
-			if err != nil {
-				break
-			}
-			pemBytes := pem.EncodeToMemory(
-				&pem.Block{
-					Type:  "EC PRIVATE KEY",
-					Bytes: derBytes,
-				},
-			)
-			if pemBytes == nil {
-				break
-			}
-			kb = string(pemBytes)
-			generated = true
-		default:
-			return errors.ErrCryptoKeyStoreAutoGenerateAlgo.WithArgs(algo)
-		}
+	if _, exists := autoGenerateAlgorithms[algo]; !exists {
+		return errors.ErrCryptoKeyStoreAutoGenerateAlgo.WithArgs(algo)
 	}
 
-	if !generated {
-		return errors.ErrCryptoKeyStoreAutoGenerateFailed.WithArgs("failed")
-	}
-
-	if err := shared.Buffer.Add(tag, kb); err != nil {
-		if err.Error() != "not empty" {
-			return errors.ErrCryptoKeyStoreAutoGenerateFailed.WithArgs(err)
-		}
-		kb, err = shared.Buffer.Get(tag)
+	// The key pair is shared across the instances with the same tag and
+	// algorithm, e.g. after a config reload.
+	bufferKey := tag + "/" + algo
+	kb, err := shared.Buffer.Get(bufferKey)
+	if err != nil {
+		kb, err = ks.loadOrGenerateKey(tag, algo)
 		if err != nil {
 			return errors.ErrCryptoKeyStoreAutoGenerateFailed.WithArgs(err)
 		}
+		if err := shared.Buffer.Add(bufferKey, kb); err != nil {
+			if err.Error() != "not empty" {
+				return errors.ErrCryptoKeyStoreAutoGenerateFailed.WithArgs(err)
+			}
+			kb, err = shared.Buffer.Get(bufferKey)
+			if err != nil {
+				return errors.ErrCryptoKeyStoreAutoGenerateFailed.WithArgs(err)
+			}
+		}
 	}
 	key, err := extractKey([]byte(kb), cfg)
 	if err != nil {
@@ -156,12 +233,90 @@ func (ks *CryptoKeyStore) AutoGenerate(tag, algo string) error {
 	}
 
 	key.enableUsage()
+	if key.Sign.Token.DefaultMethod != algo {
+		return errors.ErrCryptoKeyStoreAutoGenerateFailed.WithArgs(
+			fmt.Sprintf("stored key does not support %q algorithm", algo),
+		)
+	}
 	ks.keys = append(ks.keys, key)
 	ks.signKeys = append(ks.signKeys, key)
-	ks.verifyKeys = append(ks.verifyKeys, key)
+	ks.addVerifyKey(key)
 	return nil
 }
 
+// loadOrGenerateKey returns PEM-encoded private key from the storage. When
+// the storage is not set or it does not have the key, a new key is generated
+// and written to the storage.
+func (ks *CryptoKeyStore) loadOrGenerateKey(tag, algo string) (string, error) {
+	if ks.storage == nil {
+		return generateKey(algo)
+	}
+	storageKey := "authorize/keys/" + tag + "/" + strings.ToLower(algo) + ".pem"
+	if l, ok := ks.storage.(cryptoKeyStorageLocker); ok {
+		if err := l.Lock(context.Background(), storageKey); err != nil {
+			return "", err
+		}
+		defer l.Unlock(storageKey)
+	}
+	if ks.storage.Exists(storageKey) {
+		b, err := ks.storage.Load(storageKey)
+		if err != nil {
+			return "", err
+		}
+		if ks.logger != nil {
+			ks.logger.Debug("loaded auto-generated crypto key from storage", zap.String("algorithm", algo))
+		}
+		return string(b), nil
+	}
+	kb, err := generateKey(algo)
+	if err != nil {
+		return "", err
+	}
+	if err := ks.storage.Store(storageKey, []byte(kb)); err != nil {
+		return "", err
+	}
+	if ks.logger != nil {
+		ks.logger.Info("stored auto-generated crypto key", zap.String("algorithm", algo))
+	}
+	return kb, nil
+}
+
+// generateKey returns PEM-encoded private key for the provided algorithm.
+func generateKey(algo string) (string, error) {
+	var block *pem.Block
+	switch algo {
+	case "ES256", "ES384", "ES512":
+		priv, err := ecdsa.GenerateKey(autoGenerateAlgorithms[algo].curve, rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		derBytes, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: derBytes}
+	case "RS256", "RS384", "RS512":
+		priv, err := rsa.GenerateKey(rand.Reader, autoGenerateAlgorithms[algo].bits)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+	case "EdDSA":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		derBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: derBytes}
+	default:
+		return "", errors.ErrCryptoKeyStoreAutoGenerateAlgo.WithArgs(algo)
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
 // GetKeys returns CryptoKey instances from CryptoKeyStore.
 func (ks *CryptoKeyStore) GetKeys() []*CryptoKey {
 	return ks.keys
@@ -173,12 +328,38 @@ func (ks *CryptoKeyStore) GetSignKeys() []*CryptoKey {
 	return ks.signKeys
 }
 
+// GetDecryptKeys returns CryptoKey instances with token decryption capabilities.
+func (ks *CryptoKeyStore) GetDecryptKeys() []*CryptoKey {
+	return ks.decryptKeys
+}
+
 // GetVerifyKeys returns CryptoKey instances with key verification capabilities
 // from CryptoKeyStore.
 func (ks *CryptoKeyStore) GetVerifyKeys() []*CryptoKey {
 	return ks.verifyKeys
 }
 
+// GetJSONWebKeySet returns the public keys with key verification capabilities
+// from CryptoKeyStore as JSON Web Key Set. The shared secrets and the keys
+// fetched from remote key sets are not included. The keys loaded from
+// watched files include the rotated keys within their grace period.
+// The retired keys, i.e. past their "not after" time, are not included.
+func (ks *CryptoKeyStore) GetJSONWebKeySet() *JSONWebKeySet {
+	jwks := &JSONWebKeySet{Keys: []*JSONWebKey{}}
+	now := time.Now()
+	for _, k := range expandVerifyKeys(ks.verifyKeys, "") {
+		if k.jwks != nil || k.isExpired(now) {
+			continue
+		}
+		jwk, err := NewJSONWebKey(k)
+		if err != nil {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
 // AddKeysWithConfigs adds CryptoKey instances by providing their
 // configurations to CryptoKeyStore.
 func (ks *CryptoKeyStore) AddKeysWithConfigs(cfgs []*CryptoKeyConfig) error {
@@ -234,37 +415,164 @@ func (ks *CryptoKeyStore) AddKey(k *CryptoKey) error {
 	}
 	if k.Verify != nil {
 		if k.Verify.Capable {
-			ks.verifyKeys = append(ks.verifyKeys, k)
+			ks.addVerifyKey(k)
+		}
+	}
+	if k.Decrypt != nil {
+		if k.Decrypt.Capable {
+			ks.decryptKeys = append(ks.decryptKeys, k)
 		}
 	}
 	if k.Verify == nil && k.Sign == nil {
 		return errors.ErrCryptoKeyStoreAddKeyNil
 	}
+	if k.watch != nil {
+		if ks.logger != nil {
+			k.watch.setLogger(ks.logger)
+		}
+		k.watch.start()
+	}
+	if k.jwks != nil {
+		if ks.logger != nil {
+			k.jwks.setLogger(ks.logger)
+		}
+		k.jwks.start()
+	}
 	ks.keys = append(ks.keys, k)
+	ks.warnKeyExpiry(k, time.Now())
 	return nil
 }
 
-// ParseToken parses JWT token and returns User instance.
-func (ks *CryptoKeyStore) ParseToken(tokenName, token string) (*user.User, error) {
-	var usr *user.User
-	for _, k := range ks.verifyKeys {
-		if _, exists := reservedTokenNames[tokenName]; !exists {
-			if tokenName != k.Verify.Token.Name {
+func (ks *CryptoKeyStore) addVerifyKey(k *CryptoKey) {
+	ks.verifyKeys = append(ks.verifyKeys, k)
+	if k.usesRequest() {
+		ks.usesRequest = true
+	}
+	ks.verifyKeysByName[k.Verify.Token.Name] = append(ks.verifyKeysByName[k.Verify.Token.Name], k)
+	if k.hasKeyID() {
+		ks.verifyKeysByID[k.Verify.Token.ID] = append(ks.verifyKeysByID[k.Verify.Token.ID], k)
+	}
+}
+
+// isIssuerMismatch returns true when the token verified by the key of the
+// provider discovered via OpenID Connect is not issued by the provider. The
+// tokens verified by other keys are not affected.
+func (ks *CryptoKeyStore) isIssuerMismatch(k *CryptoKey, issuer string) bool {
+	return k.Verify.Token.Issuer != "" && issuer != k.Verify.Token.Issuer
+}
+
+// getVerifyKeys returns the keys eligible for the verification of a token
+// with the provided name and key id. When the key id matches indexed keys,
+// only these keys are returned. When it does not, only the keys without key
+// id, including remote and watched key sets, are returned, i.e. the keys with
+// another key id are never tried. When the token has no key id, all the keys
+// are returned. The tokens without key id are rejected before the lookup when
+// the key id is required, see SetRequireKeyID.
+func (ks *CryptoKeyStore) getVerifyKeys(tokenName, kid string) []*CryptoKey {
+	keys := ks.verifyKeys
+	if _, exists := reservedTokenNames[tokenName]; !exists {
+		keys = ks.verifyKeysByName[tokenName]
+	}
+	if kid == "" {
+		return keys
+	}
+	var arr []*CryptoKey
+	if indexedKeys, exists := ks.verifyKeysByID[kid]; exists {
+		for _, k := range indexedKeys {
+			if _, exists := reservedTokenNames[tokenName]; !exists && tokenName != k.Verify.Token.Name {
 				continue
 			}
+			arr = append(arr, k)
+		}
+		if len(arr) > 0 {
+			return arr
+		}
+	}
+	for _, k := range keys {
+		if !k.hasKeyID() {
+			arr = append(arr, k)
+		}
+	}
+	return arr
+}
+
+// expandVerifyKeys replaces the keys loaded from watched files with their
+// current keys and the rotated keys within their grace period.
+func expandVerifyKeys(keys []*CryptoKey, kid string) []*CryptoKey {
+	var arr []*CryptoKey
+	for _, k := range keys {
+		if k.watch == nil {
+			arr = append(arr, k)
+			continue
 		}
-		parsedToken, err := jwtlib.Parse(token, k.ProvideKey)
+		arr = append(arr, k.watch.getVerifyKeys(kid)...)
+	}
+	return arr
+}
+
+// UsesRequest returns true when the selection of the verification keys
+// depends on the request, i.e. the tokens must be parsed with
+// ParseTokenWithRequest for every request.
+func (ks *CryptoKeyStore) UsesRequest() bool {
+	return ks.usesRequest
+}
+
+// ParseToken parses JWT token and returns User instance. When the token has
+// key id, i.e. "kid" header, the token is verified with the key having the
+// key id, see getVerifyKeys. When none of the keys accepts the signing
+// algorithm of the token, e.g. "none" or HS256 with an RSA public key, the
+// ErrCryptoKeyStoreAlgorithmNotAllowed error is returned. When the token is
+// verified only by retired keys, the ErrCryptoKeyStoreTokenKeyExpired error
+// is returned.
+func (ks *CryptoKeyStore) ParseToken(tokenName, token string) (*user.User, error) {
+	return ks.ParseTokenWithRequest(nil, tokenName, token)
+}
+
+// ParseTokenWithRequest parses JWT token, see ParseToken. The keys with the
+// selection expressions, see CryptoKeyConfig.EvalExpr, are used only when
+// the expressions match the request and the unverified claims of the token.
+// The encrypted tokens, i.e. JWE with nested JWT, are decrypted prior to the
+// verification of the signature of the nested token. The PASETO v4 tokens,
+// i.e. the tokens with "v4." prefix, are verified by Ed25519 keys, when
+// public, or by 32 byte shared keys with paseto token type, when local. The
+// keys with paseto token type are not used with JWT tokens.
+func (ks *CryptoKeyStore) ParseTokenWithRequest(r *http.Request, tokenName, token string) (*user.User, error) {
+	if isPasetoToken(token) {
+		return ks.parsePasetoToken(r, tokenName, token)
+	}
+	if isEncryptedToken(token) {
+		nestedToken, err := ks.decryptToken(token)
 		if err != nil {
-			if strings.Contains(err.Error(), "is expired") {
-				usr = &user.User{}
-				for k, v := range parsedToken.Claims.(jwtlib.MapClaims) {
-					switch k {
-					case "iss":
-						usr.Authenticator.URL = v.(string)
-					case "mail", "email":
-						usr.Authenticator.LoginHint = v.(string)
-					}
-				}
+			return nil, err
+		}
+		token = nestedToken
+	}
+	var expiredUsr *user.User
+	var expiredKey *CryptoKey
+	var attempts, algRejects int
+	var alg interface{}
+	var kid string
+	in := &evalInput{request: r}
+	// The time claims are validated after the verification of the signature,
+	// because the parser does not support leeway.
+	parser := &jwtlib.Parser{SkipClaimsValidation: true}
+	if unverifiedToken, _, err := new(jwtlib.Parser).ParseUnverified(token, jwtlib.MapClaims{}); err == nil {
+		kid, _ = unverifiedToken.Header["kid"].(string)
+		in.claims = unverifiedToken.Claims.(jwtlib.MapClaims)
+	}
+	if kid == "" && ks.requireKeyID {
+		return nil, errors.ErrCryptoKeyStoreTokenKeyIDNotFound
+	}
+	for _, k := range expandVerifyKeys(ks.getVerifyKeys(tokenName, kid), kid) {
+		if k.isPasetoKey() || !k.matchEvalExpr(in) {
+			continue
+		}
+		attempts++
+		parsedToken, err := parser.Parse(token, k.ProvideKey)
+		if err != nil {
+			if ve, ok := err.(*jwtlib.ValidationError); ok && stderrors.Is(ve.Inner, errors.ErrCryptoKeyAlgorithmNotAllowed) {
+				algRejects++
+				alg = parsedToken.Header["alg"]
 			}
 			continue
 		}
@@ -276,42 +584,124 @@ func (ks *CryptoKeyStore) ParseToken(tokenName, token string) (*user.User, error
 		if err != nil {
 			continue
 		}
+		if ks.isIssuerMismatch(k, usr.Claims.Issuer) {
+			continue
+		}
+		now := time.Now()
+		if err := usr.Claims.ValidAt(now, ks.leeway); err != nil {
+			if err == errors.ErrExpiredToken {
+				expiredUsr = &user.User{}
+				expiredUsr.Authenticator.URL = usr.Claims.Issuer
+				expiredUsr.Authenticator.LoginHint = usr.Claims.Email
+			}
+			continue
+		}
+		ks.warnKeyExpiry(k, now)
+		if k.isExpired(now) {
+			expiredKey = k
+			continue
+		}
 		return usr, nil
 	}
-	if usr != nil {
-		return usr, errors.ErrCryptoKeyStoreParseTokenFailed
+	if expiredKey != nil {
+		return nil, errors.ErrCryptoKeyStoreTokenKeyExpired.WithArgs(
+			expiredKey.Verify.Token.ID, expiredKey.Config.NotAfter.Format(time.RFC3339),
+		)
+	}
+	if expiredUsr != nil {
+		return expiredUsr, errors.ErrCryptoKeyStoreParseTokenFailed
+	}
+	if attempts > 0 && attempts == algRejects {
+		return nil, errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs(alg)
 	}
 	return nil, errors.ErrCryptoKeyStoreParseTokenFailed
 }
 
 // SignToken signs user claims and add signed token to user identity.
+// The token is signed by the active key, see getSignKey.
 func (ks *CryptoKeyStore) SignToken(tokenName, signMethod interface{}, usr *user.User) error {
-	for _, k := range ks.signKeys {
-		if tokenName != nil {
-			if tokenName.(string) != k.Sign.Token.Name {
-				continue
-			}
-		}
-		response, err := k.sign(signMethod, usr.AsMap())
-		if err != nil {
-			return err
-		}
-		usr.Token = response.(string)
-		usr.TokenName = k.Sign.Token.Name
-		return nil
+	now := time.Now()
+	k, err := ks.getSignKey(tokenName, now)
+	if err != nil {
+		return err
+	}
+	ks.warnKeyExpiry(k, now)
+	response, err := k.sign(signMethod, usr.AsMap())
+	if err != nil {
+		return err
 	}
-	return errors.ErrCryptoKeyStoreSignTokenFailed
+	usr.Token = response.(string)
+	usr.TokenName = k.Sign.Token.Name
+	return nil
 }
 
 // GetTokenLifetime returns lifetime for a signed token.
 func (ks *CryptoKeyStore) GetTokenLifetime(tokenName, signMethod interface{}) int {
+	k, err := ks.getSignKey(tokenName, time.Now())
+	if err != nil {
+		return 900
+	}
+	return k.Sign.Token.MaxLifetime
+}
+
+// getSignKey returns the key with key signing capabilities for the tokens
+// with the provided name. The keys outside of their validity window at the
+// provided time are skipped. When multiple keys are active, the key with
+// the latest "not before" time is returned, i.e. a pre-staged key takes
+// over once it becomes active.
+func (ks *CryptoKeyStore) getSignKey(tokenName interface{}, now time.Time) (*CryptoKey, error) {
+	var found bool
+	var signKey *CryptoKey
 	for _, k := range ks.signKeys {
 		if tokenName != nil {
 			if tokenName.(string) != k.Sign.Token.Name {
 				continue
 			}
 		}
-		return k.Sign.Token.MaxLifetime
+		found = true
+		if !k.isActive(now) {
+			continue
+		}
+		if signKey == nil || k.getNotBefore().After(signKey.getNotBefore()) {
+			signKey = k
+		}
+	}
+	if !found {
+		return nil, errors.ErrCryptoKeyStoreSignTokenFailed
+	}
+	if signKey == nil {
+		return nil, errors.ErrCryptoKeyStoreNoActiveSignKeyFound.WithArgs(now.Format(time.RFC3339))
+	}
+	return signKey, nil
+}
+
+// warnKeyExpiry logs a warning when the retirement of the key, i.e. its
+// "not after" time, is approaching. The warning is logged at most once per
+// keyExpiryWarningInterval for each key.
+func (ks *CryptoKeyStore) warnKeyExpiry(k *CryptoKey, now time.Time) {
+	if ks.logger == nil || k.Config == nil || k.Config.NotAfter.IsZero() {
+		return
+	}
+	remaining := k.Config.NotAfter.Sub(now)
+	if remaining > keyExpiryWarningPeriod {
+		return
+	}
+	ks.mu.Lock()
+	if warnedAt, exists := ks.expiryWarnings[k]; exists && now.Sub(warnedAt) < keyExpiryWarningInterval {
+		ks.mu.Unlock()
+		return
+	}
+	ks.expiryWarnings[k] = now
+	ks.mu.Unlock()
+
+	msg := "crypto key retirement is approaching"
+	if remaining <= 0 {
+		msg = "crypto key is retired"
 	}
-	return 900
+	ks.logger.Warn(
+		msg,
+		zap.String("key_id", k.Config.ID),
+		zap.Time("not_after", k.Config.NotAfter),
+		zap.Duration("remaining", remaining),
+	)
 }
@@ -15,11 +15,18 @@
 package kms
 
 import (
+	"encoding/json"
 	"fmt"
 	jwtlib "github.com/golang-jwt/jwt/v4"
 	"github.com/greenpau/caddy-authorize/internal/tests"
 	"github.com/greenpau/caddy-authorize/pkg/errors"
 	"github.com/greenpau/caddy-authorize/pkg/user"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -303,6 +310,33 @@ func TestCryptoKeyStoreAutoGenerate(t *testing.T) {
 			// shouldErr: true,
 			//err:       fmt.Errorf(`kms: file "foo" is not supported due to extension type`),
 		},
+		{
+			name:      "generate eddsa key pair",
+			tag:       "default",
+			algorithm: "EdDSA",
+		},
+		{
+			name:      "generate es256 key pair",
+			tag:       "default",
+			algorithm: "ES256",
+		},
+		{
+			name:      "generate es384 key pair",
+			tag:       "default",
+			algorithm: "ES384",
+		},
+		{
+			name:      "generate rs256 key pair",
+			tag:       "default",
+			algorithm: "RS256",
+		},
+		{
+			name:      "generate key pair with unsupported algorithm",
+			tag:       "default",
+			algorithm: "HS256",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreAutoGenerateAlgo.WithArgs("HS256"),
+		},
 	}
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -313,6 +347,636 @@ func TestCryptoKeyStoreAutoGenerate(t *testing.T) {
 			if tests.EvalErrWithLog(t, err, nil, tc.shouldErr, tc.err, msgs) {
 				return
 			}
+			got := ks.GetKeys()[0].Sign.Token.DefaultMethod
+			if got != tc.algorithm {
+				t.Fatalf("unexpected signing method: got %s, want %s", got, tc.algorithm)
+			}
+		})
+	}
+}
+
+func TestCryptoKeyStoreAutoGenerateWithStorage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kms-autogenerate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fp := filepath.Join(tmpDir, "keys", "default.pem")
+
+	// The tags are unique, because the generated keys are also shared via
+	// the in-memory buffer.
+	ks := NewCryptoKeyStore()
+	ks.SetStorage(NewFileCryptoKeyStorage(fp))
+	if err := ks.AutoGenerate("storage-test-1", "ES384"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fi, err := os.Stat(fp)
+	if err != nil {
+		t.Fatalf("expected the key to be stored: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected key file permissions: %v", fi.Mode().Perm())
+	}
+
+	// Simulate the restart, i.e. the key is not in the buffer.
+	restarted := NewCryptoKeyStore()
+	restarted.SetStorage(NewFileCryptoKeyStorage(fp))
+	if err := restarted.AutoGenerate("storage-test-2", "ES384"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	usr := newTestUser()
+	if err := ks.SignToken(nil, nil, usr); err != nil {
+		t.Fatalf("failed signing token: %v", err)
+	}
+	if _, err := restarted.ParseToken("access_token", usr.Token); err != nil {
+		t.Fatalf("expected the token to be verified after the restart: %v", err)
+	}
+
+	// The stored key does not match the configured algorithm.
+	mismatched := NewCryptoKeyStore()
+	mismatched.SetStorage(NewFileCryptoKeyStorage(fp))
+	err = mismatched.AutoGenerate("storage-test-3", "EdDSA")
+	expErr := errors.ErrCryptoKeyStoreAutoGenerateFailed.WithArgs(`stored key does not support "EdDSA" algorithm`)
+	tests.EvalErrWithLog(t, err, nil, true, expErr, []string{"test name: stored key algorithm mismatch"})
+}
+
+func TestCryptoKeyStoreGetJSONWebKeySet(t *testing.T) {
+	var testcases = []struct {
+		name      string
+		config    string
+		generate  string
+		want      []string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "rsa and ecdsa keys with shared secret",
+			config: `
+				crypto key k1 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+				crypto key k2 verify from file ./../../testdata/ecdsakeys/test_2_pub.pem
+				crypto key k3 verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+			`,
+			want: []string{"k1: RSA RS512 sig", "k2: EC ES256 sig"},
+		},
+		{
+			name:     "auto-generated es512 key",
+			generate: "ES512",
+			want:     []string{"0: EC ES512 sig"},
+		},
+		{
+			name:     "auto-generated eddsa key",
+			generate: "EdDSA",
+			want:     []string{"0: OKP EdDSA sig"},
+		},
+		{
+			name:   "shared secret only",
+			config: `crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286`,
+			want:   []string{},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			ks := NewCryptoKeyStore()
+			if tc.generate != "" {
+				if err := ks.AutoGenerate("default", tc.generate); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				configs, err := ParseCryptoKeyConfigs(tc.config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ks.AddKeysWithConfigs(configs); err != nil {
+					t.Fatal(err)
+				}
+			}
+			jwks := ks.GetJSONWebKeySet()
+			got := []string{}
+			for _, jwk := range jwks.Keys {
+				got = append(got, fmt.Sprintf("%s: %s %s %s", jwk.KeyID, jwk.KeyType, jwk.Algorithm, jwk.Use))
+			}
+			tests.EvalObjectsWithLog(t, "keys", tc.want, got, msgs)
+			if len(jwks.Keys) == 0 {
+				return
+			}
+
+			// The published keys must verify the tokens signed by the keystore.
+			b, err := json.Marshal(jwks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := getKeysFromJSONWebKeySet(b, &CryptoKeyConfig{Usage: "verify", TokenName: "access_token", TokenLifetime: 900})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rks := NewCryptoKeyStore()
+			if err := rks.AddKeys(keys); err != nil {
+				t.Fatal(err)
+			}
+			usr := newTestUser()
+			err = ks.SignToken(nil, nil, usr)
+			if tests.EvalErrWithLog(t, err, "sign token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			_, err = rks.ParseToken("access_token", usr.Token)
+			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+		})
+	}
+}
+
+func TestCryptoKeyStoreEvalExpr(t *testing.T) {
+	config := `
+		crypto key tenant1 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+		crypto key tenant1 token eval request.host == app1.example.com
+		crypto key tenant2 sign-verify from file ./../../testdata/ecdsakeys/test_1_pri.pem
+		crypto key tenant2 token eval "request.host == app2.example.com and claims.iss =~ '^https://app2\.'"
+	`
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	if !ks.UsesRequest() {
+		t.Fatal("expected the key store to use the request for the key selection")
+	}
+
+	var testcases = []struct {
+		name      string
+		signKey   int
+		host      string
+		issuer    string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:    "tenant1 token with tenant1 host",
+			signKey: 0,
+			host:    "app1.example.com",
+		},
+		{
+			name:      "tenant1 token with tenant2 host",
+			signKey:   0,
+			host:      "app2.example.com",
+			issuer:    "https://app2.example.com",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:    "tenant2 token with tenant2 host and issuer",
+			signKey: 1,
+			host:    "app2.example.com",
+			issuer:  "https://app2.example.com",
+		},
+		{
+			name:      "tenant2 token with tenant2 host and another issuer",
+			signKey:   1,
+			host:      "app2.example.com",
+			issuer:    "https://app1.example.com",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "tenant2 token with unknown host",
+			signKey:   1,
+			host:      "app3.example.com",
+			issuer:    "https://app2.example.com",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			data := newTestUser().AsMap()
+			if tc.issuer != "" {
+				data["iss"] = tc.issuer
+			}
+			usr, err := user.NewUser(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := keys[tc.signKey].SignToken(nil, usr); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "https://"+tc.host+"/", nil)
+			_, err = ks.ParseTokenWithRequest(r, "access_token", usr.Token)
+			tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs)
 		})
 	}
 }
+
+func TestCryptoKeyStoreKeyIDLookup(t *testing.T) {
+	config := `
+		crypto key k1 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem
+		crypto key k2 sign-verify from file ./../../testdata/ecdsakeys/test_1_pri.pem
+		crypto key k3 token name foobar_token
+		crypto key k3 sign-verify from file ./../../testdata/rskeys/test_1_pri.pem
+		crypto key sign-verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+	`
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name         string
+		tokenName    string
+		kid          string
+		signKey      int
+		requireKeyID bool
+		want         []string
+		shouldErr    bool
+		err          error
+	}{
+		{
+			name:      "token with known key id",
+			tokenName: "access_token",
+			kid:       "k2",
+			signKey:   1,
+			want:      []string{"k2"},
+		},
+		{
+			name:      "token with key id of a key having another token name",
+			tokenName: "foobar_token",
+			kid:       "k3",
+			signKey:   2,
+			want:      []string{"k3"},
+		},
+		{
+			name:      "token with key id of a key having another token name and custom token name",
+			tokenName: "barfoo_token",
+			kid:       "k3",
+			signKey:   2,
+			want:      nil,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "token without key id",
+			tokenName: "access_token",
+			signKey:   3,
+			want:      []string{"k1", "k2", "k3", "0"},
+		},
+		{
+			name:         "token without key id when key id is required",
+			tokenName:    "access_token",
+			signKey:      3,
+			requireKeyID: true,
+			want:         []string{"k1", "k2", "k3", "0"},
+			shouldErr:    true,
+			err:          errors.ErrCryptoKeyStoreTokenKeyIDNotFound,
+		},
+		{
+			name:      "token with unknown key id",
+			tokenName: "access_token",
+			kid:       "k4",
+			signKey:   0,
+			want:      []string{"0"},
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs("RS512"),
+		},
+		{
+			name:      "token signed by key with key id and made-up key id",
+			tokenName: "access_token",
+			kid:       "k5",
+			signKey:   1,
+			want:      []string{"0"},
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs("ES256"),
+		},
+		{
+			name:         "token signed by key with key id and made-up key id when key id is required",
+			tokenName:    "access_token",
+			kid:          "k5",
+			signKey:      1,
+			requireKeyID: true,
+			want:         []string{"0"},
+			shouldErr:    true,
+			err:          errors.ErrCryptoKeyStoreAlgorithmNotAllowed.WithArgs("ES256"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			var got []string
+			for _, k := range ks.getVerifyKeys(tc.tokenName, tc.kid) {
+				got = append(got, k.Verify.Token.ID)
+			}
+			tests.EvalObjectsWithLog(t, "keys", tc.want, got, msgs)
+
+			signKey := keys[tc.signKey]
+			signKey.Sign.Token.ID = tc.kid
+			signKey.Sign.Token.injectKeyID = tc.kid != ""
+			usr := newTestUser()
+			if err := signKey.SignToken(nil, usr); err != nil {
+				t.Fatal(err)
+			}
+			ks.SetRequireKeyID(tc.requireKeyID)
+			defer ks.SetRequireKeyID(false)
+			_, err := ks.ParseToken(tc.tokenName, usr.Token)
+			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+		})
+	}
+}
+
+func TestCryptoKeyStoreWatchedKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "key.pem")
+	copyTestKeyFile(t, "./../../testdata/rskeys/test_2_pri.pem", fp)
+
+	config := fmt.Sprintf(`
+		crypto key k1 sign-verify from file %s
+		crypto key k1 watch interval 60
+		crypto key k1 watch grace 120
+	`, fp)
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeysWithConfigs(configs); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	watch := ks.GetKeys()[0].watch
+	// The watched keys with another key id are not tried.
+	tests.EvalObjects(t, "made-up key id", 0, len(expandVerifyKeys(ks.getVerifyKeys("access_token", "k4"), "k4")))
+
+	var testcases = []struct {
+		name string
+		// keyFile is the file replacing the watched key file.
+		keyFile string
+		// check indicates whether the watch interval elapsed.
+		check bool
+		// expire indicates whether the grace period of the rotated keys elapsed.
+		expire bool
+		// want is the signing algorithm of a newly signed token.
+		want string
+		// valid holds the expected validity of the tokens signed so far.
+		valid []bool
+	}{
+		{
+			name:  "sign and verify with initial key",
+			want:  "RS512",
+			valid: []bool{true},
+		},
+		{
+			name:    "key file changed within watch interval",
+			keyFile: "./../../testdata/ecdsakeys/test_1_pri.pem",
+			want:    "RS512",
+			valid:   []bool{true, true},
+		},
+		{
+			name:  "key file changed after watch interval",
+			check: true,
+			want:  "ES256",
+			valid: []bool{true, true, true},
+		},
+		{
+			name:   "rotated key after grace period",
+			expire: true,
+			want:   "ES256",
+			valid:  []bool{false, false, true, true},
+		},
+		{
+			name:    "malformed key file keeps current key",
+			keyFile: "./../../testdata/misckeys/test_3_empty.pem",
+			check:   true,
+			want:    "ES256",
+			valid:   []bool{false, false, true, true, true},
+		},
+	}
+
+	var signedTokens []string
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			if tc.keyFile != "" {
+				copyTestKeyFile(t, tc.keyFile, fp)
+			}
+			if tc.check {
+				watch.refresh()
+			}
+			if tc.expire {
+				watch.mu.Lock()
+				for _, rk := range watch.retired {
+					rk.expiresAt = time.Now().Add(-1 * time.Second)
+				}
+				watch.mu.Unlock()
+			}
+
+			usr := newTestUser()
+			if err := ks.SignToken(nil, nil, usr); err != nil {
+				t.Fatal(err)
+			}
+			signedTokens = append(signedTokens, usr.Token)
+			token, _, err := new(jwtlib.Parser).ParseUnverified(usr.Token, jwtlib.MapClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tests.EvalObjectsWithLog(t, "sign method", tc.want, token.Header["alg"], msgs)
+
+			var got []bool
+			for _, signedToken := range signedTokens {
+				_, err := ks.ParseToken("access_token", signedToken)
+				got = append(got, err == nil)
+			}
+			tests.EvalObjectsWithLog(t, "valid tokens", tc.valid, got, msgs)
+		})
+	}
+
+	// The retired keys past their grace period are removed in background.
+	watch.pruneRetired(time.Now())
+	tests.EvalObjects(t, "retired keys", 0, len(watch.retired))
+}
+
+func TestCryptoKeyStoreWatchedKeyBackgroundRefresh(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "key.pem")
+	copyTestKeyFile(t, "./../../testdata/rskeys/test_2_pri.pem", fp)
+
+	config := fmt.Sprintf(`
+		crypto key k1 sign-verify from file %s
+		crypto key k1 watch interval 1
+	`, fp)
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeysWithConfigs(configs); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	watch := ks.GetKeys()[0].watch
+
+	// The keys are rotated without any requests.
+	copyTestKeyFile(t, "./../../testdata/ecdsakeys/test_1_pri.pem", fp)
+	for i := 0; i < 30; i++ {
+		watch.mu.RLock()
+		n := len(watch.retired)
+		watch.mu.RUnlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("keys not rotated in background")
+}
+
+func copyTestKeyFile(t *testing.T, src, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptoKeyStoreKeyValidity(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	config := fmt.Sprintf(`
+		crypto key k1 sign-verify 8fbe4ed1-8ad4-4fd6-b2ec-3ab5e6b6c5b1
+		crypto key k1 not after %s
+		crypto key k2 sign-verify 2a3c1e7b-60a0-4f35-9e9b-55c0c5b8b1d2
+		crypto key k2 not after %s
+		crypto key k3 sign-verify 5d0f7a1c-3f9e-4b7e-8a41-0e3c9d7b2f64
+		crypto key k3 not before %s
+	`,
+		now.Add(-1*time.Hour).Format(time.RFC3339),
+		now.Add(time.Hour).Format(time.RFC3339),
+		now.Add(time.Hour).Format(time.RFC3339),
+	)
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, logs := observer.New(zap.WarnLevel)
+	ks := NewCryptoKeyStore()
+	ks.SetLogger(zap.New(core))
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name string
+		// signKey is the index of the key signing the token.
+		signKey   int
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:      "token verified by retired key",
+			signKey:   0,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreTokenKeyExpired.WithArgs("k1", now.Add(-1*time.Hour).Format(time.RFC3339)),
+		},
+		{
+			name:    "token verified by key approaching retirement",
+			signKey: 1,
+		},
+		{
+			name:    "token verified by pre-staged key",
+			signKey: 2,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			usr := newTestUser()
+			if err := keys[tc.signKey].SignToken(nil, usr); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ks.ParseToken("access_token", usr.Token)
+			tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs)
+		})
+	}
+
+	var signTestcases = []struct {
+		name      string
+		now       time.Time
+		want      string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "sign key before retirement of first key",
+			now:  now.Add(-2 * time.Hour),
+			want: "k1",
+		},
+		{
+			name: "sign key after retirement of first key",
+			now:  now,
+			want: "k2",
+		},
+		{
+			name: "sign key after activation of pre-staged key",
+			now:  now.Add(time.Hour),
+			want: "k3",
+		},
+	}
+	for _, tc := range signTestcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			k, err := ks.getSignKey(nil, tc.now)
+			if tests.EvalErrWithLog(t, err, "sign key", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			tests.EvalObjectsWithLog(t, "sign key", tc.want, k.Sign.Token.ID, msgs)
+		})
+	}
+
+	t.Run("no active sign key", func(t *testing.T) {
+		ts := now.Add(time.Hour)
+		ks := NewCryptoKeyStore()
+		if err := ks.AddKeys(keys[:2]); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ks.getSignKey(nil, ts)
+		tests.EvalErrWithLog(t, err, "sign key", true, errors.ErrCryptoKeyStoreNoActiveSignKeyFound.WithArgs(ts.Format(time.RFC3339)), nil)
+	})
+
+	t.Run("retirement warnings", func(t *testing.T) {
+		usr := newTestUser()
+		for i := 0; i < 2; i++ {
+			if err := ks.SignToken(nil, nil, usr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got []string
+		for _, entry := range logs.All() {
+			got = append(got, entry.Message+" "+entry.ContextMap()["key_id"].(string))
+		}
+		want := []string{
+			"crypto key is retired k1",
+			"crypto key retirement is approaching k2",
+		}
+		tests.EvalObjectsWithLog(t, "warnings", want, got, nil)
+	})
+}
@@ -15,6 +15,7 @@
 package kms
 
 import (
+	"github.com/greenpau/caddy-authorize/pkg/errors"
 	"strings"
 )
 
@@ -27,21 +28,30 @@ var (
 		"RS256": "rsa",
 		"RS384": "rsa",
 		"RS512": "rsa",
+		"PS256": "rsa",
+		"PS384": "rsa",
+		"PS512": "rsa",
 		"ES256": "ecdsa",
 		"ES384": "ecdsa",
 		"ES512": "ecdsa",
+		"EdDSA": "eddsa",
 	}
 
 	algoMethodMap = map[string][]string{
 		"hmac":  []string{"HS512", "HS384", "HS256"},
-		"rsa":   []string{"RS512", "RS384", "RS256"},
+		"rsa":   []string{"RS512", "RS384", "RS256", "PS512", "PS384", "PS256"},
 		"ecdsa": []string{"ES512", "ES384", "ES256"},
+		"eddsa": []string{"EdDSA"},
 	}
 )
 
 // getSigningMethodAlias returns alias for the provided signing method.
 func getSigningMethodAlias(s string) string {
-	s = strings.ToUpper(s)
+	if strings.EqualFold(s, "EdDSA") {
+		s = "EdDSA"
+	} else {
+		s = strings.ToUpper(s)
+	}
 	if v, exists := signingMethods[s]; exists {
 		arr := strings.SplitN(v, ",", 2)
 		return strings.TrimSpace(arr[0])
@@ -52,3 +62,39 @@ func getSigningMethodAlias(s string) string {
 func getMethodsPerAlgo(s string) []string {
 	return algoMethodMap[s]
 }
+
+// hasMethod returns true if the provided signing method is in the list.
+func hasMethod(methods []string, s string) bool {
+	for _, m := range methods {
+		if m == s {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMethods returns the signing methods present in both lists,
+// preserving the order of the first one.
+func filterMethods(methods, allowed []string) []string {
+	var arr []string
+	for _, m := range methods {
+		if hasMethod(allowed, m) {
+			arr = append(arr, m)
+		}
+	}
+	return arr
+}
+
+// getMethodPerCurve returns the signing method associated with the provided
+// ECDSA curve name. See https://golang.org/src/crypto/elliptic/elliptic.go.
+func getMethodPerCurve(s string) (string, error) {
+	switch s {
+	case "P-256":
+		return "ES256", nil
+	case "P-384":
+		return "ES384", nil
+	case "P-521":
+		return "ES512", nil
+	}
+	return "", errors.ErrUnsupportedECDSACurve.WithArgs(s)
+}
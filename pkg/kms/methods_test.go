@@ -34,6 +34,8 @@ func TestGetSigningMethodAlias(t *testing.T) {
 		{name: "ES256", want: "ecdsa"},
 		{name: "ES384", want: "ecdsa"},
 		{name: "ES512", want: "ecdsa"},
+		{name: "EdDSA", want: "eddsa"},
+		{name: "eddsa", want: "eddsa"},
 		{name: "TBD", want: "unknown"},
 	}
 	for _, tc := range testcases {
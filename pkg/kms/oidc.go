@@ -0,0 +1,75 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"encoding/json"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// oidcProviderMetadata is a subset of OpenID Provider Metadata, see
+// OpenID Connect Discovery 1.0, Section 3.
+type oidcProviderMetadata struct {
+	Issuer  string `json:"issuer"`
+	JwksURI string `json:"jwks_uri"`
+}
+
+// newOidcCryptoKey returns an instance of CryptoKey backed by the JSON Web
+// Key Set of an OpenID Connect provider. The provider is discovered via its
+// issuer URL. The tokens verified by the key must be issued by the provider.
+func newOidcCryptoKey(issuerURL string, cfg *CryptoKeyConfig) (*CryptoKey, error) {
+	metadata, err := discoverOidcProvider(issuerURL)
+	if err != nil {
+		return nil, err
+	}
+	k, err := newJwksCryptoKey(metadata.JwksURI, cfg)
+	if err != nil {
+		return nil, err
+	}
+	k.Verify.Token.Issuer = metadata.Issuer
+	return k, nil
+}
+
+func discoverOidcProvider(issuerURL string) (*oidcProviderMetadata, error) {
+	client := &http.Client{Timeout: defaultJwksFetchTimeout}
+	resp, err := client.Get(strings.TrimSuffix(issuerURL, "/") + oidcDiscoveryPath)
+	if err != nil {
+		return nil, errors.ErrCryptoKeyOidcDiscovery.WithArgs(issuerURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.ErrCryptoKeyOidcDiscovery.WithArgs(issuerURL, resp.Status)
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxJwksResponseSize))
+	if err != nil {
+		return nil, errors.ErrCryptoKeyOidcDiscovery.WithArgs(issuerURL, err)
+	}
+	metadata := &oidcProviderMetadata{}
+	if err := json.Unmarshal(b, metadata); err != nil {
+		return nil, errors.ErrCryptoKeyOidcDiscovery.WithArgs(issuerURL, err)
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != strings.TrimSuffix(issuerURL, "/") {
+		return nil, errors.ErrCryptoKeyOidcIssuerMismatch.WithArgs(issuerURL, metadata.Issuer)
+	}
+	if metadata.JwksURI == "" {
+		return nil, errors.ErrCryptoKeyOidcDiscovery.WithArgs(issuerURL, "jwks_uri not found")
+	}
+	return metadata, nil
+}
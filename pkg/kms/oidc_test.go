@@ -0,0 +1,125 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOidcCryptoKey(t *testing.T) {
+	signKey := newTestSignKey(t, "kid1", "./../../testdata/rskeys/test_2_pri.pem")
+	// otherKey is the key of another provider discovered via OpenID Connect.
+	otherKey := newTestSignKey(t, "kid2", "./../../testdata/ecdsakeys/test_1_pri.pem")
+	otherKey.Verify.Token.Issuer = "https://localhost/oauth2"
+	srv := &testJwksServer{}
+	srv.set(http.StatusOK, newTestJSONWebKey(t, signKey))
+
+	var issuer string
+	mux := http.NewServeMux()
+	mux.Handle("/jwks", srv)
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := json.Marshal(map[string]interface{}{
+			"issuer":   issuer,
+			"jwks_uri": "http://" + r.Host + "/jwks",
+		})
+		w.Write(b)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	testcases := []struct {
+		name            string
+		discoveryIssuer string
+		tokenIssuer     string
+		keyErr          bool
+		shouldErr       bool
+		err             error
+	}{
+		{
+			name:            "token issued by discovered provider",
+			discoveryIssuer: ts.URL,
+			tokenIssuer:     ts.URL,
+		},
+		{
+			name:            "token issued by another discovered provider",
+			discoveryIssuer: ts.URL,
+			tokenIssuer:     "https://localhost/oauth2",
+			shouldErr:       true,
+			err:             errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:            "token issued by unknown provider",
+			discoveryIssuer: ts.URL,
+			tokenIssuer:     "https://auth.example.com",
+			shouldErr:       true,
+			err:             errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:            "discovered issuer mismatch",
+			discoveryIssuer: "https://localhost/oauth2",
+			keyErr:          true,
+			shouldErr:       true,
+			err:             errors.ErrCryptoKeyOidcIssuerMismatch.WithArgs(ts.URL, "https://localhost/oauth2"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			issuer = tc.discoveryIssuer
+			configs, err := ParseCryptoKeyConfigs("crypto key verify from oidc " + ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := GetKeysFromConfigs(configs)
+			if tc.keyErr {
+				tests.EvalErrWithLog(t, err, "keys", tc.shouldErr, tc.err, msgs)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tests.EvalObjectsWithLog(t, "issuer", ts.URL, keys[0].Verify.Token.Issuer, msgs)
+
+			ks := NewCryptoKeyStore()
+			if err := ks.AddKeys(append(keys, otherKey)); err != nil {
+				t.Fatal(err)
+			}
+			usr, err := user.NewUser(map[string]interface{}{
+				"exp":   float64(time.Now().Add(10 * time.Minute).Unix()),
+				"iss":   tc.tokenIssuer,
+				"sub":   "smithj@outlook.com",
+				"roles": "anonymous guest",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := signKey.SignToken(nil, usr); err != nil {
+				t.Fatal(err)
+			}
+			_, err = ks.ParseToken("access_token", usr.Token)
+			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+		})
+	}
+}
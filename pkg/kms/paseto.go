@@ -0,0 +1,260 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	pasetoPublicHeader = "v4.public."
+	pasetoLocalHeader  = "v4.local."
+	pasetoNonceSize    = 32
+	pasetoMacSize      = 32
+)
+
+// pasetoToken is a PASETO v4 token.
+type pasetoToken struct {
+	header string
+	body   []byte
+	footer []byte
+	kid    string
+}
+
+// isPasetoToken returns true when the token is a PASETO v4 token.
+func isPasetoToken(token string) bool {
+	return strings.HasPrefix(token, "v4.")
+}
+
+// splitPasetoToken splits the token into its header, body, and optional
+// footer. When the footer is a JSON object with "kid" key, the key id is
+// used to select the verification keys.
+func splitPasetoToken(token string) (*pasetoToken, error) {
+	t := &pasetoToken{}
+	switch {
+	case strings.HasPrefix(token, pasetoPublicHeader):
+		t.header = pasetoPublicHeader
+	case strings.HasPrefix(token, pasetoLocalHeader):
+		t.header = pasetoLocalHeader
+	default:
+		return nil, errors.ErrCryptoKeyStorePasetoTokenUnsupported.WithArgs(strings.Join(strings.SplitN(token, ".", 3)[:2], "."))
+	}
+	parts := strings.Split(strings.TrimPrefix(token, t.header), ".")
+	if len(parts) > 2 {
+		return nil, errors.ErrCryptoKeyStorePasetoTokenMalformed.WithArgs("too many parts")
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.ErrCryptoKeyStorePasetoTokenMalformed.WithArgs(err)
+	}
+	t.body = body
+	if len(parts) == 2 {
+		footer, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.ErrCryptoKeyStorePasetoTokenMalformed.WithArgs(err)
+		}
+		t.footer = footer
+		if strings.HasPrefix(string(footer), "{") {
+			m := make(map[string]interface{})
+			if err := json.Unmarshal(footer, &m); err == nil {
+				t.kid, _ = m["kid"].(string)
+			}
+		}
+	}
+	switch t.header {
+	case pasetoPublicHeader:
+		if len(t.body) < ed25519.SignatureSize {
+			return nil, errors.ErrCryptoKeyStorePasetoTokenMalformed.WithArgs("body is too short")
+		}
+	case pasetoLocalHeader:
+		if len(t.body) < pasetoNonceSize+pasetoMacSize {
+			return nil, errors.ErrCryptoKeyStorePasetoTokenMalformed.WithArgs("body is too short")
+		}
+	}
+	return t, nil
+}
+
+// verify returns the payload of the token when the key verifies the
+// signature of v4.public token, or authenticates and decrypts v4.local token.
+// The v4.local tokens are decrypted only by the 32 byte shared keys with
+// paseto token type, because PASETO keys must not be reused across protocols.
+func (t *pasetoToken) verify(k *CryptoKey) ([]byte, error) {
+	switch t.header {
+	case pasetoPublicHeader:
+		pubKey, ok := k.Verify.Secret.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %q is not Ed25519 public key", k.Verify.Token.ID)
+		}
+		m := t.body[:len(t.body)-ed25519.SignatureSize]
+		sig := t.body[len(t.body)-ed25519.SignatureSize:]
+		if !ed25519.Verify(pubKey, pasetoPAE([]byte(t.header), m, t.footer, nil), sig) {
+			return nil, fmt.Errorf("signature is invalid")
+		}
+		return m, nil
+	case pasetoLocalHeader:
+		secret, ok := k.Verify.Secret.([]byte)
+		if !ok || k.Config.Algorithm != "hmac" || len(secret) != 32 {
+			return nil, fmt.Errorf("key %q is not 32 byte shared key", k.Verify.Token.ID)
+		}
+		if !k.isPasetoKey() {
+			return nil, fmt.Errorf("key %q is not PASETO key", k.Verify.Token.ID)
+		}
+		n := t.body[:pasetoNonceSize]
+		c := t.body[pasetoNonceSize : len(t.body)-pasetoMacSize]
+		mac := t.body[len(t.body)-pasetoMacSize:]
+
+		tmp, err := pasetoKeyedHash(56, secret, []byte("paseto-encryption-key"), n)
+		if err != nil {
+			return nil, err
+		}
+		encKey, nonce := tmp[:32], tmp[32:]
+		authKey, err := pasetoKeyedHash(32, secret, []byte("paseto-auth-key-for-aead"), n)
+		if err != nil {
+			return nil, err
+		}
+		expectedMac, err := pasetoKeyedHash(32, authKey, pasetoPAE([]byte(t.header), n, c, t.footer, nil))
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(mac, expectedMac) {
+			return nil, fmt.Errorf("authentication tag is invalid")
+		}
+		cipher, err := chacha20.NewUnauthenticatedCipher(encKey, nonce)
+		if err != nil {
+			return nil, err
+		}
+		m := make([]byte, len(c))
+		cipher.XORKeyStream(m, c)
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported token header %s", t.header)
+}
+
+// pasetoKeyedHash returns BLAKE2b keyed hash of the provided size.
+func pasetoKeyedHash(size int, key []byte, data ...[]byte) ([]byte, error) {
+	h, err := blake2b.New(size, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range data {
+		h.Write(b)
+	}
+	return h.Sum(nil), nil
+}
+
+// pasetoPAE returns the pre-authentication encoding of the pieces.
+func pasetoPAE(pieces ...[]byte) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(len(pieces))&(1<<63-1))
+	for _, p := range pieces {
+		n := make([]byte, 8)
+		binary.LittleEndian.PutUint64(n, uint64(len(p))&(1<<63-1))
+		b = append(b, n...)
+		b = append(b, p...)
+	}
+	return b
+}
+
+// getPasetoClaims returns the claims of the payload. The registered time
+// claims of PASETO are RFC3339 strings. They are converted to the numeric
+// dates of JWT.
+func getPasetoClaims(payload []byte) (map[string]interface{}, error) {
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"exp", "nbf", "iat"} {
+		v, exists := claims[name]
+		if !exists {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%q claim is not RFC3339 time", name)
+		}
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("%q claim is not RFC3339 time: %v", name, err)
+		}
+		claims[name] = tm.Unix()
+	}
+	return claims, nil
+}
+
+// parsePasetoToken verifies PASETO v4 token with the verification keys of
+// the keystore. The v4.public tokens are verified by Ed25519 keys, and the
+// v4.local tokens by 32 byte shared keys with paseto token type.
+func (ks *CryptoKeyStore) parsePasetoToken(r *http.Request, tokenName, token string) (*user.User, error) {
+	t, err := splitPasetoToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if t.kid == "" && ks.requireKeyID {
+		return nil, errors.ErrCryptoKeyStoreTokenKeyIDNotFound
+	}
+	var expiredKey *CryptoKey
+	for _, k := range expandVerifyKeys(ks.getVerifyKeys(tokenName, t.kid), t.kid) {
+		if k.jwks != nil {
+			continue
+		}
+		payload, err := t.verify(k)
+		if err != nil {
+			continue
+		}
+		claims, err := getPasetoClaims(payload)
+		if err != nil {
+			continue
+		}
+		if !k.matchEvalExpr(&evalInput{request: r, claims: claims}) {
+			continue
+		}
+		usr, err := user.NewUser(claims)
+		if err != nil {
+			continue
+		}
+		if ks.isIssuerMismatch(k, usr.Claims.Issuer) {
+			continue
+		}
+		now := time.Now()
+		if err := usr.Claims.ValidAt(now, ks.leeway); err != nil {
+			continue
+		}
+		ks.warnKeyExpiry(k, now)
+		if k.isExpired(now) {
+			expiredKey = k
+			continue
+		}
+		return usr, nil
+	}
+	if expiredKey != nil {
+		return nil, errors.ErrCryptoKeyStoreTokenKeyExpired.WithArgs(
+			expiredKey.Verify.Token.ID, expiredKey.Config.NotAfter.Format(time.RFC3339),
+		)
+	}
+	return nil, errors.ErrCryptoKeyStoreParseTokenFailed
+}
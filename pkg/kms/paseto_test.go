@@ -0,0 +1,271 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	jwtlib "github.com/golang-jwt/jwt/v4"
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"golang.org/x/crypto/chacha20"
+	"testing"
+	"time"
+)
+
+const (
+	testPasetoLocalKey = "3f1c9b2e7a6d4e8f0b5a2c7d9e1f4a6b"
+	// testPasetoJwtKey is 32 byte shared key not marked for PASETO tokens.
+	testPasetoJwtKey = "8d2a6f0c4e9b1d7a3c5e8f2b6d0a4c9e"
+)
+
+func newTestPasetoToken(t *testing.T, header string, key interface{}, claims map[string]interface{}, footer string) string {
+	m, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	switch header {
+	case pasetoPublicHeader:
+		sig := ed25519.Sign(key.(ed25519.PrivateKey), pasetoPAE([]byte(header), m, []byte(footer), nil))
+		body = append(m, sig...)
+	case pasetoLocalHeader:
+		secret := key.([]byte)
+		n := make([]byte, pasetoNonceSize)
+		if _, err := rand.Read(n); err != nil {
+			t.Fatal(err)
+		}
+		tmp, _ := pasetoKeyedHash(56, secret, []byte("paseto-encryption-key"), n)
+		authKey, _ := pasetoKeyedHash(32, secret, []byte("paseto-auth-key-for-aead"), n)
+		cipher, err := chacha20.NewUnauthenticatedCipher(tmp[:32], tmp[32:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := make([]byte, len(m))
+		cipher.XORKeyStream(c, m)
+		mac, _ := pasetoKeyedHash(32, authKey, pasetoPAE([]byte(header), n, c, []byte(footer), nil))
+		body = append(append(n, c...), mac...)
+	}
+	token := header + base64.RawURLEncoding.EncodeToString(body)
+	if footer != "" {
+		token += "." + base64.RawURLEncoding.EncodeToString([]byte(footer))
+	}
+	return token
+}
+
+func TestPasetoPAE(t *testing.T) {
+	var testcases = []struct {
+		name   string
+		pieces [][]byte
+		want   string
+	}{
+		{
+			name: "no pieces",
+			want: "\x00\x00\x00\x00\x00\x00\x00\x00",
+		},
+		{
+			name:   "empty piece",
+			pieces: [][]byte{{}},
+			want:   "\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		},
+		{
+			name:   "single piece",
+			pieces: [][]byte{[]byte("test")},
+			want:   "\x01\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00test",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			tests.EvalObjectsWithLog(t, "pae", tc.want, string(pasetoPAE(tc.pieces...)), msgs)
+		})
+	}
+}
+
+func TestCryptoKeyStoreParsePasetoToken(t *testing.T) {
+	config := `
+		crypto key k1 verify from file ./../../testdata/eddsakeys/test_1_pub.pem
+		crypto key k2 verify ` + testPasetoLocalKey + `
+		crypto key k2 token type paseto
+		crypto key k3 verify ` + testPasetoJwtKey + `
+	`
+	configs, err := ParseCryptoKeyConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewCryptoKeyStore()
+	if err := ks.AddKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	signKeys, err := GetKeysFromConfig(&CryptoKeyConfig{
+		ID:       "k1",
+		Usage:    "sign",
+		Source:   "config",
+		FilePath: "./../../testdata/eddsakeys/test_1_pri.pem",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey := signKeys[0].Sign.Secret.(ed25519.PrivateKey)
+	_, unknownKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	claims := map[string]interface{}{
+		"sub":   "smithj@outlook.com",
+		"email": "smithj@outlook.com",
+		"roles": []string{"admin"},
+		"exp":   now.Add(10 * time.Minute).Format(time.RFC3339),
+		"iat":   now.Format(time.RFC3339),
+	}
+	want := map[string]interface{}{
+		"sub":   "smithj@outlook.com",
+		"mail":  "smithj@outlook.com",
+		"roles": []string{"admin"},
+		"exp":   now.Add(10 * time.Minute).Unix(),
+		"iat":   now.Unix(),
+	}
+	withClaim := func(name string, v interface{}) map[string]interface{} {
+		m := make(map[string]interface{})
+		for k, v := range claims {
+			m[k] = v
+		}
+		m[name] = v
+		return m
+	}
+	tamperedToken := []byte(newTestPasetoToken(t, pasetoLocalHeader, []byte(testPasetoLocalKey), claims, ""))
+	// The nonce is tampered with while keeping the token a valid base64 string.
+	if tamperedToken[20] == 'A' {
+		tamperedToken[20] = 'B'
+	} else {
+		tamperedToken[20] = 'A'
+	}
+	jwtToken, err := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, jwtlib.MapClaims{
+		"sub": "smithj@outlook.com",
+		"exp": now.Add(10 * time.Minute).Unix(),
+	}).SignedString([]byte(testPasetoLocalKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name      string
+		token     string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:  "public token",
+			token: newTestPasetoToken(t, pasetoPublicHeader, privKey, claims, ""),
+		},
+		{
+			name:  "public token with key id in footer",
+			token: newTestPasetoToken(t, pasetoPublicHeader, privKey, claims, `{"kid":"k1"}`),
+		},
+		{
+			name:  "local token",
+			token: newTestPasetoToken(t, pasetoLocalHeader, []byte(testPasetoLocalKey), claims, ""),
+		},
+		{
+			name:  "local token with footer",
+			token: newTestPasetoToken(t, pasetoLocalHeader, []byte(testPasetoLocalKey), claims, "app1"),
+		},
+		{
+			name:      "public token signed by unknown key",
+			token:     newTestPasetoToken(t, pasetoPublicHeader, unknownKey, claims, ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "local token encrypted with unknown key",
+			token:     newTestPasetoToken(t, pasetoLocalHeader, []byte("00000000000000000000000000000000"), claims, ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "local token encrypted with key not marked for paseto",
+			token:     newTestPasetoToken(t, pasetoLocalHeader, []byte(testPasetoJwtKey), claims, ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "jwt token signed by paseto key",
+			token:     jwtToken,
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "tampered local token",
+			token:     string(tamperedToken),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "expired token",
+			token:     newTestPasetoToken(t, pasetoPublicHeader, privKey, withClaim("exp", now.Add(-time.Minute).Format(time.RFC3339)), ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "token not valid yet",
+			token:     newTestPasetoToken(t, pasetoPublicHeader, privKey, withClaim("nbf", now.Add(time.Hour).Format(time.RFC3339)), ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "token with numeric expiry",
+			token:     newTestPasetoToken(t, pasetoPublicHeader, privKey, withClaim("exp", now.Add(time.Hour).Unix()), ""),
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name:      "unsupported token purpose",
+			token:     "v4.secret.AAAA",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStorePasetoTokenUnsupported.WithArgs("v4.secret"),
+		},
+		{
+			name:      "token with malformed body",
+			token:     "v4.public.!!!!",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStorePasetoTokenMalformed.WithArgs("illegal base64 data at input byte 0"),
+		},
+		{
+			name:      "token with short body",
+			token:     "v4.local.AAAA",
+			shouldErr: true,
+			err:       errors.ErrCryptoKeyStorePasetoTokenMalformed.WithArgs("body is too short"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			usr, err := ks.ParseToken("access_token", tc.token)
+			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			tests.EvalObjectsWithLog(t, "claims", want, usr.AsMap(), msgs)
+		})
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+	"os"
+	"strings"
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo is PKCS #8 EncryptedPrivateKeyInfo, see RFC 5208.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params is PBES2-params, see RFC 8018.
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params is PBKDF2-params, see RFC 8018.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// scryptParams is scrypt-params, see RFC 7914.
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// getPassphrase returns the passphrase of an encrypted private key from
+// the environment variable referenced in the config. A single trailing
+// newline, e.g. added when the variable is populated from a file or a secret
+// mount, is removed. Any other whitespace is a part of the passphrase.
+func getPassphrase(cfg *CryptoKeyConfig) ([]byte, error) {
+	if cfg.PassphraseEnvVarName == "" {
+		return nil, errors.ErrCryptoKeyPassphraseNotFound
+	}
+	v := os.Getenv(cfg.PassphraseEnvVarName)
+	if strings.HasSuffix(v, "\r\n") {
+		v = strings.TrimSuffix(v, "\r\n")
+	} else {
+		v = strings.TrimSuffix(v, "\n")
+	}
+	if v == "" {
+		return nil, errors.ErrCryptoKeyConfigEmptyEnvVar.WithArgs(cfg.PassphraseEnvVarName)
+	}
+	return []byte(v), nil
+}
+
+// decryptPrivateKeyBlock returns the decrypted PEM block of an encrypted
+// private key. Both the encrypted PKCS #8 keys and the legacy encrypted PEM
+// blocks, i.e. with "Proc-Type: 4,ENCRYPTED" header, are supported. When
+// the block is not encrypted, it is returned as is.
+func decryptPrivateKeyBlock(block *pem.Block, cfg *CryptoKeyConfig) (*pem.Block, error) {
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		passphrase, err := getPassphrase(cfg)
+		if err != nil {
+			return nil, err
+		}
+		der, err := decryptPKCS8PrivateKey(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	case x509.IsEncryptedPEMBlock(block):
+		passphrase, err := getPassphrase(cfg)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			if err == x509.IncorrectPasswordError {
+				return nil, errors.ErrCryptoKeyPassphraseIncorrect
+			}
+			return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs(err)
+		}
+		return &pem.Block{Type: block.Type, Bytes: der}, nil
+	}
+	return block, nil
+}
+
+// decryptPKCS8PrivateKey decrypts PKCS #8 EncryptedPrivateKeyInfo with the
+// provided passphrase and returns PKCS #8 PrivateKeyInfo. The supported
+// encryption scheme is PBES2 with PBKDF2 or scrypt key derivation and
+// AES-CBC encryption, i.e. the default of OpenSSL.
+func decryptPKCS8PrivateKey(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs(err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs("unsupported encryption algorithm " + info.Algorithm.Algorithm.String())
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs(err)
+	}
+
+	var keyLength int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs("unsupported encryption scheme " + params.EncryptionScheme.Algorithm.String())
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs(err)
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs("invalid initialization vector")
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, passphrase, keyLength)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs(err)
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs("invalid encrypted data size")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(blk, iv).CryptBlocks(out, data)
+
+	// The invalid padding indicates the wrong passphrase.
+	n := int(out[len(out)-1])
+	if n == 0 || n > aes.BlockSize || !bytes.Equal(out[len(out)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errors.ErrCryptoKeyPassphraseIncorrect
+	}
+	out = out[:len(out)-n]
+	if _, err := x509.ParsePKCS8PrivateKey(out); err != nil {
+		return nil, errors.ErrCryptoKeyPassphraseIncorrect
+	}
+	return out, nil
+}
+
+// deriveKey derives the encryption key from the passphrase with the provided
+// key derivation function.
+func deriveKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLength int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs(err)
+		}
+		var h func() hash.Hash
+		switch {
+		case len(params.PRF.Algorithm) == 0, params.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA224):
+			h = sha256.New224
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA384):
+			h = sha512.New384
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA512):
+			h = sha512.New
+		default:
+			return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs("unsupported pbkdf2 prf " + params.PRF.Algorithm.String())
+		}
+		return pbkdf2.Key(passphrase, params.Salt, params.IterationCount, keyLength, h), nil
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs(err)
+		}
+		key, err := scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keyLength)
+		if err != nil {
+			return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs(err)
+		}
+		return key, nil
+	}
+	return nil, errors.ErrCryptoKeyDecryptFailed.WithArgs("unsupported key derivation function " + kdf.Algorithm.String())
+}
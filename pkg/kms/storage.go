@@ -0,0 +1,84 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CryptoKeyStorage persists auto-generated keys across restarts. The
+// interface is a subset of certmagic.Storage, i.e. Caddy storage satisfies it.
+type CryptoKeyStorage interface {
+	Exists(key string) bool
+	Load(key string) ([]byte, error)
+	Store(key string, value []byte) error
+}
+
+// cryptoKeyStorageLocker is implemented by the storages capable of
+// coordinating key generation across multiple instances, e.g. certmagic.Storage.
+type cryptoKeyStorageLocker interface {
+	Lock(ctx context.Context, key string) error
+	Unlock(key string) error
+}
+
+// fileCryptoKeyStorage stores an auto-generated key in a single file. The
+// storage key is ignored, because the file holds exactly one key.
+type fileCryptoKeyStorage struct {
+	path string
+}
+
+// NewFileCryptoKeyStorage returns an instance of CryptoKeyStorage backed by
+// the file at the provided path.
+func NewFileCryptoKeyStorage(fp string) CryptoKeyStorage {
+	return &fileCryptoKeyStorage{path: fp}
+}
+
+func (s *fileCryptoKeyStorage) Exists(key string) bool {
+	_, err := os.Stat(s.path)
+	return err == nil
+}
+
+func (s *fileCryptoKeyStorage) Load(key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path)
+}
+
+// Store writes the key to a temporary file and then renames it, so that
+// the partially written key is never read.
+func (s *fileCryptoKeyStorage) Store(key string, value []byte) error {
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
@@ -0,0 +1,331 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWatchGracePeriod int = 300
+)
+
+// watchedKeySet holds the keys loaded from a watched file or directory.
+// Once the set is added to CryptoKeyStore, the file or directory is checked
+// for changes in background, once per watch interval, until the set is
+// stopped. When the content changes, the keys are reloaded and swapped in.
+// The replaced keys remain available for token verification until the end
+// of the grace period.
+type watchedKeySet struct {
+	mu      sync.RWMutex
+	path    string
+	isDir   bool
+	cfg     *CryptoKeyConfig
+	keys    []*CryptoKey
+	retired []*retiredCryptoKey
+	// digest is the digest of the content of the watched file or directory.
+	digest      string
+	interval    time.Duration
+	gracePeriod time.Duration
+	done        chan struct{}
+	startOnce   sync.Once
+	stopOnce    sync.Once
+	logger      *zap.Logger
+}
+
+// retiredCryptoKey is a key replaced during key rotation.
+type retiredCryptoKey struct {
+	key       *CryptoKey
+	expiresAt time.Time
+}
+
+func newWatchedKeySet(cfg *CryptoKeyConfig) *watchedKeySet {
+	s := &watchedKeySet{
+		cfg:         cfg,
+		interval:    time.Duration(cfg.WatchInterval) * time.Second,
+		gracePeriod: time.Duration(defaultWatchGracePeriod) * time.Second,
+		done:        make(chan struct{}),
+		logger:      zap.NewNop(),
+	}
+	if cfg.WatchGracePeriod > 0 {
+		s.gracePeriod = time.Duration(cfg.WatchGracePeriod) * time.Second
+	}
+	switch {
+	case cfg.FilePath != "":
+		s.path = cfg.FilePath
+	case cfg.DirPath != "":
+		s.path = cfg.DirPath
+		s.isDir = true
+	case cfg.EnvVarType == "file":
+		s.path = cfg.EnvVarValue
+	case cfg.EnvVarType == "directory":
+		s.path = cfg.EnvVarValue
+		s.isDir = true
+	}
+	return s
+}
+
+// newWatchedCryptoKey returns an instance of CryptoKey backed by a watched
+// file or directory. The initial set of keys is loaded synchronously. The
+// changes are watched once the key is added to CryptoKeyStore, see
+// CryptoKeyStore.AddKey.
+func newWatchedCryptoKey(cfg *CryptoKeyConfig) (*CryptoKey, error) {
+	k := newCryptoKey()
+	k.Config = cfg
+	k.watch = newWatchedKeySet(cfg)
+	digest, err := k.watch.getDigest()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := k.watch.load()
+	if err != nil {
+		return nil, err
+	}
+	k.watch.keys = keys
+	k.watch.digest = digest
+
+	for _, wk := range keys {
+		if wk.Sign.Capable {
+			k.Sign.Capable = true
+		}
+		if wk.Verify.Capable {
+			k.Verify.Capable = true
+		}
+	}
+	for _, algo := range []string{"rsa", "ecdsa", "eddsa"} {
+		k.Sign.Token.PreferredMethods = append(k.Sign.Token.PreferredMethods, getMethodsPerAlgo(algo)...)
+		k.Verify.Token.PreferredMethods = append(k.Verify.Token.PreferredMethods, getMethodsPerAlgo(algo)...)
+	}
+	return k, nil
+}
+
+// start starts watching the file or directory for changes, unless it has
+// already been started.
+func (s *watchedKeySet) start() {
+	s.startOnce.Do(func() {
+		go s.run()
+	})
+}
+
+// stop stops watching the file or directory for changes.
+func (s *watchedKeySet) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// run checks the file or directory for changes once per watch interval, and
+// removes the retired keys past their grace period.
+func (s *watchedKeySet) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.refresh()
+		s.pruneRetired(time.Now())
+	}
+}
+
+func (s *watchedKeySet) setLogger(logger *zap.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+}
+
+// load reads the keys from the watched file or directory.
+func (s *watchedKeySet) load() ([]*CryptoKey, error) {
+	var keys []*CryptoKey
+	var err error
+	if s.isDir {
+		keys, err = extractKeysFromDir(s.path, s.cfg)
+	} else {
+		keys, err = extractKeysFromFile(s.path, s.cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if err := k.configure(); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// getDigest returns the digest of the content of the watched file or of
+// the key files in the watched directory. The content, rather than the
+// modification time, is used because the files are often replaced via
+// symlink swaps, e.g. with Kubernetes secrets.
+func (s *watchedKeySet) getDigest() (string, error) {
+	var paths []string
+	if s.isDir {
+		exts := s.cfg.getFileExtensions()
+		err := filepath.Walk(s.path, func(fp string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return nil
+			}
+			if exts[filepath.Ext(fp)] {
+				paths = append(paths, fp)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(paths)
+	} else {
+		paths = append(paths, s.path)
+	}
+	h := sha256.New()
+	for _, fp := range paths {
+		b, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(fp))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// refresh checks the watched file or directory for changes. When the
+// content changed, the keys are reloaded. When the reload fails, the current
+// keys remain and the reload is retried at the next check. The files are
+// read without holding the lock, i.e. the verification of the tokens does
+// not wait for the reload.
+func (s *watchedKeySet) refresh() {
+	s.mu.RLock()
+	current := s.digest
+	logger := s.logger
+	s.mu.RUnlock()
+
+	digest, err := s.getDigest()
+	if err != nil {
+		logger.Warn("failed checking crypto keys for changes", zap.String("path", s.path), zap.Error(err))
+		return
+	}
+	if digest == current {
+		return
+	}
+	keys, err := s.load()
+	if err != nil {
+		logger.Error("failed reloading crypto keys", zap.String("path", s.path), zap.Error(err))
+		return
+	}
+
+	var keyIDs []string
+	for _, k := range keys {
+		keyIDs = append(keyIDs, k.Config.ID)
+	}
+	now := time.Now()
+	s.mu.Lock()
+	if s.digest != current {
+		s.mu.Unlock()
+		return
+	}
+	for _, k := range s.keys {
+		s.retired = append(s.retired, &retiredCryptoKey{key: k, expiresAt: now.Add(s.gracePeriod)})
+	}
+	s.keys = keys
+	s.digest = digest
+	retiredCount := len(s.retired)
+	s.mu.Unlock()
+
+	logger.Info(
+		"crypto keys rotated",
+		zap.String("path", s.path),
+		zap.Strings("key_ids", keyIDs),
+		zap.Int("retired_key_count", retiredCount),
+		zap.Duration("grace_period", s.gracePeriod),
+	)
+}
+
+// pruneRetired removes the retired keys past their grace period.
+func (s *watchedKeySet) pruneRetired(now time.Time) {
+	s.mu.Lock()
+	var retired []*retiredCryptoKey
+	var keyIDs []string
+	for _, rk := range s.retired {
+		if now.Before(rk.expiresAt) {
+			retired = append(retired, rk)
+			continue
+		}
+		keyIDs = append(keyIDs, rk.key.Config.ID)
+	}
+	s.retired = retired
+	logger := s.logger
+	s.mu.Unlock()
+	if len(keyIDs) > 0 {
+		logger.Info(
+			"retired crypto keys expired",
+			zap.String("path", s.path),
+			zap.Strings("key_ids", keyIDs),
+		)
+	}
+}
+
+// getVerifyKeys returns the current keys and the retired keys within their
+// grace period. When the key id is provided, the keys with a different
+// key id are skipped, even when none of the keys has the key id.
+func (s *watchedKeySet) getVerifyKeys(kid string) []*CryptoKey {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := append([]*CryptoKey{}, s.keys...)
+	for _, rk := range s.retired {
+		if now.Before(rk.expiresAt) {
+			keys = append(keys, rk.key)
+		}
+	}
+	var arr []*CryptoKey
+	for _, k := range keys {
+		if !k.Verify.Capable {
+			continue
+		}
+		if kid != "" && k.hasKeyID() && k.Verify.Token.ID != kid {
+			continue
+		}
+		arr = append(arr, k)
+	}
+	return arr
+}
+
+// getSignKey returns the first current key with key signing capabilities.
+func (s *watchedKeySet) getSignKey() *CryptoKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if k.Sign.Capable {
+			return k
+		}
+	}
+	return nil
+}
@@ -20,11 +20,42 @@ type TokenValidatorOptions struct {
 	ValidateBearerHeader        bool `json:"validate_bearer_header,omitempty" xml:"validate_bearer_header,omitempty" yaml:"validate_bearer_header,omitempty"`
 	ValidateMethodPath          bool `json:"validate_method_path,omitempty" xml:"validate_method_path,omitempty" yaml:"validate_method_path,omitempty"`
 	ValidateAccessListPathClaim bool `json:"validate_access_list_path_claim,omitempty" xml:"validate_access_list_path_claim,omitempty" yaml:"validate_access_list_path_claim,omitempty"`
+	ValidateKeyID               bool `json:"validate_key_id,omitempty" xml:"validate_key_id,omitempty" yaml:"validate_key_id,omitempty"`
+	// ValidateAudience holds the allowed "aud" claim values of the tokens.
+	ValidateAudience []string `json:"validate_audience,omitempty" xml:"validate_audience,omitempty" yaml:"validate_audience,omitempty"`
+	// ValidateIssuer holds the allowed "iss" claim values of the tokens.
+	ValidateIssuer []string `json:"validate_issuer,omitempty" xml:"validate_issuer,omitempty" yaml:"validate_issuer,omitempty"`
+	// TokenLeeway is the number of seconds of tolerated clock skew when
+	// validating "exp", "nbf", and "iat" claims.
+	TokenLeeway int `json:"token_leeway,omitempty" xml:"token_leeway,omitempty" yaml:"token_leeway,omitempty"`
+	// TokenMaxAge is the max number of seconds since the "iat" claim of the
+	// tokens, regardless of their "exp" claim.
+	TokenMaxAge int `json:"token_max_age,omitempty" xml:"token_max_age,omitempty" yaml:"token_max_age,omitempty"`
+	// RequiredClaims holds the claims the tokens must carry.
+	RequiredClaims []*RequiredClaim `json:"required_claims,omitempty" xml:"required_claims,omitempty" yaml:"required_claims,omitempty"`
+	// ValidateDPoP enables the validation of DPoP proofs of possession of
+	// the tokens presented with DPoP authorization scheme, see RFC 9449.
+	ValidateDPoP bool `json:"validate_dpop,omitempty" xml:"validate_dpop,omitempty" yaml:"validate_dpop,omitempty"`
+	// ValidateClientCertificate enables the validation of the binding of the
+	// tokens to the client certificates of mutual TLS, see RFC 8705.
+	ValidateClientCertificate bool `json:"validate_client_certificate,omitempty" xml:"validate_client_certificate,omitempty" yaml:"validate_client_certificate,omitempty"`
+}
+
+// RequiredClaim is a claim the tokens must carry. When the type is set, the
+// value of the claim must be of the type, i.e. string, number, bool, list,
+// or map.
+type RequiredClaim struct {
+	Name string `json:"name,omitempty" xml:"name,omitempty" yaml:"name,omitempty"`
+	Type string `json:"type,omitempty" xml:"type,omitempty" yaml:"type,omitempty"`
 }
 
 // TokenGrantorOptions provides options for TokenGrantor.
 type TokenGrantorOptions struct {
 	EnableSourceAddress bool `json:"enable_source_address,omitempty" xml:"enable_source_address,omitempty" yaml:"enable_source_address,omitempty"`
+	// Issuer is the default "iss" claim of the granted tokens.
+	Issuer string `json:"issuer,omitempty" xml:"issuer,omitempty" yaml:"issuer,omitempty"`
+	// Audience is the default "aud" claim of the granted tokens.
+	Audience []string `json:"audience,omitempty" xml:"audience,omitempty" yaml:"audience,omitempty"`
 }
 
 // NewTokenValidatorOptions returns an instance of TokenValidatorOptions
@@ -112,9 +112,26 @@ type AccessListClaim struct {
 
 // Valid validates user claims.
 func (c Claims) Valid() error {
-	if c.ExpiresAt < time.Now().Unix() {
+	now := time.Now()
+	if c.ExpiresAt < now.Unix() {
 		return errors.ErrExpiredToken
 	}
+	return c.ValidAt(now, 0)
+}
+
+// ValidAt validates the "exp", "nbf", and "iat" claims, when present, at
+// the provided time. The leeway is the tolerated clock skew between the
+// issuer of the token and the validator.
+func (c Claims) ValidAt(now time.Time, leeway time.Duration) error {
+	if c.ExpiresAt > 0 && c.ExpiresAt < now.Add(-leeway).Unix() {
+		return errors.ErrExpiredToken
+	}
+	if c.NotBefore > 0 && c.NotBefore > now.Add(leeway).Unix() {
+		return errors.ErrTokenNotYetValid
+	}
+	if c.IssuedAt > 0 && c.IssuedAt > now.Add(leeway).Unix() {
+		return errors.ErrTokenIssuedInFuture
+	}
 	return nil
 }
 
@@ -27,6 +27,7 @@ func TestTokenValidity(t *testing.T) {
 	testcases := []struct {
 		name      string
 		data      []byte
+		leeway    time.Duration
 		shouldErr bool
 		err       error
 	}{
@@ -40,6 +41,35 @@ func TestTokenValidity(t *testing.T) {
 			shouldErr: true,
 			err:       errors.ErrExpiredToken,
 		},
+		{
+			name:   "expired token within leeway",
+			data:   []byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(-10*time.Second).Unix())),
+			leeway: 30 * time.Second,
+		},
+		{
+			name:      "expired token beyond leeway",
+			data:      []byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(-time.Minute).Unix())),
+			leeway:    30 * time.Second,
+			shouldErr: true,
+			err:       errors.ErrExpiredToken,
+		},
+		{
+			name:      "token not valid yet",
+			data:      []byte(fmt.Sprintf(`{"exp":%d,"nbf":%d}`, time.Now().Add(10*time.Minute).Unix(), time.Now().Add(time.Minute).Unix())),
+			shouldErr: true,
+			err:       errors.ErrTokenNotYetValid,
+		},
+		{
+			name:   "token not valid yet within leeway",
+			data:   []byte(fmt.Sprintf(`{"exp":%d,"nbf":%d}`, time.Now().Add(10*time.Minute).Unix(), time.Now().Add(10*time.Second).Unix())),
+			leeway: 30 * time.Second,
+		},
+		{
+			name:      "token issued in the future",
+			data:      []byte(fmt.Sprintf(`{"exp":%d,"iat":%d}`, time.Now().Add(10*time.Minute).Unix(), time.Now().Add(time.Minute).Unix())),
+			shouldErr: true,
+			err:       errors.ErrTokenIssuedInFuture,
+		},
 	}
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -48,7 +78,11 @@ func TestTokenValidity(t *testing.T) {
 			usr, err := NewUser(tc.data)
 			if err == nil {
 				msgs = append(msgs, fmt.Sprintf("parsed claims: %v", usr.AsMap()))
-				err = usr.Claims.Valid()
+				if tc.leeway > 0 {
+					err = usr.Claims.ValidAt(time.Now(), tc.leeway)
+				} else {
+					err = usr.Claims.Valid()
+				}
 			}
 			if tests.EvalErrWithLog(t, err, "parse token", tc.shouldErr, tc.err, msgs) {
 				return
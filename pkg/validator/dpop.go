@@ -0,0 +1,259 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v4"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/kms"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+	urlutils "github.com/greenpau/caddy-authorize/pkg/utils/url"
+)
+
+const (
+	dpopTokenName     = "dpop"
+	dpopProofType     = "dpop+jwt"
+	dpopProofLifetime = 60 * time.Second
+)
+
+// dpopSigningMethods are the asymmetric signing methods of DPoP proofs.
+var dpopSigningMethods = []string{
+	"ES256", "ES384", "ES512",
+	"PS256", "PS384", "PS512",
+	"RS256", "RS384", "RS512",
+	"EdDSA",
+}
+
+// GetDPoPSigningMethods returns the signing methods allowed for DPoP proofs.
+func GetDPoPSigningMethods() []string {
+	return dpopSigningMethods
+}
+
+// dpopValidator validates DPoP proofs, see RFC 9449. The token ids of the
+// proofs are tracked for the lifetime of the proofs to reject the replays.
+type dpopValidator struct {
+	mu       sync.Mutex
+	leeway   time.Duration
+	proofIDs map[string]time.Time
+	prunedAt time.Time
+}
+
+func newDPoPValidator(leeway time.Duration) *dpopValidator {
+	return &dpopValidator{
+		leeway:   leeway,
+		proofIDs: make(map[string]time.Time),
+		prunedAt: time.Now(),
+	}
+}
+
+// validate validates the DPoP proof of the request for the access token and
+// returns the thumbprint of the key the proof is signed with.
+func (d *dpopValidator) validate(r *http.Request, token string) (string, error) {
+	proofs := r.Header.Values("DPoP")
+	switch {
+	case len(proofs) == 0:
+		return "", errors.ErrDPoPProofNotFound
+	case len(proofs) > 1, strings.Contains(proofs[0], ","):
+		return "", errors.ErrDPoPProofMultiple
+	}
+
+	var jwk *kms.JSONWebKey
+	var keyErr error
+	claims := jwtlib.MapClaims{}
+	parser := &jwtlib.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(strings.TrimSpace(proofs[0]), claims, func(t *jwtlib.Token) (interface{}, error) {
+		jwk, keyErr = getDPoPProofKey(t)
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		pubKey, err := jwk.GetPublicKey()
+		if err != nil {
+			keyErr = errors.ErrDPoPProofKeyInvalid.WithArgs(err)
+			return nil, keyErr
+		}
+		return pubKey, nil
+	})
+	if err != nil {
+		if keyErr != nil {
+			return "", keyErr
+		}
+		var ve *jwtlib.ValidationError
+		if stderrors.As(err, &ve) && ve.Errors&jwtlib.ValidationErrorSignatureInvalid != 0 {
+			return "", errors.ErrDPoPProofSignatureInvalid.WithArgs(err)
+		}
+		return "", errors.ErrDPoPProofMalformed.WithArgs(err)
+	}
+
+	if htm, _ := claims["htm"].(string); htm != r.Method {
+		return "", errors.ErrDPoPProofMethodMismatch.WithArgs(htm, r.Method)
+	}
+	reqURL := urlutils.GetCurrentURL(r)
+	htu, _ := claims["htu"].(string)
+	if !isDPoPProofURL(htu, reqURL) {
+		return "", errors.ErrDPoPProofURLMismatch.WithArgs(htu, reqURL)
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return "", errors.ErrDPoPProofIssuedAtNotFound
+	}
+	issuedAt := time.Unix(int64(iat), 0).UTC()
+	now := time.Now()
+	if issuedAt.After(now.Add(d.leeway)) || issuedAt.Before(now.Add(-dpopProofLifetime-d.leeway)) {
+		return "", errors.ErrDPoPProofIssuedAtInvalid.WithArgs(issuedAt.Format(time.RFC3339))
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", errors.ErrDPoPProofTokenIDNotFound
+	}
+	h := sha256.Sum256([]byte(token))
+	if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(h[:]) {
+		return "", errors.ErrDPoPProofTokenHashMismatch
+	}
+
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		return "", errors.ErrDPoPProofKeyInvalid.WithArgs(err)
+	}
+	// The proof is accepted once, until it expires.
+	if !d.addProofID(thumbprint+":"+jti, issuedAt.Add(dpopProofLifetime+d.leeway), now) {
+		return "", errors.ErrDPoPProofReplayed.WithArgs(jti)
+	}
+	return thumbprint, nil
+}
+
+// addProofID records the token id of the proof. It returns false when the
+// token id is already recorded.
+func (d *dpopValidator) addProofID(id string, expiresAt, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.prunedAt) > dpopProofLifetime {
+		for k, v := range d.proofIDs {
+			if v.Before(now) {
+				delete(d.proofIDs, k)
+			}
+		}
+		d.prunedAt = now
+	}
+	if v, exists := d.proofIDs[id]; exists && !v.Before(now) {
+		return false
+	}
+	d.proofIDs[id] = expiresAt
+	return true
+}
+
+// getDPoPProofKey validates the header of DPoP proof and returns the public
+// key embedded in it.
+func getDPoPProofKey(t *jwtlib.Token) (*kms.JSONWebKey, error) {
+	if typ, _ := t.Header["typ"].(string); typ != dpopProofType {
+		return nil, errors.ErrDPoPProofTypeInvalid.WithArgs(typ)
+	}
+	alg, _ := t.Header["alg"].(string)
+	var allowed bool
+	for _, s := range dpopSigningMethods {
+		if alg == s {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, errors.ErrDPoPProofAlgorithmNotAllowed.WithArgs(alg)
+	}
+	m, ok := t.Header["jwk"].(map[string]interface{})
+	if !ok {
+		return nil, errors.ErrDPoPProofKeyNotFound
+	}
+	if _, exists := m["d"]; exists {
+		return nil, errors.ErrDPoPProofKeyPrivate
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.ErrDPoPProofKeyInvalid.WithArgs(err)
+	}
+	jwk := &kms.JSONWebKey{}
+	if err := json.Unmarshal(b, jwk); err != nil {
+		return nil, errors.ErrDPoPProofKeyInvalid.WithArgs(err)
+	}
+	return jwk, nil
+}
+
+// isDPoPProofURL returns true when the "htu" claim of DPoP proof matches the
+// URL of the request, without query and fragment, see RFC 9449, section 4.3.
+func isDPoPProofURL(htu, reqURL string) bool {
+	a, ok := normalizeDPoPURL(htu)
+	if !ok {
+		return false
+	}
+	b, ok := normalizeDPoPURL(reqURL)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+// normalizeDPoPURL returns the absolute URL with lowercase scheme and host,
+// and without default port, query, and fragment.
+func normalizeDPoPURL(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && !(scheme == "https" && port == "443") && !(scheme == "http" && port == "80") {
+		host += ":" + port
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return scheme + "://" + host + path, true
+}
+
+// authorizeProofOfPossession validates the binding of the token to the key
+// of DPoP proof, when the validation is enabled. The tokens bound to a key
+// must be presented with DPoP authorization scheme.
+func (v *TokenValidator) authorizeProofOfPossession(r *http.Request, tokenName, token string, usr *user.User) error {
+	if v.dpop == nil {
+		return nil
+	}
+	jkt := getConfirmationClaim(usr, "jkt")
+	if tokenName != dpopTokenName {
+		if jkt != "" {
+			return errors.ErrValidatorInvalidDPoPToken.WithArgs(errors.ErrDPoPTokenNotPresentedAsDPoP)
+		}
+		return nil
+	}
+	if jkt == "" {
+		return errors.ErrValidatorInvalidDPoPToken.WithArgs(errors.ErrDPoPTokenNotBound)
+	}
+	thumbprint, err := v.dpop.validate(r, token)
+	if err != nil {
+		return errors.ErrValidatorInvalidDPoPProof.WithArgs(err)
+	}
+	if thumbprint != jkt {
+		return errors.ErrValidatorInvalidDPoPToken.WithArgs(errors.ErrDPoPTokenThumbprintMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v4"
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/internal/testutils"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/kms"
+	"github.com/greenpau/caddy-authorize/pkg/options"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+)
+
+type testDPoPKey struct {
+	privateKey *ecdsa.PrivateKey
+	jwk        *kms.JSONWebKey
+	thumbprint string
+}
+
+func newTestDPoPKey(t *testing.T) *testDPoPKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := &kms.JSONWebKey{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(privateKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(privateKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDPoPKey{privateKey: privateKey, jwk: jwk, thumbprint: thumbprint}
+}
+
+// newProof returns DPoP proof for the token signed with the key. The header
+// and the claims of the proof are altered by the provided function.
+func (k *testDPoPKey) newProof(t *testing.T, token string, fn func(map[string]interface{}, jwtlib.MapClaims)) string {
+	h := sha256.Sum256([]byte(token))
+	claims := jwtlib.MapClaims{
+		"htm": "GET",
+		"htu": "https://example.com/protected/path",
+		"iat": time.Now().Unix(),
+		"jti": fmt.Sprintf("%d", time.Now().UnixNano()),
+		"ath": base64.RawURLEncoding.EncodeToString(h[:]),
+	}
+	tkn := jwtlib.NewWithClaims(jwtlib.SigningMethodES256, claims)
+	tkn.Header["typ"] = "dpop+jwt"
+	tkn.Header["jwk"] = k.jwk
+	if fn != nil {
+		fn(tkn.Header, claims)
+	}
+	var signingKey interface{} = k.privateKey
+	if tkn.Header["alg"] == "HS256" {
+		tkn.Method = jwtlib.SigningMethodHS256
+		signingKey = []byte("foobar")
+	}
+	proof, err := tkn.SignedString(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestDPoP(t *testing.T) {
+	ctx := context.Background()
+	ks := testutils.NewTestCryptoKeyStore()
+	opts := options.NewTokenValidatorOptions()
+	opts.ValidateDPoP = true
+	v := NewTokenValidator()
+	if err := v.Configure(ctx, ks.GetKeys(), testutils.NewTestGuestAccessList(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestDPoPKey(t)
+	otherKey := newTestDPoPKey(t)
+
+	newToken := func(jkt string) string {
+		m := testutils.NewTestUser().AsMap()
+		if jkt != "" {
+			m["cnf"] = map[string]interface{}{"jkt": jkt}
+		}
+		usr, err := user.NewUser(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ks.SignToken("access_token", "HS512", usr); err != nil {
+			t.Fatal(err)
+		}
+		return usr.Token
+	}
+	boundToken := newToken(key.thumbprint)
+	unboundToken := newToken("")
+	replayedProof := key.newProof(t, boundToken, func(_ map[string]interface{}, claims jwtlib.MapClaims) {
+		claims["jti"] = "a1"
+	})
+
+	var testcases = []struct {
+		name   string
+		scheme string
+		token  string
+		proofs []string
+		// method is the method of the request, defaults to GET.
+		method    string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:   "valid proof",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{replayedProof},
+		},
+		{
+			name:      "replayed proof",
+			scheme:    "DPoP",
+			token:     boundToken,
+			proofs:    []string{replayedProof},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofReplayed.WithArgs("a1")),
+		},
+		{
+			name:      "proof not found",
+			scheme:    "DPoP",
+			token:     boundToken,
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofNotFound),
+		},
+		{
+			name:      "multiple proofs",
+			scheme:    "DPoP",
+			token:     boundToken,
+			proofs:    []string{key.newProof(t, boundToken, nil), key.newProof(t, boundToken, nil)},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofMultiple),
+		},
+		{
+			name:   "proof with invalid type",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(hdr map[string]interface{}, _ jwtlib.MapClaims) {
+				hdr["typ"] = "JWT"
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofTypeInvalid.WithArgs("JWT")),
+		},
+		{
+			name:   "proof without type",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(hdr map[string]interface{}, _ jwtlib.MapClaims) {
+				delete(hdr, "typ")
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofTypeInvalid.WithArgs("")),
+		},
+		{
+			name:   "proof with symmetric algorithm",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(hdr map[string]interface{}, _ jwtlib.MapClaims) {
+				hdr["alg"] = "HS256"
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofAlgorithmNotAllowed.WithArgs("HS256")),
+		},
+		{
+			name:   "proof without key",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(hdr map[string]interface{}, _ jwtlib.MapClaims) {
+				delete(hdr, "jwk")
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofKeyNotFound),
+		},
+		{
+			name:   "proof signed with another key",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{otherKey.newProof(t, boundToken, func(hdr map[string]interface{}, _ jwtlib.MapClaims) {
+				hdr["jwk"] = key.jwk
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofSignatureInvalid.WithArgs("crypto/ecdsa: verification error")),
+		},
+		{
+			name:      "proof with method mismatch",
+			scheme:    "DPoP",
+			token:     boundToken,
+			proofs:    []string{key.newProof(t, boundToken, nil)},
+			method:    "POST",
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofMethodMismatch.WithArgs("GET", "POST")),
+		},
+		{
+			name:   "proof without method",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(_ map[string]interface{}, claims jwtlib.MapClaims) {
+				delete(claims, "htm")
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofMethodMismatch.WithArgs("", "GET")),
+		},
+		{
+			name:   "proof without url",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(_ map[string]interface{}, claims jwtlib.MapClaims) {
+				delete(claims, "htu")
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofURLMismatch.WithArgs("", "https://example.com/protected/path")),
+		},
+		{
+			name:   "proof with url mismatch",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(_ map[string]interface{}, claims jwtlib.MapClaims) {
+				claims["htu"] = "https://example.com/other/path"
+			})},
+			shouldErr: true,
+			err: errors.ErrValidatorInvalidDPoPProof.WithArgs(
+				errors.ErrDPoPProofURLMismatch.WithArgs("https://example.com/other/path", "https://example.com/protected/path"),
+			),
+		},
+		{
+			name:   "proof with url with default port and query",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(_ map[string]interface{}, claims jwtlib.MapClaims) {
+				claims["htu"] = "HTTPS://Example.com:443/protected/path?foo=bar"
+			})},
+		},
+		{
+			name:   "stale proof",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(_ map[string]interface{}, claims jwtlib.MapClaims) {
+				claims["iat"] = time.Unix(1600000000, 0).Unix()
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofIssuedAtInvalid.WithArgs("2020-09-13T12:26:40Z")),
+		},
+		{
+			name:   "proof without token id",
+			scheme: "DPoP",
+			token:  boundToken,
+			proofs: []string{key.newProof(t, boundToken, func(_ map[string]interface{}, claims jwtlib.MapClaims) {
+				delete(claims, "jti")
+			})},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofTokenIDNotFound),
+		},
+		{
+			name:      "proof for another token",
+			scheme:    "DPoP",
+			token:     boundToken,
+			proofs:    []string{key.newProof(t, unboundToken, nil)},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPProof.WithArgs(errors.ErrDPoPProofTokenHashMismatch),
+		},
+		{
+			name:      "token bound to another key",
+			scheme:    "DPoP",
+			token:     boundToken,
+			proofs:    []string{otherKey.newProof(t, boundToken, nil)},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPToken.WithArgs(errors.ErrDPoPTokenThumbprintMismatch),
+		},
+		{
+			name:      "unbound token with dpop scheme",
+			scheme:    "DPoP",
+			token:     unboundToken,
+			proofs:    []string{key.newProof(t, unboundToken, nil)},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPToken.WithArgs(errors.ErrDPoPTokenNotBound),
+		},
+		{
+			name:      "bound token without dpop scheme",
+			scheme:    "access_token=",
+			token:     boundToken,
+			proofs:    []string{key.newProof(t, boundToken, nil)},
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidDPoPToken.WithArgs(errors.ErrDPoPTokenNotPresentedAsDPoP),
+		},
+		{
+			name:   "unbound token without dpop scheme",
+			scheme: "access_token=",
+			token:  unboundToken,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			method := tc.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, "https://example.com/protected/path?foo=bar", nil)
+			if tc.scheme == "DPoP" {
+				r.Header.Set("Authorization", "DPoP "+tc.token)
+			} else {
+				r.Header.Set("Authorization", tc.scheme+tc.token)
+			}
+			for _, proof := range tc.proofs {
+				r.Header.Add("DPoP", proof)
+			}
+			_, err := v.Authorize(ctx, r)
+			tests.EvalErrWithLog(t, err, "authorize", tc.shouldErr, tc.err, msgs)
+		})
+	}
+}
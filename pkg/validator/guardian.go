@@ -0,0 +1,254 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/greenpau/caddy-authorize/pkg/acl"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/options"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+	addrutils "github.com/greenpau/caddy-authorize/pkg/utils/addr"
+)
+
+// Guardian is a step of the authorization of the requests with valid tokens.
+// The guardians of TokenValidator run in order, and the first error denies
+// the request.
+type Guardian interface {
+	Authorize(context.Context, *http.Request, *user.User) error
+}
+
+// GuardianFunc is an adapter to use a function as Guardian.
+type GuardianFunc func(context.Context, *http.Request, *user.User) error
+
+// Authorize calls f(ctx, r, usr).
+func (f GuardianFunc) Authorize(ctx context.Context, r *http.Request, usr *user.User) error {
+	return f(ctx, r, usr)
+}
+
+// GuardianFactory returns Guardian for the argument of the guardian, e.g.
+// the header name of "tenant:X-Tenant-ID" guardian.
+type GuardianFactory func(arg string) (Guardian, error)
+
+var (
+	guardianFactoriesMu sync.RWMutex
+	guardianFactories   = map[string]GuardianFactory{}
+)
+
+// accessListGuardian evaluates the user against the access list. When the
+// access list is the only guardian and the method and the path of the request
+// are not evaluated, the cached users are allowed, because they were evaluated
+// prior to being cached.
+type accessListGuardian struct {
+	accessList *acl.AccessList
+	methodPath bool
+	skipCached bool
+}
+
+// sourceAddressGuardian validates the source address of the request matches
+// the "addr" claim of the token.
+type sourceAddressGuardian struct{}
+
+// pathClaimGuardian validates the path of the request matches the path-based
+// access list in the "acl" claim of the token.
+type pathClaimGuardian struct{}
+
+// clientCertGuardian validates the binding of the token to the client
+// certificate, i.e. the "x5t#S256" member of the "cnf" claim, see RFC 8705.
+type clientCertGuardian struct{}
+
+// newGuardians returns the built-in guardians enabled by the options.
+func newGuardians(accessList *acl.AccessList, opts *options.TokenValidatorOptions) []Guardian {
+	skipCached := !opts.ValidateMethodPath && !opts.ValidateSourceAddress &&
+		!opts.ValidateAccessListPathClaim && !opts.ValidateClientCertificate
+	guardians := []Guardian{
+		&accessListGuardian{accessList: accessList, methodPath: opts.ValidateMethodPath, skipCached: skipCached},
+	}
+	if opts.ValidateSourceAddress {
+		guardians = append(guardians, &sourceAddressGuardian{})
+	}
+	if opts.ValidateAccessListPathClaim {
+		guardians = append(guardians, &pathClaimGuardian{})
+	}
+	if opts.ValidateClientCertificate {
+		guardians = append(guardians, &clientCertGuardian{})
+	}
+	return guardians
+}
+
+// Authorize authorizes the user with the access list.
+func (g *accessListGuardian) Authorize(ctx context.Context, r *http.Request, usr *user.User) error {
+	if !g.methodPath {
+		if usr.Cached && g.skipCached {
+			return nil
+		}
+		if userAllowed := g.accessList.Allow(ctx, usr.GetData()); !userAllowed {
+			return errors.ErrAccessNotAllowed
+		}
+		return nil
+	}
+	kv := make(map[string]interface{})
+	for k, v := range usr.GetData() {
+		kv[k] = v
+	}
+	kv["method"] = r.Method
+	kv["path"] = r.URL.Path
+	if userAllowed := g.accessList.Allow(ctx, kv); !userAllowed {
+		return errors.ErrAccessNotAllowed
+	}
+	return nil
+}
+
+// Authorize authorizes the source address of the request.
+func (g *sourceAddressGuardian) Authorize(ctx context.Context, r *http.Request, usr *user.User) error {
+	if usr.Claims.Address == "" {
+		return errors.ErrSourceAddressNotFound
+	}
+	reqAddr := addrutils.GetSourceAddress(r)
+	if usr.Claims.Address != reqAddr {
+		return errors.ErrSourceAddressMismatch.WithArgs(usr.Claims.Address, reqAddr)
+	}
+	return nil
+}
+
+// Authorize authorizes the path of the request.
+func (g *pathClaimGuardian) Authorize(ctx context.Context, r *http.Request, usr *user.User) error {
+	if usr.Claims.AccessList == nil {
+		return errors.ErrAccessNotAllowedByPathACL
+	}
+	for path := range usr.Claims.AccessList.Paths {
+		if acl.MatchPathBasedACL(path, r.URL.Path) {
+			return nil
+		}
+	}
+	return errors.ErrAccessNotAllowedByPathACL
+}
+
+// Authorize authorizes the client certificate of the request.
+func (g *clientCertGuardian) Authorize(ctx context.Context, r *http.Request, usr *user.User) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errors.ErrClientCertificateNotFound
+	}
+	tokenThumbprint := getConfirmationClaim(usr, "x5t#S256")
+	if tokenThumbprint == "" {
+		return errors.ErrClientCertificateClaimNotFound
+	}
+	h := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	reqThumbprint := base64.RawURLEncoding.EncodeToString(h[:])
+	if tokenThumbprint != reqThumbprint {
+		return errors.ErrClientCertificateMismatch.WithArgs(tokenThumbprint, reqThumbprint)
+	}
+	return nil
+}
+
+// RegisterGuardian registers the named guardian, e.g. by the plugins
+// extending the authorization. The guardian is enabled by its name,
+// optionally followed by colon and the argument passed to the factory, see
+// SetGuardians.
+func RegisterGuardian(name string, factory GuardianFactory) error {
+	if name == "" || strings.Contains(name, ":") || factory == nil {
+		return errors.ErrInvalidGuardianName.WithArgs(name)
+	}
+	guardianFactoriesMu.Lock()
+	defer guardianFactoriesMu.Unlock()
+	if _, exists := guardianFactories[name]; exists {
+		return errors.ErrGuardianRegistered.WithArgs(name)
+	}
+	guardianFactories[name] = factory
+	return nil
+}
+
+// newRegisteredGuardian returns Guardian for the registered guardian with an
+// optional argument, e.g. "tenant:X-Tenant-ID".
+func newRegisteredGuardian(s string) (Guardian, error) {
+	name, arg := s, ""
+	if i := strings.Index(s, ":"); i > 0 {
+		name, arg = s[:i], s[i+1:]
+	}
+	guardianFactoriesMu.RLock()
+	factory, exists := guardianFactories[name]
+	guardianFactoriesMu.RUnlock()
+	if !exists {
+		return nil, errors.ErrInvalidGuardianName.WithArgs(s)
+	}
+	g, err := factory(arg)
+	if err != nil {
+		return nil, errors.ErrInvalidGuardianConfig.WithArgs(s, err)
+	}
+	if g == nil {
+		return nil, errors.ErrInvalidGuardianConfig.WithArgs(s, errors.ErrValidatorGuardianNil)
+	}
+	return g, nil
+}
+
+// SetGuardians enables the guardians registered by RegisterGuardian. The
+// enabled guardians run in the provided order, after the built-in guardians
+// and prior to the guardians added by AddGuardian.
+func (v *TokenValidator) SetGuardians(arr []string) error {
+	m := make(map[string]bool)
+	var guardians []Guardian
+	for _, s := range arr {
+		s = strings.TrimSpace(s)
+		if _, exists := m[s]; exists {
+			return errors.ErrDuplicateGuardianName.WithArgs(s)
+		}
+		m[s] = true
+		g, err := newRegisteredGuardian(s)
+		if err != nil {
+			return err
+		}
+		guardians = append(guardians, g)
+	}
+	v.registeredGuardians = guardians
+	return nil
+}
+
+// AddGuardian adds the guardian to TokenValidator. The added guardians run
+// in the order they are added, after the built-in guardians, i.e. the access
+// list, the source address, the path-based access list claim, and the client
+// certificate, and after the guardians enabled by SetGuardians.
+func (v *TokenValidator) AddGuardian(g Guardian) error {
+	if g == nil {
+		return errors.ErrValidatorGuardianNil
+	}
+	v.customGuardians = append(v.customGuardians, g)
+	return nil
+}
+
+// authorizeGuardians runs the guardians of TokenValidator.
+func (v *TokenValidator) authorizeGuardians(ctx context.Context, r *http.Request, usr *user.User) error {
+	for _, g := range v.guardians {
+		if err := g.Authorize(ctx, r, usr); err != nil {
+			return err
+		}
+	}
+	for _, g := range v.registeredGuardians {
+		if err := g.Authorize(ctx, r, usr); err != nil {
+			return err
+		}
+	}
+	for _, g := range v.customGuardians {
+		if err := g.Authorize(ctx, r, usr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
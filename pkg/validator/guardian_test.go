@@ -0,0 +1,290 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/internal/testutils"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/options"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+)
+
+func TestAddGuardian(t *testing.T) {
+	ctx := context.Background()
+	ks := testutils.NewTestCryptoKeyStore()
+	opts := options.NewTokenValidatorOptions()
+	opts.ValidateMethodPath = true
+	v := NewTokenValidator()
+	if err := v.Configure(ctx, ks.GetKeys(), testutils.NewTestGuestAccessList(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	errTenantMismatch := fmt.Errorf("tenant mismatch")
+	if err := v.AddGuardian(GuardianFunc(func(ctx context.Context, r *http.Request, usr *user.User) error {
+		calls = append(calls, "tenant")
+		if r.Header.Get("X-Tenant") != "acme" {
+			return errTenantMismatch
+		}
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.AddGuardian(GuardianFunc(func(ctx context.Context, r *http.Request, usr *user.User) error {
+		calls = append(calls, "audit")
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	usr := testutils.NewTestUser()
+	if err := ks.SignToken("access_token", "HS512", usr); err != nil {
+		t.Fatal(err)
+	}
+	deniedUsr, err := user.NewUser(map[string]interface{}{
+		"exp":   time.Now().Add(10 * time.Minute).Unix(),
+		"sub":   "jsmith@example.com",
+		"roles": []string{"viewer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.SignToken("access_token", "HS512", deniedUsr); err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name      string
+		token     string
+		tenant    string
+		want      []string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:   "request allowed by all guardians",
+			token:  usr.Token,
+			tenant: "acme",
+			want:   []string{"tenant", "audit"},
+		},
+		{
+			name:      "request denied by custom guardian",
+			token:     usr.Token,
+			tenant:    "contoso",
+			want:      []string{"tenant"},
+			shouldErr: true,
+			err:       errTenantMismatch,
+		},
+		{
+			name:      "request denied by access list prior to custom guardians",
+			token:     deniedUsr.Token,
+			tenant:    "acme",
+			shouldErr: true,
+			err:       errors.ErrAccessNotAllowed,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			calls = nil
+			r := httptest.NewRequest("GET", "/protected/path", nil)
+			r.Header.Set("Authorization", "access_token="+tc.token)
+			r.Header.Set("X-Tenant", tc.tenant)
+			_, err := v.Authorize(ctx, r)
+			tests.EvalErrWithLog(t, err, "authorize", tc.shouldErr, tc.err, msgs)
+			tests.EvalObjectsWithLog(t, "calls", tc.want, calls, msgs)
+		})
+	}
+
+	if err := v.AddGuardian(nil); err == nil {
+		t.Fatalf("expected error when adding nil guardian")
+	}
+}
+
+func TestRegisterGuardian(t *testing.T) {
+	ctx := context.Background()
+	ks := testutils.NewTestCryptoKeyStore()
+	v := NewTokenValidator()
+	if err := v.Configure(ctx, ks.GetKeys(), testutils.NewTestGuestAccessList(), options.NewTokenValidatorOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	errTenantMismatch := fmt.Errorf("tenant mismatch")
+	errTenantNotFound := fmt.Errorf("tenant not found")
+	if err := RegisterGuardian("test_tenant", func(arg string) (Guardian, error) {
+		if arg == "" {
+			return nil, errTenantNotFound
+		}
+		return GuardianFunc(func(ctx context.Context, r *http.Request, usr *user.User) error {
+			if r.Header.Get("X-Tenant") != arg {
+				return errTenantMismatch
+			}
+			return nil
+		}), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var registerTestcases = []struct {
+		name      string
+		guardian  string
+		factory   GuardianFactory
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:     "register guardian with the name of registered guardian",
+			guardian: "test_tenant",
+			factory: func(arg string) (Guardian, error) {
+				return nil, nil
+			},
+			shouldErr: true,
+			err:       errors.ErrGuardianRegistered.WithArgs("test_tenant"),
+		},
+		{
+			name:     "register guardian with colon in name",
+			guardian: "test:tenant",
+			factory: func(arg string) (Guardian, error) {
+				return nil, nil
+			},
+			shouldErr: true,
+			err:       errors.ErrInvalidGuardianName.WithArgs("test:tenant"),
+		},
+		{
+			name:      "register guardian without factory",
+			guardian:  "test_foobar",
+			shouldErr: true,
+			err:       errors.ErrInvalidGuardianName.WithArgs("test_foobar"),
+		},
+	}
+	for _, tc := range registerTestcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			err := RegisterGuardian(tc.guardian, tc.factory)
+			tests.EvalErrWithLog(t, err, "register guardian", tc.shouldErr, tc.err, msgs)
+		})
+	}
+
+	var setTestcases = []struct {
+		name      string
+		guardians []string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:      "enable unregistered guardian",
+			guardians: []string{"foobar"},
+			shouldErr: true,
+			err:       errors.ErrInvalidGuardianName.WithArgs("foobar"),
+		},
+		{
+			name:      "enable duplicate guardian",
+			guardians: []string{"test_tenant:acme", "test_tenant:acme"},
+			shouldErr: true,
+			err:       errors.ErrDuplicateGuardianName.WithArgs("test_tenant:acme"),
+		},
+		{
+			name:      "enable guardian with invalid argument",
+			guardians: []string{"test_tenant"},
+			shouldErr: true,
+			err:       errors.ErrInvalidGuardianConfig.WithArgs("test_tenant", errTenantNotFound),
+		},
+		{
+			name:      "enable registered guardian",
+			guardians: []string{"test_tenant:acme"},
+		},
+	}
+	for _, tc := range setTestcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			err := v.SetGuardians(tc.guardians)
+			tests.EvalErrWithLog(t, err, "set guardians", tc.shouldErr, tc.err, msgs)
+		})
+	}
+
+	usr := testutils.NewTestUser()
+	if err := ks.SignToken("access_token", "HS512", usr); err != nil {
+		t.Fatal(err)
+	}
+	for _, tenant := range []string{"acme", "contoso"} {
+		r := httptest.NewRequest("GET", "/protected/path", nil)
+		r.Header.Set("Authorization", "access_token="+usr.Token)
+		r.Header.Set("X-Tenant", tenant)
+		_, err := v.Authorize(ctx, r)
+		tests.EvalErrWithLog(t, err, "authorize tenant "+tenant, tenant != "acme", errTenantMismatch, nil)
+	}
+}
+
+func TestCachedUserGuardians(t *testing.T) {
+	ctx := context.Background()
+	ks := testutils.NewTestCryptoKeyStore()
+
+	var testcases = []struct {
+		name                  string
+		validateSourceAddress bool
+		shouldErr             bool
+		err                   error
+	}{
+		{
+			name: "cached user with access list only",
+		},
+		{
+			name:                  "cached user with source address guardian",
+			validateSourceAddress: true,
+			shouldErr:             true,
+			err:                   errors.ErrAccessNotAllowed,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			opts := options.NewTokenValidatorOptions()
+			opts.ValidateSourceAddress = tc.validateSourceAddress
+			v := NewTokenValidator()
+			if err := v.Configure(ctx, ks.GetKeys(), testutils.NewTestGuestAccessList(), opts); err != nil {
+				t.Fatal(err)
+			}
+			// The user is denied by the access list, but it is in the cache.
+			usr, err := user.NewUser(map[string]interface{}{
+				"exp":   time.Now().Add(10 * time.Minute).Unix(),
+				"sub":   "jsmith@example.com",
+				"roles": []string{"viewer"},
+				"addr":  "10.10.10.10",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ks.SignToken("access_token", "HS512", usr); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.CacheUser(usr); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/protected/path", nil)
+			r.RemoteAddr = "10.10.10.10:51234"
+			r.Header.Set("Authorization", "access_token="+usr.Token)
+			_, err = v.Authorize(ctx, r)
+			tests.EvalErrWithLog(t, err, "authorize", tc.shouldErr, tc.err, msgs)
+		})
+	}
+}
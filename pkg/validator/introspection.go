@@ -0,0 +1,166 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+)
+
+const (
+	defaultIntrospectionCacheTTL = 60
+	defaultIntrospectionTimeout  = 5 * time.Second
+	maxIntrospectionResponseSize = 1 << 20
+)
+
+// IntrospectionConfig is the configuration of OAuth 2.0 Token Introspection,
+// see RFC 7662. The tokens other than JWT, JWE, and PASETO, i.e. opaque
+// tokens, and the tokens with the configured names are sent to the
+// introspection endpoint.
+type IntrospectionConfig struct {
+	EndpointURL  string `json:"endpoint_url,omitempty" xml:"endpoint_url,omitempty" yaml:"endpoint_url,omitempty"`
+	ClientID     string `json:"client_id,omitempty" xml:"client_id,omitempty" yaml:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty" xml:"client_secret,omitempty" yaml:"client_secret,omitempty"`
+	// TokenNames are the names of the tokens introspected regardless of
+	// their format.
+	TokenNames []string `json:"token_names,omitempty" xml:"token_names,omitempty" yaml:"token_names,omitempty"`
+	// CacheTTL is the max number of seconds the introspection result is
+	// cached. The result is not cached beyond the expiry of the token.
+	CacheTTL int `json:"cache_ttl,omitempty" xml:"cache_ttl,omitempty" yaml:"cache_ttl,omitempty"`
+}
+
+type introspector struct {
+	config     *IntrospectionConfig
+	tokenNames map[string]bool
+	client     *http.Client
+}
+
+// Validate validates introspection config and sets its defaults.
+func (cfg *IntrospectionConfig) Validate() error {
+	if cfg.EndpointURL == "" {
+		return errors.ErrIntrospectionEndpointNotFound
+	}
+	u, err := url.Parse(cfg.EndpointURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.ErrIntrospectionEndpointInvalid.WithArgs(cfg.EndpointURL)
+	}
+	if cfg.ClientID != "" && cfg.ClientSecret == "" {
+		return errors.ErrIntrospectionClientSecretNotFound.WithArgs(cfg.ClientID)
+	}
+	if cfg.CacheTTL < 0 {
+		return errors.ErrIntrospectionCacheTTLInvalid.WithArgs(cfg.CacheTTL)
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = defaultIntrospectionCacheTTL
+	}
+	return nil
+}
+
+func newIntrospector(cfg *IntrospectionConfig) (*introspector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	i := &introspector{
+		config:     cfg,
+		tokenNames: make(map[string]bool),
+		client:     &http.Client{Timeout: defaultIntrospectionTimeout},
+	}
+	for _, name := range cfg.TokenNames {
+		i.tokenNames[name] = true
+	}
+	return i, nil
+}
+
+// matches returns true when the token is to be introspected, i.e. it has
+// one of the configured names, or it is an opaque token.
+func (i *introspector) matches(tokenName, token string) bool {
+	if i.tokenNames[tokenName] {
+		return true
+	}
+	if strings.HasPrefix(token, "v4.") {
+		return false
+	}
+	switch strings.Count(token, ".") {
+	case 2, 4:
+		return false
+	}
+	return true
+}
+
+// introspect sends the token to the introspection endpoint and returns the
+// user built from the response, together with the time the user may be
+// cached until.
+func (i *introspector) introspect(ctx context.Context, token string) (*user.User, int64, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequestWithContext(ctx, "POST", i.config.EndpointURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, errors.ErrIntrospectionRequestFailed.WithArgs(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.config.ClientID), url.QueryEscape(i.config.ClientSecret))
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, 0, errors.ErrIntrospectionRequestFailed.WithArgs(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.ErrIntrospectionResponseStatus.WithArgs(resp.Status)
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxIntrospectionResponseSize))
+	if err != nil {
+		return nil, 0, errors.ErrIntrospectionRequestFailed.WithArgs(err)
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, 0, errors.ErrIntrospectionResponseMalformed.WithArgs(err)
+	}
+	if active, _ := m["active"].(bool); !active {
+		return nil, 0, errors.ErrIntrospectionTokenInactive
+	}
+	delete(m, "active")
+
+	now := time.Now().Unix()
+	expiresAt := now + int64(i.config.CacheTTL)
+	if v, exists := m["exp"]; exists {
+		exp, ok := v.(float64)
+		if !ok {
+			return nil, 0, errors.ErrIntrospectionResponseMalformed.WithArgs("exp is not numeric")
+		}
+		if int64(exp) <= now {
+			return nil, 0, errors.ErrIntrospectionTokenExpired
+		}
+		if int64(exp) < expiresAt {
+			expiresAt = int64(exp)
+		}
+	}
+	usr, err := user.NewUser(m)
+	if err != nil {
+		return nil, 0, errors.ErrIntrospectionResponseMalformed.WithArgs(err)
+	}
+	return usr, expiresAt, nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/internal/testutils"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/options"
+)
+
+func TestIntrospection(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	responses := map[string]interface{}{
+		"active-token": map[string]interface{}{
+			"active":    true,
+			"sub":       "svc-billing",
+			"client_id": "billing",
+			"scope":     "read write",
+			"roles":     []string{"guest"},
+			"exp":       time.Now().Add(10 * time.Minute).Unix(),
+		},
+		"no-expiry-token": map[string]interface{}{
+			"active": true,
+			"sub":    "svc-billing",
+			"roles":  []string{"guest"},
+		},
+		"partner.jwt.token": map[string]interface{}{
+			"active": true,
+			"sub":    "svc-partner",
+			"roles":  []string{"guest"},
+			"exp":    time.Now().Add(10 * time.Minute).Unix(),
+		},
+		"denied-token": map[string]interface{}{
+			"active": true,
+			"sub":    "svc-billing",
+			"roles":  []string{"admin"},
+			"exp":    time.Now().Add(10 * time.Minute).Unix(),
+		},
+		"inactive-token": map[string]interface{}{
+			"active": false,
+		},
+		"expired-token": map[string]interface{}{
+			"active": true,
+			"sub":    "svc-billing",
+			"exp":    time.Now().Add(-10 * time.Minute).Unix(),
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The client credentials are form-encoded, see RFC 6749, section 2.3.1.
+		clientID, clientSecret, ok := r.BasicAuth()
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+		if r.Method != "POST" || !ok || clientID != "authorize" || clientSecret != "foo:bar" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token := r.PostFormValue("token")
+		mu.Lock()
+		requests[token]++
+		mu.Unlock()
+		switch token {
+		case "malformed-token":
+			w.Write([]byte(`{"active":`))
+			return
+		case "error-token":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp, exists := responses[token]
+		if !exists {
+			resp = map[string]interface{}{"active": false}
+		}
+		b, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	v := NewTokenValidator()
+	if err := v.Configure(ctx, testutils.NewTestCryptoKeyStore().GetKeys(), testutils.NewTestGuestAccessList(), options.NewTokenValidatorOptions()); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &IntrospectionConfig{
+		EndpointURL:  srv.URL,
+		ClientID:     "authorize",
+		ClientSecret: "foo:bar",
+		TokenNames:   []string{"partner_token"},
+	}
+	if err := v.RegisterIntrospectionEndpoint(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name      string
+		tokenName string
+		token     string
+		want      map[string]interface{}
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:      "active opaque token",
+			tokenName: "access_token",
+			token:     "active-token",
+			want: map[string]interface{}{
+				"sub":      "svc-billing",
+				"scopes":   []string{"read", "write"},
+				"requests": 1,
+				"cached":   true,
+			},
+		},
+		{
+			name:      "cached opaque token",
+			tokenName: "access_token",
+			token:     "active-token",
+			want: map[string]interface{}{
+				"sub":      "svc-billing",
+				"scopes":   []string{"read", "write"},
+				"requests": 1,
+				"cached":   true,
+			},
+		},
+		{
+			name:      "active opaque token without expiry",
+			tokenName: "access_token",
+			token:     "no-expiry-token",
+			want: map[string]interface{}{
+				"sub":      "svc-billing",
+				"scopes":   []string(nil),
+				"requests": 1,
+				"cached":   true,
+			},
+		},
+		{
+			name:      "token introspected per token name",
+			tokenName: "partner_token",
+			token:     "partner.jwt.token",
+			want: map[string]interface{}{
+				"sub":      "svc-partner",
+				"scopes":   []string(nil),
+				"requests": 1,
+				"cached":   true,
+			},
+		},
+		{
+			name:      "active opaque token denied by access list",
+			tokenName: "access_token",
+			token:     "denied-token",
+			shouldErr: true,
+			err:       errors.ErrAccessNotAllowed,
+		},
+		{
+			name:      "inactive opaque token",
+			tokenName: "access_token",
+			token:     "inactive-token",
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidToken.WithArgs(errors.ErrIntrospectionTokenInactive),
+		},
+		{
+			name:      "expired opaque token",
+			tokenName: "access_token",
+			token:     "expired-token",
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidToken.WithArgs(errors.ErrIntrospectionTokenExpired),
+		},
+		{
+			name:      "malformed introspection response",
+			tokenName: "access_token",
+			token:     "malformed-token",
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidToken.WithArgs(errors.ErrIntrospectionResponseMalformed.WithArgs("unexpected end of JSON input")),
+		},
+		{
+			name:      "introspection endpoint error",
+			tokenName: "access_token",
+			token:     "error-token",
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidToken.WithArgs(errors.ErrIntrospectionResponseStatus.WithArgs("500 Internal Server Error")),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			r := httptest.NewRequest("GET", "/protected/path", nil)
+			r.Header.Set("Authorization", tc.tokenName+"="+tc.token)
+			usr, err := v.Authorize(ctx, r)
+			if tests.EvalErrWithLog(t, err, "authorize", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			got := map[string]interface{}{
+				"sub":      usr.Claims.Subject,
+				"scopes":   usr.Claims.Scopes,
+				"requests": requests[tc.token],
+				"cached":   v.cache.Get(tc.token) != nil,
+			}
+			tests.EvalObjectsWithLog(t, "user", tc.want, got, msgs)
+		})
+	}
+}
+
+func TestIntrospectionConfig(t *testing.T) {
+	var testcases = []struct {
+		name      string
+		config    *IntrospectionConfig
+		want      int
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "config with default cache ttl",
+			config: &IntrospectionConfig{
+				EndpointURL: "https://auth.example.com/oauth2/introspect",
+			},
+			want: defaultIntrospectionCacheTTL,
+		},
+		{
+			name:      "config without endpoint",
+			config:    &IntrospectionConfig{},
+			shouldErr: true,
+			err:       errors.ErrIntrospectionEndpointNotFound,
+		},
+		{
+			name: "config with invalid endpoint",
+			config: &IntrospectionConfig{
+				EndpointURL: "/oauth2/introspect",
+			},
+			shouldErr: true,
+			err:       errors.ErrIntrospectionEndpointInvalid.WithArgs("/oauth2/introspect"),
+		},
+		{
+			name: "config with negative cache ttl",
+			config: &IntrospectionConfig{
+				EndpointURL: "https://auth.example.com/oauth2/introspect",
+				CacheTTL:    -1,
+			},
+			shouldErr: true,
+			err:       errors.ErrIntrospectionCacheTTLInvalid.WithArgs(-1),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			err := tc.config.Validate()
+			if tests.EvalErrWithLog(t, err, "config", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			tests.EvalObjectsWithLog(t, "cache ttl", tc.want, tc.config.CacheTTL, msgs)
+		})
+	}
+}
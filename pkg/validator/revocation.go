@@ -0,0 +1,334 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRevocationRefreshInterval = 30
+)
+
+// RevocationConfig is the configuration of the token revocation list. The
+// revoked tokens are loaded from the file, when provided, and pushed via the
+// admin endpoint, see RevocationList.Revoke.
+type RevocationConfig struct {
+	// FilePath is the path to JSON file with the list of revoked tokens.
+	FilePath string `json:"file_path,omitempty" xml:"file_path,omitempty" yaml:"file_path,omitempty"`
+	// RefreshInterval is the min number of seconds between the checks of
+	// the file for changes.
+	RefreshInterval int `json:"refresh_interval,omitempty" xml:"refresh_interval,omitempty" yaml:"refresh_interval,omitempty"`
+}
+
+// RevokedToken identifies the revoked tokens by their token id, i.e. "jti"
+// claim, by their subject, i.e. "sub" claim, or by the hex-encoded SHA256
+// hash of the token. The entry is dropped after its expiry, when provided.
+type RevokedToken struct {
+	TokenID   string `json:"token_id,omitempty" xml:"token_id,omitempty" yaml:"token_id,omitempty"`
+	Subject   string `json:"subject,omitempty" xml:"subject,omitempty" yaml:"subject,omitempty"`
+	TokenHash string `json:"token_hash,omitempty" xml:"token_hash,omitempty" yaml:"token_hash,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty" xml:"expires_at,omitempty" yaml:"expires_at,omitempty"`
+}
+
+// RevocationList holds the revoked tokens. The file with the revoked tokens
+// is checked for changes, at most once per refresh interval, when the list
+// is being consulted. The subscribers, i.e. token validators, are notified
+// about the newly revoked tokens to evict them from their caches.
+type RevocationList struct {
+	mu     sync.RWMutex
+	config *RevocationConfig
+	// fileEntries are the entries loaded from the file, and pushedEntries
+	// are the entries added via Revoke.
+	fileEntries   []*RevokedToken
+	pushedEntries []*RevokedToken
+	// The indexes of the entries, with the expiry of the entries.
+	tokenIDs    map[string]int64
+	subjects    map[string]int64
+	tokenHashes map[string]int64
+	// digest is the digest of the content of the file.
+	digest string
+	// checkedAt is the time of the last check for changes.
+	checkedAt   time.Time
+	interval    time.Duration
+	subscribers []func([]*RevokedToken)
+	logger      *zap.Logger
+}
+
+// Validate validates revocation config and sets its defaults.
+func (cfg *RevocationConfig) Validate() error {
+	if cfg.FilePath == "" {
+		return errors.ErrRevocationFilePathNotFound
+	}
+	if cfg.RefreshInterval < 0 {
+		return errors.ErrRevocationRefreshIntervalInvalid.WithArgs(cfg.RefreshInterval)
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = defaultRevocationRefreshInterval
+	}
+	return nil
+}
+
+// Validate validates the revoked token entry.
+func (e *RevokedToken) Validate() error {
+	if e == nil || (e.TokenID == "" && e.Subject == "" && e.TokenHash == "") {
+		return errors.ErrRevocationEntryEmpty
+	}
+	return nil
+}
+
+// NewRevocationList returns an instance of RevocationList. When the config
+// is nil, the list holds the pushed entries only. The initial set of entries
+// is loaded from the file synchronously.
+func NewRevocationList(cfg *RevocationConfig) (*RevocationList, error) {
+	l := &RevocationList{
+		config: cfg,
+		logger: zap.NewNop(),
+	}
+	if cfg != nil {
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		l.interval = time.Duration(cfg.RefreshInterval) * time.Second
+	}
+	if l.hasFile() {
+		digest, entries, err := l.load()
+		if err != nil {
+			return nil, err
+		}
+		l.digest = digest
+		l.fileEntries = entries
+		l.checkedAt = time.Now()
+	}
+	l.reindex(time.Now())
+	return l, nil
+}
+
+// SetLogger adds a logger to RevocationList.
+func (l *RevocationList) SetLogger(logger *zap.Logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger = logger
+}
+
+// Revoke adds the revoked tokens to the list.
+func (l *RevocationList) Revoke(entries []*RevokedToken) error {
+	for _, e := range entries {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	l.pushedEntries = append(l.pushedEntries, entries...)
+	l.reindex(time.Now())
+	subscribers := l.subscribers
+	l.mu.Unlock()
+	for _, fn := range subscribers {
+		fn(entries)
+	}
+	return nil
+}
+
+// GetRevokedTokens returns the unexpired revoked tokens.
+func (l *RevocationList) GetRevokedTokens() []*RevokedToken {
+	l.refresh()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	now := time.Now().Unix()
+	entries := []*RevokedToken{}
+	for _, arr := range [][]*RevokedToken{l.fileEntries, l.pushedEntries} {
+		for _, e := range arr {
+			if e.ExpiresAt > 0 && e.ExpiresAt < now {
+				continue
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (l *RevocationList) subscribe(fn func([]*RevokedToken)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers = append(l.subscribers, fn)
+}
+
+func (l *RevocationList) hasFile() bool {
+	return l.config != nil && l.config.FilePath != ""
+}
+
+// load reads the entries from the file.
+func (l *RevocationList) load() (string, []*RevokedToken, error) {
+	b, err := ioutil.ReadFile(l.config.FilePath)
+	if err != nil {
+		return "", nil, errors.ErrRevocationFileRead.WithArgs(l.config.FilePath, err)
+	}
+	h := sha256.Sum256(b)
+	entries := []*RevokedToken{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return "", nil, errors.ErrRevocationFileMalformed.WithArgs(l.config.FilePath, err)
+	}
+	for _, e := range entries {
+		if err := e.Validate(); err != nil {
+			return "", nil, errors.ErrRevocationFileMalformed.WithArgs(l.config.FilePath, err)
+		}
+	}
+	return hex.EncodeToString(h[:]), entries, nil
+}
+
+// reindex rebuilds the indexes of the entries and drops the expired ones.
+// The caller holds the lock.
+func (l *RevocationList) reindex(now time.Time) {
+	l.tokenIDs = make(map[string]int64)
+	l.subjects = make(map[string]int64)
+	l.tokenHashes = make(map[string]int64)
+	var pushedEntries []*RevokedToken
+	for _, e := range l.pushedEntries {
+		if e.ExpiresAt > 0 && e.ExpiresAt < now.Unix() {
+			continue
+		}
+		pushedEntries = append(pushedEntries, e)
+	}
+	l.pushedEntries = pushedEntries
+	for _, arr := range [][]*RevokedToken{l.fileEntries, l.pushedEntries} {
+		for _, e := range arr {
+			addRevocationIndex(l.tokenIDs, e.TokenID, e.ExpiresAt)
+			addRevocationIndex(l.subjects, e.Subject, e.ExpiresAt)
+			addRevocationIndex(l.tokenHashes, strings.ToLower(e.TokenHash), e.ExpiresAt)
+		}
+	}
+}
+
+func addRevocationIndex(m map[string]int64, k string, expiresAt int64) {
+	if k == "" {
+		return
+	}
+	if prev, exists := m[k]; exists && (prev == 0 || (expiresAt != 0 && prev > expiresAt)) {
+		return
+	}
+	m[k] = expiresAt
+}
+
+// refresh checks the file for changes, unless it was checked within the
+// refresh interval. When the content changed, the entries are reloaded and
+// the subscribers are notified. When the reload fails, the current entries
+// remain and the reload is retried after the refresh interval. The file is
+// read without holding the lock, i.e. the concurrent checks use the current
+// entries while the file is being reloaded.
+func (l *RevocationList) refresh() {
+	if !l.hasFile() {
+		return
+	}
+	now := time.Now()
+	l.mu.RLock()
+	checkedAt := l.checkedAt
+	l.mu.RUnlock()
+	if now.Sub(checkedAt) < l.interval {
+		return
+	}
+
+	l.mu.Lock()
+	if now.Sub(l.checkedAt) < l.interval {
+		l.mu.Unlock()
+		return
+	}
+	l.checkedAt = now
+	logger := l.logger
+	l.mu.Unlock()
+
+	digest, entries, err := l.load()
+	if err != nil {
+		logger.Error("failed reloading revoked tokens", zap.String("path", l.config.FilePath), zap.Error(err))
+		return
+	}
+
+	l.mu.Lock()
+	if digest == l.digest {
+		l.reindex(now)
+		l.mu.Unlock()
+		return
+	}
+	l.digest = digest
+	l.fileEntries = entries
+	l.reindex(now)
+	subscribers := l.subscribers
+	l.mu.Unlock()
+	logger.Info("revoked tokens reloaded", zap.String("path", l.config.FilePath), zap.Int("entry_count", len(entries)))
+	for _, fn := range subscribers {
+		fn(entries)
+	}
+}
+
+// isTokenRevoked returns true when the hash of the token is revoked.
+func (l *RevocationList) isTokenRevoked(token string) bool {
+	l.refresh()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.tokenHashes) == 0 {
+		return false
+	}
+	return isRevoked(l.tokenHashes, getTokenHash(token))
+}
+
+// isUserRevoked returns true when the token id or the subject of the user is
+// revoked.
+func (l *RevocationList) isUserRevoked(usr *user.User) bool {
+	l.refresh()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return isRevoked(l.tokenIDs, usr.Claims.ID) || isRevoked(l.subjects, usr.Claims.Subject)
+}
+
+func isRevoked(m map[string]int64, k string) bool {
+	if k == "" {
+		return false
+	}
+	expiresAt, exists := m[k]
+	if !exists {
+		return false
+	}
+	return expiresAt == 0 || expiresAt >= time.Now().Unix()
+}
+
+// matches returns true when the entry revokes the token of the user.
+func (e *RevokedToken) matches(token string, usr *user.User) bool {
+	if e.ExpiresAt > 0 && e.ExpiresAt < time.Now().Unix() {
+		return false
+	}
+	switch {
+	case e.TokenID != "" && e.TokenID == usr.Claims.ID:
+		return true
+	case e.Subject != "" && e.Subject == usr.Claims.Subject:
+		return true
+	case e.TokenHash != "" && strings.EqualFold(e.TokenHash, getTokenHash(token)):
+		return true
+	}
+	return false
+}
+
+func getTokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
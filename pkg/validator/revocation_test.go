@@ -0,0 +1,232 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/greenpau/caddy-authorize/internal/tests"
+	"github.com/greenpau/caddy-authorize/internal/testutils"
+	"github.com/greenpau/caddy-authorize/pkg/errors"
+	"github.com/greenpau/caddy-authorize/pkg/options"
+	"github.com/greenpau/caddy-authorize/pkg/user"
+)
+
+func TestRevocationList(t *testing.T) {
+	ctx := context.Background()
+	fp := filepath.Join(t.TempDir(), "revoked_tokens.json")
+	if err := ioutil.WriteFile(fp, []byte(`[{"subject": "revoked@example.com"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	revocations, err := NewRevocationList(&RevocationConfig{FilePath: fp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := testutils.NewTestCryptoKeyStore()
+	v := NewTokenValidator()
+	if err := v.Configure(ctx, ks.GetKeys(), testutils.NewTestGuestAccessList(), options.NewTokenValidatorOptions()); err != nil {
+		t.Fatal(err)
+	}
+	v.SetRevocationList(revocations)
+
+	newToken := func(jti, sub string) string {
+		usr := testutils.NewTestUser()
+		m := usr.AsMap()
+		m["jti"] = jti
+		m["sub"] = sub
+		usr, err := user.NewUser(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ks.SignToken("access_token", "HS512", usr); err != nil {
+			t.Fatal(err)
+		}
+		return usr.Token
+	}
+	authorize := func(token string) (*user.User, error) {
+		r := httptest.NewRequest("GET", "/protected/path", nil)
+		r.Header.Set("Authorization", "access_token="+token)
+		return v.Authorize(ctx, r)
+	}
+
+	hashedToken := newToken("a4", "jsmith@example.com")
+
+	var testcases = []struct {
+		name  string
+		token string
+		// revoke holds the revoked tokens pushed after the token is cached.
+		revoke []*RevokedToken
+		// file holds the content of the file replaced after the token is
+		// cached.
+		file      string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:  "token not revoked",
+			token: newToken("a1", "jsmith@example.com"),
+		},
+		{
+			name:      "token revoked by subject in file",
+			token:     newToken("a2", "revoked@example.com"),
+			shouldErr: true,
+			err:       errors.ErrValidatorTokenRevoked,
+		},
+		{
+			name:      "cached token revoked by token id",
+			token:     newToken("a3", "jsmith@example.com"),
+			revoke:    []*RevokedToken{{TokenID: "a3"}},
+			shouldErr: true,
+			err:       errors.ErrValidatorTokenRevoked,
+		},
+		{
+			name:      "cached token revoked by token hash",
+			token:     hashedToken,
+			revoke:    []*RevokedToken{{TokenHash: strings.ToUpper(getTokenHash(hashedToken))}},
+			shouldErr: true,
+			err:       errors.ErrValidatorTokenRevoked,
+		},
+		{
+			name:   "cached token revoked by expired entry",
+			token:  newToken("a5", "jsmith@example.com"),
+			revoke: []*RevokedToken{{TokenID: "a5", ExpiresAt: time.Now().Add(-time.Minute).Unix()}},
+		},
+		{
+			name:      "cached token revoked by subject in reloaded file",
+			token:     newToken("a6", "jdoe@example.com"),
+			file:      `[{"subject": "revoked@example.com"}, {"subject": "jdoe@example.com"}]`,
+			shouldErr: true,
+			err:       errors.ErrValidatorTokenRevoked,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			usr, err := authorize(tc.token)
+			if tc.revoke == nil && tc.file == "" {
+				tests.EvalErrWithLog(t, err, "authorize", tc.shouldErr, tc.err, msgs)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := v.CacheUser(usr); err != nil {
+				t.Fatal(err)
+			}
+			if tc.revoke != nil {
+				if err := revocations.Revoke(tc.revoke); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.file != "" {
+				if err := ioutil.WriteFile(fp, []byte(tc.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				revocations.mu.Lock()
+				revocations.checkedAt = time.Time{}
+				revocations.mu.Unlock()
+				revocations.refresh()
+			}
+			tests.EvalObjectsWithLog(t, "cached", !tc.shouldErr, v.cache.Get(tc.token) != nil, msgs)
+			_, err = authorize(tc.token)
+			tests.EvalErrWithLog(t, err, "authorize", tc.shouldErr, tc.err, msgs)
+		})
+	}
+}
+
+func TestNewRevocationList(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"valid.json":       `[{"token_id": "a1", "expires_at": 1}, {"subject": "jsmith@example.com"}]`,
+		"malformed.json":   `{"token_id": "a1"}`,
+		"empty_entry.json": `[{"expires_at": 1}]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var testcases = []struct {
+		name      string
+		config    *RevocationConfig
+		want      int
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "list without file",
+		},
+		{
+			name:   "list with file",
+			config: &RevocationConfig{FilePath: filepath.Join(dir, "valid.json")},
+			want:   1,
+		},
+		{
+			name:      "config without file",
+			config:    &RevocationConfig{},
+			shouldErr: true,
+			err:       errors.ErrRevocationFilePathNotFound,
+		},
+		{
+			name: "config with negative refresh interval",
+			config: &RevocationConfig{
+				FilePath:        filepath.Join(dir, "valid.json"),
+				RefreshInterval: -1,
+			},
+			shouldErr: true,
+			err:       errors.ErrRevocationRefreshIntervalInvalid.WithArgs(-1),
+		},
+		{
+			name:      "file not found",
+			config:    &RevocationConfig{FilePath: filepath.Join(dir, "foo.json")},
+			shouldErr: true,
+			err: errors.ErrRevocationFileRead.WithArgs(
+				filepath.Join(dir, "foo.json"),
+				fmt.Sprintf("open %s: no such file or directory", filepath.Join(dir, "foo.json")),
+			),
+		},
+		{
+			name:      "malformed file",
+			config:    &RevocationConfig{FilePath: filepath.Join(dir, "malformed.json")},
+			shouldErr: true,
+			err: errors.ErrRevocationFileMalformed.WithArgs(
+				filepath.Join(dir, "malformed.json"),
+				"json: cannot unmarshal object into Go value of type []*validator.RevokedToken",
+			),
+		},
+		{
+			name:      "file with empty entry",
+			config:    &RevocationConfig{FilePath: filepath.Join(dir, "empty_entry.json")},
+			shouldErr: true,
+			err:       errors.ErrRevocationFileMalformed.WithArgs(filepath.Join(dir, "empty_entry.json"), errors.ErrRevocationEntryEmpty),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			l, err := NewRevocationList(tc.config)
+			if tests.EvalErrWithLog(t, err, "revocation list", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			tests.EvalObjectsWithLog(t, "revoked tokens", tc.want, len(l.GetRevokedTokens()), msgs)
+		})
+	}
+}
@@ -15,17 +15,59 @@
 package validator
 
 import (
+	"bytes"
 	"context"
+	stderrors "errors"
 	"github.com/greenpau/caddy-authorize/pkg/errors"
 	"github.com/greenpau/caddy-authorize/pkg/user"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 )
 
 const (
-	tokenSourceHeader = "header"
-	tokenSourceCookie = "cookie"
-	tokenSourceQuery  = "query"
+	tokenSourceHeader    = "header"
+	tokenSourceCookie    = "cookie"
+	tokenSourceQuery     = "query"
+	tokenSourceWebSocket = "websocket"
+	tokenSourceForm      = "form"
+
+	// The tokens from the custom headers and the form fields are raw tokens,
+	// and they are verified with all the verification keys, as the tokens
+	// in Authorization header with Bearer scheme are.
+	rawTokenName = "bearer"
+
+	maxTokenFormSize = 1 << 20
+)
+
+// TokenExtractor extracts the token from the requests. It returns the name
+// and the value of the token, or empty strings when the request has no token.
+type TokenExtractor interface {
+	ExtractToken(context.Context, *http.Request) (string, string)
+}
+
+// TokenExtractorFunc is an adapter to use a function as TokenExtractor.
+type TokenExtractorFunc func(context.Context, *http.Request) (string, string)
+
+// ExtractToken calls f(ctx, r).
+func (f TokenExtractorFunc) ExtractToken(ctx context.Context, r *http.Request) (string, string) {
+	return f(ctx, r)
+}
+
+// TokenExtractorFactory returns TokenExtractor for the argument of the token
+// source, e.g. the header name of "header:X-Auth-Token" token source.
+type TokenExtractorFactory func(arg string) (TokenExtractor, error)
+
+var (
+	tokenExtractorFactoriesMu sync.RWMutex
+	tokenExtractorFactories   = map[string]TokenExtractorFactory{
+		tokenSourceHeader: newHeaderTokenExtractor,
+		tokenSourceForm:   newFormTokenExtractor,
+	}
 )
 
 var (
@@ -103,6 +145,11 @@ func (v *TokenValidator) parseAuthHeader(ctx context.Context, r *http.Request) (
 			}
 			return "bearer", strings.TrimSpace(kv[1])
 		}
+		if v.opts.ValidateDPoP && strings.HasPrefix(entry, "DPoP ") {
+			// The token bound to a key is passed with DPoP scheme, and the
+			// proof of possession of the key is in DPoP header.
+			return dpopTokenName, strings.TrimSpace(strings.TrimPrefix(entry, "DPoP "))
+		}
 		kv := strings.SplitN(entry, "=", 2)
 		if len(kv) != 2 {
 			continue
@@ -115,6 +162,116 @@ func (v *TokenValidator) parseAuthHeader(ctx context.Context, r *http.Request) (
 	return "", ""
 }
 
+// parseWebSocketProtocol extracts the token from Sec-WebSocket-Protocol
+// header of the requests of browser WebSocket clients, which cannot set
+// Authorization header. The token follows the protocol matching the token
+// name, e.g. "Sec-WebSocket-Protocol: access_token, <token>".
+func (v *TokenValidator) parseWebSocketProtocol(ctx context.Context, r *http.Request) (string, string) {
+	var entries []string
+	for _, hdr := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, entry := range strings.Split(hdr, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	for i := 0; i < len(entries)-1; i++ {
+		if _, exists := v.authHeaders[entries[i]]; exists {
+			return entries[i], entries[i+1]
+		}
+	}
+	return "", ""
+}
+
+// RegisterTokenSource registers the named token source. The token source is
+// enabled by its name, optionally followed by colon and the argument passed
+// to the factory, in the token source priority, see SetSourcePriority.
+func RegisterTokenSource(name string, factory TokenExtractorFactory) error {
+	if name == "" || strings.Contains(name, ":") || factory == nil {
+		return errors.ErrInvalidSourceName.WithArgs(name)
+	}
+	tokenExtractorFactoriesMu.Lock()
+	defer tokenExtractorFactoriesMu.Unlock()
+	switch name {
+	case tokenSourceCookie, tokenSourceQuery, tokenSourceWebSocket:
+		return errors.ErrTokenSourceRegistered.WithArgs(name)
+	}
+	if _, exists := tokenExtractorFactories[name]; exists {
+		return errors.ErrTokenSourceRegistered.WithArgs(name)
+	}
+	tokenExtractorFactories[name] = factory
+	return nil
+}
+
+// newTokenExtractor returns TokenExtractor for the token source with an
+// argument, e.g. "header:X-Auth-Token", or for the registered token source.
+func newTokenExtractor(source string) (TokenExtractor, error) {
+	name, arg := source, ""
+	if i := strings.Index(source, ":"); i > 0 {
+		name, arg = source[:i], source[i+1:]
+	}
+	tokenExtractorFactoriesMu.RLock()
+	factory, exists := tokenExtractorFactories[name]
+	tokenExtractorFactoriesMu.RUnlock()
+	if !exists {
+		return nil, errors.ErrInvalidSourceName.WithArgs(source)
+	}
+	extractor, err := factory(arg)
+	if err != nil {
+		return nil, errors.ErrInvalidSourceConfig.WithArgs(source, err)
+	}
+	return extractor, nil
+}
+
+// newHeaderTokenExtractor returns TokenExtractor for the raw tokens in the
+// header, e.g. X-Forwarded-Access-Token header set by oauth2-proxy.
+func newHeaderTokenExtractor(arg string) (TokenExtractor, error) {
+	if arg == "" {
+		return nil, errors.ErrTokenSourceArgNotFound.WithArgs("header name")
+	}
+	name := http.CanonicalHeaderKey(arg)
+	return TokenExtractorFunc(func(ctx context.Context, r *http.Request) (string, string) {
+		token := strings.TrimSpace(r.Header.Get(name))
+		if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+			token = strings.TrimSpace(token[7:])
+		}
+		if token == "" {
+			return "", ""
+		}
+		return rawTokenName, token
+	}), nil
+}
+
+// newFormTokenExtractor returns TokenExtractor for the raw tokens in the
+// field of URL-encoded form of POST requests. The body of the request is
+// preserved for the upstream handlers.
+func newFormTokenExtractor(arg string) (TokenExtractor, error) {
+	if arg == "" {
+		return nil, errors.ErrTokenSourceArgNotFound.WithArgs("form field name")
+	}
+	return TokenExtractorFunc(func(ctx context.Context, r *http.Request) (string, string) {
+		if r.Method != http.MethodPost || r.Body == nil {
+			return "", ""
+		}
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if contentType != "application/x-www-form-urlencoded" {
+			return "", ""
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxTokenFormSize+1))
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+		if err != nil || len(b) > maxTokenFormSize {
+			return "", ""
+		}
+		values, err := url.ParseQuery(string(b))
+		if err != nil {
+			return "", ""
+		}
+		token := strings.TrimSpace(values.Get(arg))
+		if token == "" {
+			return "", ""
+		}
+		return rawTokenName, token
+	}), nil
+}
+
 // AuthorizeCookies authorizes HTTP requests based on the presence and the
 // content of the tokens in HTTP cookies.
 func (v *TokenValidator) parseCookies(ctx context.Context, r *http.Request) (string, string) {
@@ -148,6 +305,16 @@ func (v *TokenValidator) Authorize(ctx context.Context, r *http.Request) (usr *u
 		case tokenSourceQuery:
 			tokenName, token = v.parseQueryParams(ctx, r)
 			tokenSource = tokenSourceQuery
+		case tokenSourceWebSocket:
+			tokenName, token = v.parseWebSocketProtocol(ctx, r)
+			tokenSource = tokenSourceWebSocket
+		default:
+			extractor, exists := v.tokenExtractors[sourceName]
+			if !exists {
+				continue
+			}
+			tokenName, token = extractor.ExtractToken(ctx, r)
+			tokenSource = sourceName
 		}
 		if token != "" {
 			found = true
@@ -173,21 +340,59 @@ func (v *TokenValidator) Authorize(ctx context.Context, r *http.Request) (usr *u
 		return nil, errors.ErrNoTokenFound
 	}
 
-	// Perform cache lookup for the previously obtained credentials.
-	usr = v.cache.Get(token)
+	// The revoked tokens are rejected by their hash prior to the cache
+	// lookup, and by their token id or subject after it.
+	if v.revocations != nil && v.revocations.isTokenRevoked(token) {
+		return nil, errors.ErrValidatorTokenRevoked
+	}
+
+	// The opaque tokens are introspected by the authorization server.
+	introspect := v.introspector != nil && v.introspector.matches(tokenName, token)
+	var cacheExpiresAt int64
+
+	// Perform cache lookup for the previously obtained credentials. The
+	// cache is bypassed when the verification keys are selected based on
+	// the request, because the token may be valid for one request only.
+	if introspect || !v.keystore.UsesRequest() {
+		usr = v.cache.Get(token)
+	}
 	if usr == nil {
 		// The user is not in the cache.
-		usr, err = v.keystore.ParseToken(tokenName, token)
+		if introspect {
+			usr, cacheExpiresAt, err = v.introspector.introspect(ctx, token)
+		} else {
+			usr, err = v.keystore.ParseTokenWithRequest(r, tokenName, token)
+		}
 		if err != nil {
+			if stderrors.Is(err, errors.ErrCryptoKeyStoreAlgorithmNotAllowed) {
+				return usr, err
+			}
 			return usr, errors.ErrValidatorInvalidToken.WithArgs(err)
 		}
 	}
 
-	if err := v.guardian.authorize(ctx, r, usr); err != nil {
+	if v.revocations != nil && v.revocations.isUserRevoked(usr) {
+		return usr, errors.ErrValidatorTokenRevoked
+	}
+
+	// The time claims, the audience, and the issuer are validated prior to
+	// the access list.
+	if err := v.authorizeClaims(usr); err != nil {
+		return usr, err
+	}
+	if err := v.authorizeProofOfPossession(r, tokenName, token, usr); err != nil {
+		return usr, err
+	}
+	if err := v.authorizeGuardians(ctx, r, usr); err != nil {
 		return usr, err
 	}
 	usr.TokenSource = tokenSource
 	usr.TokenName = tokenName
 	usr.Token = token
+	if cacheExpiresAt > 0 {
+		// The introspection result is cached for the shorter of the token
+		// lifetime and the configured time to live.
+		v.cache.AddWithExpiry(usr, cacheExpiresAt)
+	}
 	return usr, nil
 }
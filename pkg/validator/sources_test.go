@@ -17,8 +17,10 @@ package validator
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -279,3 +281,155 @@ func TestAuthorizationSources(t *testing.T) {
 		})
 	}
 }
+
+func TestCustomTokenSources(t *testing.T) {
+	ctx := context.Background()
+	ks := testutils.NewTestCryptoKeyStore()
+	usr := testutils.NewTestUser()
+	if err := ks.SignToken("access_token", "HS512", usr); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterTokenSource("x-test-prefix", func(arg string) (TokenExtractor, error) {
+		return TokenExtractorFunc(func(ctx context.Context, r *http.Request) (string, string) {
+			return "access_token", strings.TrimPrefix(r.Header.Get("X-Test"), arg)
+		}), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterTokenSource("header", nil); err == nil {
+		t.Fatalf("expected error when registering token source without factory")
+	}
+	if err := RegisterTokenSource("form", newFormTokenExtractor); err == nil {
+		t.Fatalf("expected error when registering token source twice")
+	}
+
+	var testcases = []struct {
+		name    string
+		sources []string
+		method  string
+		headers map[string]string
+		body    string
+		want    map[string]interface{}
+		// shouldErr indicates the request has no token.
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:    "token in custom header",
+			sources: []string{"header", "header:X-Auth-Token"},
+			headers: map[string]string{"X-Auth-Token": usr.Token},
+			want: map[string]interface{}{
+				"token_name":   "bearer",
+				"token_source": "header:X-Auth-Token",
+			},
+		},
+		{
+			name:    "token with bearer scheme in custom header",
+			sources: []string{"header:x-forwarded-access-token"},
+			headers: map[string]string{"X-Forwarded-Access-Token": "Bearer " + usr.Token},
+			want: map[string]interface{}{
+				"token_name":   "bearer",
+				"token_source": "header:x-forwarded-access-token",
+			},
+		},
+		{
+			name:    "custom header token source priority",
+			sources: []string{"header:X-Auth-Token", "header"},
+			headers: map[string]string{
+				"X-Auth-Token":  usr.Token,
+				"Authorization": "access_token=foobar",
+			},
+			want: map[string]interface{}{
+				"token_name":   "bearer",
+				"token_source": "header:X-Auth-Token",
+			},
+		},
+		{
+			name:    "token in form field",
+			sources: []string{"form:access_token"},
+			method:  "POST",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:    "state=foo&access_token=" + usr.Token,
+			want: map[string]interface{}{
+				"token_name":   "bearer",
+				"token_source": "form:access_token",
+			},
+		},
+		{
+			name:      "token in form field of get request",
+			sources:   []string{"form:access_token"},
+			headers:   map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:      "access_token=" + usr.Token,
+			shouldErr: true,
+			err:       errors.ErrNoTokenFound,
+		},
+		{
+			name:      "token in form field of multipart form",
+			sources:   []string{"form:access_token"},
+			method:    "POST",
+			headers:   map[string]string{"Content-Type": "multipart/form-data; boundary=foo"},
+			body:      "access_token=" + usr.Token,
+			shouldErr: true,
+			err:       errors.ErrNoTokenFound,
+		},
+		{
+			name:    "token in websocket protocol",
+			sources: []string{"header", "websocket"},
+			headers: map[string]string{"Sec-WebSocket-Protocol": "chat, access_token, " + usr.Token},
+			want: map[string]interface{}{
+				"token_name":   "access_token",
+				"token_source": "websocket",
+			},
+		},
+		{
+			name:      "websocket protocol without token",
+			sources:   []string{"websocket"},
+			headers:   map[string]string{"Sec-WebSocket-Protocol": "chat, access_token"},
+			shouldErr: true,
+			err:       errors.ErrNoTokenFound,
+		},
+		{
+			name:    "token from registered token source",
+			sources: []string{"x-test-prefix:foo-"},
+			headers: map[string]string{"X-Test": "foo-" + usr.Token},
+			want: map[string]interface{}{
+				"token_name":   "access_token",
+				"token_source": "x-test-prefix:foo-",
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			v := NewTokenValidator()
+			if err := v.Configure(ctx, ks.GetKeys(), testutils.NewTestGuestAccessList(), options.NewTokenValidatorOptions()); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.SetSourcePriority(tc.sources); err != nil {
+				t.Fatal(err)
+			}
+			method := tc.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, "/protected/path", strings.NewReader(tc.body))
+			for k, val := range tc.headers {
+				r.Header.Set(k, val)
+			}
+			usr, err := v.Authorize(ctx, r)
+			if tests.EvalErrWithLog(t, err, "authorize", tc.shouldErr, tc.err, msgs) {
+				return
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]interface{}{
+				"token_name":   usr.TokenName,
+				"token_source": usr.TokenSource,
+			}
+			tests.EvalObjectsWithLog(t, "user", tc.want, got, msgs)
+			tests.EvalObjectsWithLog(t, "body", tc.body, string(b), msgs)
+		})
+	}
+}
@@ -16,8 +16,9 @@ package validator
 
 import (
 	"context"
-	"net/http"
+	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/greenpau/caddy-authorize/pkg/acl"
 	"github.com/greenpau/caddy-authorize/pkg/cache"
@@ -26,60 +27,35 @@ import (
 	"github.com/greenpau/caddy-authorize/pkg/options"
 	"github.com/greenpau/caddy-authorize/pkg/shared/idp"
 	"github.com/greenpau/caddy-authorize/pkg/user"
-	addrutils "github.com/greenpau/caddy-authorize/pkg/utils/addr"
+	"go.uber.org/zap"
 )
 
-type guardian interface {
-	authorize(context.Context, *http.Request, *user.User) error
-}
-
-type guardianBase struct {
-	accessList *acl.AccessList
-}
-
-type guardianWithSrcAddr struct {
-	accessList *acl.AccessList
-}
-
-type guardianWithPathClaim struct {
-	accessList *acl.AccessList
-}
-
-type guardianWithMethodPath struct {
-	accessList *acl.AccessList
-}
-
-type guardianWithSrcAddrPathClaim struct {
-	accessList *acl.AccessList
-}
-
-type guardianWithMethodPathSrcAddr struct {
-	accessList *acl.AccessList
-}
-
-type guardianWithMethodPathPathClaim struct {
-	accessList *acl.AccessList
-}
-
-type guardianWithMethodPathSrcAddrPathClaim struct {
-	accessList *acl.AccessList
-}
-
 // TokenValidator validates tokens in http requests.
 type TokenValidator struct {
-	keystore          *kms.CryptoKeyStore
-	authHeaders       map[string]interface{}
-	authCookies       map[string]interface{}
-	authQueryParams   map[string]interface{}
-	cache             *cache.TokenCache
-	accessList        *acl.AccessList
-	guardian          guardian
-	tokenSources      []string
-	opts              *options.TokenValidatorOptions
-	basicAuthEnabled  bool
-	apiKeyAuthEnabled bool
-	customAuthEnabled bool
-	idpConfig         *idp.IdentityProviderConfig
+	keystore            *kms.CryptoKeyStore
+	authHeaders         map[string]interface{}
+	authCookies         map[string]interface{}
+	authQueryParams     map[string]interface{}
+	cache               *cache.TokenCache
+	accessList          *acl.AccessList
+	guardians           []Guardian
+	customGuardians     []Guardian
+	registeredGuardians []Guardian
+	tokenSources        []string
+	tokenExtractors     map[string]TokenExtractor
+	opts                *options.TokenValidatorOptions
+	basicAuthEnabled    bool
+	apiKeyAuthEnabled   bool
+	customAuthEnabled   bool
+	idpConfig           *idp.IdentityProviderConfig
+	introspector        *introspector
+	audiences           map[string]bool
+	issuers             map[string]bool
+	leeway              time.Duration
+	maxTokenAge         time.Duration
+	requiredClaims      []*options.RequiredClaim
+	revocations         *RevocationList
+	dpop                *dpopValidator
 }
 
 // NewTokenValidator returns an instance of TokenValidator
@@ -102,6 +78,11 @@ func NewTokenValidator() *TokenValidator {
 	return v
 }
 
+// SetLogger adds a logger to the keystore of TokenValidator.
+func (v *TokenValidator) SetLogger(logger *zap.Logger) {
+	v.keystore.SetLogger(logger)
+}
+
 // GetAuthCookies returns auth cookies registered with TokenValidator.
 func (v *TokenValidator) GetAuthCookies() map[string]interface{} {
 	return v.authCookies
@@ -125,28 +106,56 @@ func (v *TokenValidator) setAllowedTokenNames(arr []string) error {
 		v.authCookies[s] = true
 		v.authQueryParams[s] = true
 	}
+	v.addIntrospectionTokenNames()
 	return nil
 }
 
+// addIntrospectionTokenNames adds the names of the introspected tokens to
+// the allowed token names.
+func (v *TokenValidator) addIntrospectionTokenNames() {
+	if v.introspector == nil {
+		return
+	}
+	for _, s := range v.introspector.config.TokenNames {
+		v.authHeaders[s] = true
+		v.authCookies[s] = true
+		v.authQueryParams[s] = true
+	}
+}
+
 // SetSourcePriority sets the order in which various token sources are being
 // evaluated for the presence of keys. The default order is cookie, header,
-// and query parameters.
+// and query parameters. Besides, the tokens are extracted from
+// Sec-WebSocket-Protocol header with "websocket" source, from the headers
+// with "header:<NAME>" sources, from the fields of the forms with
+// "form:<NAME>" sources, and with the sources registered by
+// RegisterTokenSource.
 func (v *TokenValidator) SetSourcePriority(arr []string) error {
-	if len(arr) == 0 || len(arr) > 3 {
+	if len(arr) == 0 {
 		return errors.ErrInvalidSourcePriority
 	}
 	m := make(map[string]bool)
+	var sources []string
+	extractors := make(map[string]TokenExtractor)
 	for _, s := range arr {
 		s = strings.TrimSpace(s)
-		if s != tokenSourceHeader && s != tokenSourceCookie && s != tokenSourceQuery {
-			return errors.ErrInvalidSourceName.WithArgs(s)
-		}
 		if _, exists := m[s]; exists {
 			return errors.ErrDuplicateSourceName.WithArgs(s)
 		}
 		m[s] = true
+		sources = append(sources, s)
+		switch s {
+		case tokenSourceHeader, tokenSourceCookie, tokenSourceQuery, tokenSourceWebSocket:
+			continue
+		}
+		extractor, err := newTokenExtractor(s)
+		if err != nil {
+			return err
+		}
+		extractors[s] = extractor
 	}
-	v.tokenSources = arr
+	v.tokenSources = sources
+	v.tokenExtractors = extractors
 	return nil
 }
 
@@ -155,148 +164,127 @@ func (v *TokenValidator) GetSourcePriority() []string {
 	return v.tokenSources
 }
 
-func (g *guardianBase) authorize(ctx context.Context, r *http.Request, usr *user.User) error {
-	if usr.Cached {
-		return nil
-	}
-	if userAllowed := g.accessList.Allow(ctx, usr.GetData()); !userAllowed {
-		return errors.ErrAccessNotAllowed
-	}
-	return nil
-}
-
-func (g *guardianWithSrcAddr) authorize(ctx context.Context, r *http.Request, usr *user.User) error {
-	if userAllowed := g.accessList.Allow(ctx, usr.GetData()); !userAllowed {
-		return errors.ErrAccessNotAllowed
+// getConfirmationClaim returns the member of the "cnf" claim of the token,
+// i.e. the thumbprint of the key or the certificate the token is bound to.
+func getConfirmationClaim(usr *user.User, name string) string {
+	cnf, ok := usr.AsMap()["cnf"].(map[string]interface{})
+	if !ok {
+		return ""
 	}
-	if usr.Claims.Address == "" {
-		return errors.ErrSourceAddressNotFound
-	}
-	reqAddr := addrutils.GetSourceAddress(r)
-	if usr.Claims.Address != reqAddr {
-		return errors.ErrSourceAddressMismatch.WithArgs(usr.Claims.Address, reqAddr)
-	}
-	return nil
+	s, _ := cnf[name].(string)
+	return s
 }
 
-func (g *guardianWithPathClaim) authorize(ctx context.Context, r *http.Request, usr *user.User) error {
-	if userAllowed := g.accessList.Allow(ctx, usr.GetData()); !userAllowed {
-		return errors.ErrAccessNotAllowed
-	}
-	if usr.Claims.AccessList == nil {
-		return errors.ErrAccessNotAllowedByPathACL
-	}
-	for path := range usr.Claims.AccessList.Paths {
-		if acl.MatchPathBasedACL(path, r.URL.Path) {
-			return nil
+// authorizeClaims validates the time claims of the token, and the audience
+// and the issuer of the token, when the validation is enabled. The token is
+// allowed when one of its audiences is allowed. The max age of the token is
+// measured from its "iat" claim, regardless of its "exp" claim.
+func (v *TokenValidator) authorizeClaims(usr *user.User) error {
+	now := time.Now()
+	if err := usr.Claims.ValidAt(now, v.leeway); err != nil {
+		return errors.ErrValidatorInvalidToken.WithArgs(err)
+	}
+	if v.maxTokenAge > 0 {
+		if usr.Claims.IssuedAt == 0 {
+			return errors.ErrValidatorIssuedAtNotFound
+		}
+		issuedAt := time.Unix(usr.Claims.IssuedAt, 0).UTC()
+		if now.Sub(issuedAt) > v.maxTokenAge+v.leeway {
+			return errors.ErrValidatorTokenMaxAgeExceeded.WithArgs(issuedAt.Format(time.RFC3339), int64(v.maxTokenAge/time.Second))
 		}
 	}
-	return errors.ErrAccessNotAllowedByPathACL
-}
-
-func (g *guardianWithSrcAddrPathClaim) authorize(ctx context.Context, r *http.Request, usr *user.User) error {
-	if userAllowed := g.accessList.Allow(ctx, usr.GetData()); !userAllowed {
-		return errors.ErrAccessNotAllowed
-	}
-	if usr.Claims.Address == "" {
-		return errors.ErrSourceAddressNotFound
-	}
-	reqAddr := addrutils.GetSourceAddress(r)
-	if usr.Claims.Address != reqAddr {
-		return errors.ErrSourceAddressMismatch.WithArgs(usr.Claims.Address, reqAddr)
+	if err := v.authorizeRequiredClaims(usr); err != nil {
+		return err
 	}
-	if usr.Claims.AccessList == nil {
-		return errors.ErrAccessNotAllowedByPathACL
+	if len(v.audiences) > 0 {
+		if len(usr.Claims.Audience) == 0 {
+			return errors.ErrValidatorAudienceNotFound
+		}
+		var allowed bool
+		for _, aud := range usr.Claims.Audience {
+			if v.audiences[aud] {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.ErrValidatorAudienceNotAllowed.WithArgs(usr.Claims.Audience)
+		}
 	}
-	for path := range usr.Claims.AccessList.Paths {
-		if acl.MatchPathBasedACL(path, r.URL.Path) {
-			return nil
+	if len(v.issuers) > 0 {
+		if usr.Claims.Issuer == "" {
+			return errors.ErrValidatorIssuerNotFound
+		}
+		if !v.issuers[usr.Claims.Issuer] {
+			return errors.ErrValidatorIssuerNotAllowed.WithArgs(usr.Claims.Issuer)
 		}
 	}
-	return errors.ErrAccessNotAllowedByPathACL
+	return nil
 }
 
-func (g *guardianWithMethodPath) authorize(ctx context.Context, r *http.Request, usr *user.User) error {
-	kv := make(map[string]interface{})
-	for k, v := range usr.GetData() {
-		kv[k] = v
-	}
-	kv["method"] = r.Method
-	kv["path"] = r.URL.Path
-	if userAllowed := g.accessList.Allow(ctx, kv); !userAllowed {
-		return errors.ErrAccessNotAllowed
-	}
-	return nil
+// requiredClaimAliases maps the claim names to the names the user has for
+// them.
+var requiredClaimAliases = map[string]string{
+	"email": "mail",
+	"scope": "scopes",
 }
 
-func (g *guardianWithMethodPathSrcAddr) authorize(ctx context.Context, r *http.Request, usr *user.User) error {
-	kv := make(map[string]interface{})
-	for k, v := range usr.GetData() {
-		kv[k] = v
-	}
-	kv["method"] = r.Method
-	kv["path"] = r.URL.Path
-	if userAllowed := g.accessList.Allow(ctx, kv); !userAllowed {
-		return errors.ErrAccessNotAllowed
-	}
-	if usr.Claims.Address == "" {
-		return errors.ErrSourceAddressNotFound
+// authorizeRequiredClaims validates the presence and the type of the
+// required claims. The claims are looked up by the names the user has for
+// them, e.g. "email" is "mail".
+func (v *TokenValidator) authorizeRequiredClaims(usr *user.User) error {
+	if len(v.requiredClaims) == 0 {
+		return nil
 	}
-	reqAddr := addrutils.GetSourceAddress(r)
-	if usr.Claims.Address != reqAddr {
-		return errors.ErrSourceAddressMismatch.WithArgs(usr.Claims.Address, reqAddr)
+	m := usr.AsMap()
+	for _, c := range v.requiredClaims {
+		name := c.Name
+		if alias, exists := requiredClaimAliases[name]; exists {
+			name = alias
+		}
+		value, exists := m[name]
+		if !exists || value == nil {
+			return errors.ErrValidatorRequiredClaimNotFound.WithArgs(c.Name)
+		}
+		if c.Type != "" && !isRequiredClaimType(value, c.Type) {
+			return errors.ErrValidatorRequiredClaimTypeMismatch.WithArgs(c.Name, c.Type)
+		}
 	}
 	return nil
 }
 
-func (g *guardianWithMethodPathPathClaim) authorize(ctx context.Context, r *http.Request, usr *user.User) error {
-	kv := make(map[string]interface{})
-	for k, v := range usr.GetData() {
-		kv[k] = v
-	}
-	kv["method"] = r.Method
-	kv["path"] = r.URL.Path
-	if userAllowed := g.accessList.Allow(ctx, kv); !userAllowed {
-		return errors.ErrAccessNotAllowed
-	}
-	if usr.Claims.AccessList == nil {
-		return errors.ErrAccessNotAllowedByPathACL
-	}
-	for path := range usr.Claims.AccessList.Paths {
-		if acl.MatchPathBasedACL(path, r.URL.Path) {
-			return nil
-		}
-	}
-	return errors.ErrAccessNotAllowedByPathACL
+func isRequiredClaimType(value interface{}, claimType string) bool {
+	switch value.(type) {
+	case string:
+		return claimType == "string"
+	case float64, int, int64, json.Number:
+		return claimType == "number"
+	case bool:
+		return claimType == "bool"
+	case []interface{}, []string:
+		return claimType == "list"
+	case map[string]interface{}:
+		return claimType == "map"
+	}
+	return false
 }
 
-func (g *guardianWithMethodPathSrcAddrPathClaim) authorize(ctx context.Context, r *http.Request, usr *user.User) error {
-	kv := make(map[string]interface{})
-	for k, v := range usr.GetData() {
-		kv[k] = v
-	}
-	kv["method"] = r.Method
-	kv["path"] = r.URL.Path
-	if userAllowed := g.accessList.Allow(ctx, kv); !userAllowed {
-		return errors.ErrAccessNotAllowed
-	}
-	if usr.Claims.Address == "" {
-		return errors.ErrSourceAddressNotFound
-	}
-	reqAddr := addrutils.GetSourceAddress(r)
-	if usr.Claims.Address != reqAddr {
-		return errors.ErrSourceAddressMismatch.WithArgs(usr.Claims.Address, reqAddr)
-	}
+// SetRevocationList adds the list of revoked tokens to TokenValidator. The
+// cached tokens are evicted when they get revoked.
+func (v *TokenValidator) SetRevocationList(l *RevocationList) {
+	v.revocations = l
+	l.subscribe(v.evictRevokedTokens)
+}
 
-	if usr.Claims.AccessList == nil {
-		return errors.ErrAccessNotAllowedByPathACL
-	}
-	for path := range usr.Claims.AccessList.Paths {
-		if acl.MatchPathBasedACL(path, r.URL.Path) {
-			return nil
+func (v *TokenValidator) evictRevokedTokens(entries []*RevokedToken) {
+	v.cache.DeleteMatching(func(token string, usr *user.User) bool {
+		for _, e := range entries {
+			if e.matches(token, usr) {
+				return true
+			}
 		}
-	}
-	return errors.ErrAccessNotAllowedByPathACL
+		return false
+	})
 }
 
 // Configure adds access list and keys for the verification of tokens.
@@ -312,33 +300,32 @@ func (v *TokenValidator) Configure(ctx context.Context, keys []*kms.CryptoKey, a
 	}
 
 	v.opts = opts
-
-	switch {
-	case opts.ValidateMethodPath && opts.ValidateSourceAddress && opts.ValidateAccessListPathClaim:
-		g := &guardianWithMethodPathSrcAddrPathClaim{accessList: accessList}
-		v.guardian = g
-	case opts.ValidateMethodPath && opts.ValidateAccessListPathClaim:
-		g := &guardianWithMethodPathPathClaim{accessList: accessList}
-		v.guardian = g
-	case opts.ValidateMethodPath && opts.ValidateSourceAddress:
-		g := &guardianWithMethodPathSrcAddr{accessList: accessList}
-		v.guardian = g
-	case opts.ValidateSourceAddress && opts.ValidateAccessListPathClaim:
-		g := &guardianWithSrcAddrPathClaim{accessList: accessList}
-		v.guardian = g
-	case opts.ValidateAccessListPathClaim:
-		g := &guardianWithPathClaim{accessList: accessList}
-		v.guardian = g
-	case opts.ValidateMethodPath:
-		g := &guardianWithMethodPath{accessList: accessList}
-		v.guardian = g
-	case opts.ValidateSourceAddress:
-		g := &guardianWithSrcAddr{accessList: accessList}
-		v.guardian = g
-	default:
-		g := &guardianBase{accessList: accessList}
-		v.guardian = g
+	v.keystore.SetRequireKeyID(opts.ValidateKeyID)
+	v.leeway = time.Duration(opts.TokenLeeway) * time.Second
+	v.maxTokenAge = time.Duration(opts.TokenMaxAge) * time.Second
+	v.keystore.SetLeeway(v.leeway)
+	v.cache.SetLeeway(v.leeway)
+	for _, c := range opts.RequiredClaims {
+		switch c.Type {
+		case "", "string", "number", "bool", "list", "map":
+		default:
+			return errors.ErrValidatorRequiredClaimTypeInvalid.WithArgs(c.Name, c.Type)
+		}
+	}
+	v.requiredClaims = opts.RequiredClaims
+	if opts.ValidateDPoP {
+		v.dpop = newDPoPValidator(v.leeway)
+	}
+	v.audiences = make(map[string]bool)
+	for _, s := range opts.ValidateAudience {
+		v.audiences[s] = true
 	}
+	v.issuers = make(map[string]bool)
+	for _, s := range opts.ValidateIssuer {
+		v.issuers[s] = true
+	}
+
+	v.guardians = newGuardians(accessList, opts)
 	return nil
 }
 
@@ -361,6 +348,11 @@ func (v *TokenValidator) addKeys(ctx context.Context, keys []*kms.CryptoKey) err
 		return errors.ErrValidatorCryptoKeyStoreNoKeys
 	}
 	for _, k := range keys {
+		if k.Decrypt != nil && k.Decrypt.Capable {
+			// The key decrypts the encrypted tokens prior to verification.
+			v.keystore.AddKey(k)
+			continue
+		}
 		if !k.Verify.Token.Capable {
 			continue
 		}
@@ -409,3 +401,18 @@ func (v *TokenValidator) RegisterIdentityProvider(cfg *idp.IdentityProviderConfi
 	v.idpConfig = cfg
 	return nil
 }
+
+// RegisterIntrospectionEndpoint registers OAuth 2.0 Token Introspection
+// endpoint with TokenValidator.
+func (v *TokenValidator) RegisterIntrospectionEndpoint(cfg *IntrospectionConfig) error {
+	if cfg == nil {
+		return errors.ErrValidatorIntrospectionConfig
+	}
+	i, err := newIntrospector(cfg)
+	if err != nil {
+		return err
+	}
+	v.introspector = i
+	v.addIntrospectionTokenNames()
+	return nil
+}
@@ -16,7 +16,17 @@ package validator
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -161,6 +171,12 @@ var (
         "scope": ["write:books"]
     }`
 
+	service = `{
+        "exp": ` + fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix()) + `,
+        "iss": "https://auth.example.com",
+        "sub": "svc-billing"
+    }`
+
 	// Create access list with default deny that allows viewer only
 	defaultRolesDenyACL = []*acl.RuleConfiguration{
 		{
@@ -306,7 +322,51 @@ var (
     }`
 )
 
+func newTestCertificate(t *testing.T) *x509.Certificate {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "svc-billing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	b, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func getTestCertificateThumbprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
 func TestAuthorize(t *testing.T) {
+	viewerUser, err := user.NewUser(viewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerIssuedAt := time.Unix(viewerUser.Claims.IssuedAt, 0).UTC().Format(time.RFC3339)
+
+	clientCert := newTestCertificate(t)
+	otherClientCert := newTestCertificate(t)
+	clientCertThumbprint := getTestCertificateThumbprint(clientCert)
+	certBoundViewer := `{
+        "exp": ` + fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix()) + `,
+        "sub": "smithj@outlook.com",
+        "scope": ["read:books"],
+        "cnf": {"x5t#S256": "` + clientCertThumbprint + `"}
+    }`
+
 	testcases := []struct {
 		name string
 		// disabled                    bool
@@ -320,6 +380,13 @@ func TestAuthorize(t *testing.T) {
 		validateAccessListPathClaim bool
 		validateSourceAddress       bool
 		validateMethodPath          bool
+		validateAudience            []string
+		validateIssuer              []string
+		tokenLeeway                 int
+		tokenMaxAge                 int
+		requiredClaims              []*options.RequiredClaim
+		validateClientCertificate   bool
+		clientCertificate           *x509.Certificate
 		optionsDisabled             bool
 		want                        map[string]interface{}
 		shouldErr                   bool
@@ -952,6 +1019,238 @@ func TestAuthorize(t *testing.T) {
 			validateSourceAddress: true,
 			sourceAddress:         "[2001:DB8::21f:5bff:febf:ce22:8a2e]:80",
 		},
+		{
+			name:             "token with allowed audience",
+			claims:           viewer,
+			config:           defaultAllowACL,
+			method:           "GET",
+			path:             "/app/viewer",
+			validateAudience: []string{"https://google.com/", "https://example.com/"},
+		},
+		{
+			name:             "token with audience not allowed",
+			claims:           editor,
+			config:           defaultRolesAllowACL,
+			method:           "GET",
+			path:             "/app/viewer",
+			validateAudience: []string{"https://google.com/"},
+			shouldErr:        true,
+			err:              errors.ErrValidatorAudienceNotAllowed.WithArgs([]string{"https://localhost/"}),
+		},
+		{
+			name:             "token without audience",
+			claims:           service,
+			config:           defaultRolesAllowACL,
+			method:           "GET",
+			path:             "/app/viewer",
+			validateAudience: []string{"https://google.com/"},
+			shouldErr:        true,
+			err:              errors.ErrValidatorAudienceNotFound,
+		},
+		{
+			name:           "token with allowed issuer",
+			claims:         service,
+			config:         defaultRolesAllowACL,
+			method:         "GET",
+			path:           "/app/viewer",
+			validateIssuer: []string{"https://auth.example.com"},
+		},
+		{
+			name:           "token with issuer not allowed",
+			claims:         service,
+			config:         defaultRolesAllowACL,
+			method:         "GET",
+			path:           "/app/viewer",
+			validateIssuer: []string{"https://login.example.com"},
+			shouldErr:      true,
+			err:            errors.ErrValidatorIssuerNotAllowed.WithArgs("https://auth.example.com"),
+		},
+		{
+			name:           "token without issuer",
+			claims:         viewer,
+			config:         defaultAllowACL,
+			method:         "GET",
+			path:           "/app/viewer",
+			validateIssuer: []string{"https://auth.example.com"},
+			shouldErr:      true,
+			err:            errors.ErrValidatorIssuerNotFound,
+		},
+		{
+			name:        "recently expired token within leeway",
+			claims:      `{"exp": ` + fmt.Sprintf("%d", time.Now().Add(-10*time.Second).Unix()) + `, "sub": "svc-billing"}`,
+			config:      defaultRolesAllowACL,
+			method:      "GET",
+			path:        "/app/viewer",
+			tokenLeeway: 30,
+		},
+		{
+			name:        "expired token beyond leeway",
+			claims:      `{"exp": ` + fmt.Sprintf("%d", time.Now().Add(-time.Minute).Unix()) + `, "sub": "svc-billing"}`,
+			config:      defaultRolesAllowACL,
+			method:      "GET",
+			path:        "/app/viewer",
+			tokenLeeway: 30,
+			shouldErr:   true,
+			err:         errors.ErrValidatorInvalidToken.WithArgs(errors.ErrCryptoKeyStoreParseTokenFailed),
+		},
+		{
+			name:        "token not valid yet within leeway",
+			claims:      `{"exp": ` + fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix()) + `, "nbf": ` + fmt.Sprintf("%d", time.Now().Add(10*time.Second).Unix()) + `, "sub": "svc-billing"}`,
+			config:      defaultRolesAllowACL,
+			method:      "GET",
+			path:        "/app/viewer",
+			tokenLeeway: 30,
+		},
+		{
+			name:      "token not valid yet",
+			claims:    `{"exp": ` + fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix()) + `, "nbf": ` + fmt.Sprintf("%d", time.Now().Add(time.Minute).Unix()) + `, "sub": "svc-billing"}`,
+			config:    defaultRolesAllowACL,
+			method:    "GET",
+			path:      "/app/viewer",
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidToken.WithArgs(errors.ErrCryptoKeyStoreParseTokenFailed),
+		},
+		{
+			name:      "token issued in the future",
+			claims:    `{"exp": ` + fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix()) + `, "iat": ` + fmt.Sprintf("%d", time.Now().Add(time.Minute).Unix()) + `, "sub": "svc-billing"}`,
+			config:    defaultRolesAllowACL,
+			method:    "GET",
+			path:      "/app/viewer",
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidToken.WithArgs(errors.ErrCryptoKeyStoreParseTokenFailed),
+		},
+		{
+			name:        "token within max age",
+			claims:      viewer,
+			config:      defaultAllowACL,
+			method:      "GET",
+			path:        "/app/viewer",
+			tokenMaxAge: 3600,
+			cacheUser:   true,
+		},
+		{
+			name:        "token exceeding max age",
+			claims:      viewer,
+			config:      defaultAllowACL,
+			method:      "GET",
+			path:        "/app/viewer",
+			tokenMaxAge: 300,
+			shouldErr:   true,
+			err:         errors.ErrValidatorTokenMaxAgeExceeded.WithArgs(viewerIssuedAt, 300),
+		},
+		{
+			name:        "token without issued at time and max age",
+			claims:      service,
+			config:      defaultRolesAllowACL,
+			method:      "GET",
+			path:        "/app/viewer",
+			tokenMaxAge: 300,
+			shouldErr:   true,
+			err:         errors.ErrValidatorIssuedAtNotFound,
+		},
+		{
+			name:   "token with required claims",
+			claims: viewer,
+			config: defaultAllowACL,
+			method: "GET",
+			path:   "/app/viewer",
+			requiredClaims: []*options.RequiredClaim{
+				{Name: "sub", Type: "string"},
+				{Name: "aud", Type: "list"},
+				{Name: "exp", Type: "number"},
+				{Name: "scope"},
+			},
+		},
+		{
+			name:   "token without required claim",
+			claims: viewer,
+			config: defaultAllowACL,
+			method: "GET",
+			path:   "/app/viewer",
+			requiredClaims: []*options.RequiredClaim{
+				{Name: "sub"},
+				{Name: "email"},
+			},
+			shouldErr: true,
+			err:       errors.ErrValidatorRequiredClaimNotFound.WithArgs("email"),
+		},
+		{
+			name:   "token with required custom claim of another type",
+			claims: `{"exp": ` + fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix()) + `, "sub": "svc-billing", "tenant": 42}`,
+			config: defaultRolesAllowACL,
+			method: "GET",
+			path:   "/app/viewer",
+			requiredClaims: []*options.RequiredClaim{
+				{Name: "tenant", Type: "string"},
+			},
+			shouldErr: true,
+			err:       errors.ErrValidatorRequiredClaimTypeMismatch.WithArgs("tenant", "string"),
+		},
+		{
+			name:   "required claim with unsupported type",
+			claims: viewer,
+			config: defaultAllowACL,
+			method: "GET",
+			path:   "/app/viewer",
+			requiredClaims: []*options.RequiredClaim{
+				{Name: "iat", Type: "date"},
+			},
+			shouldErr: true,
+			err:       errors.ErrValidatorRequiredClaimTypeInvalid.WithArgs("iat", "date"),
+		},
+		// Certificate-bound tokens
+		{
+			name:                      "certificate-bound token with client certificate",
+			claims:                    certBoundViewer,
+			config:                    defaultAllowACL,
+			method:                    "GET",
+			path:                      "/app/viewer",
+			validateClientCertificate: true,
+			clientCertificate:         clientCert,
+			cacheUser:                 true,
+		},
+		{
+			name:                      "certificate-bound token with another client certificate",
+			claims:                    certBoundViewer,
+			config:                    defaultAllowACL,
+			method:                    "GET",
+			path:                      "/app/viewer",
+			validateClientCertificate: true,
+			clientCertificate:         otherClientCert,
+			shouldErr:                 true,
+			err:                       errors.ErrClientCertificateMismatch.WithArgs(clientCertThumbprint, getTestCertificateThumbprint(otherClientCert)),
+		},
+		{
+			name:                      "certificate-bound token without client certificate",
+			claims:                    certBoundViewer,
+			config:                    defaultAllowACL,
+			method:                    "GET",
+			path:                      "/app/viewer",
+			validateClientCertificate: true,
+			shouldErr:                 true,
+			err:                       errors.ErrClientCertificateNotFound,
+		},
+		{
+			name:                      "token without certificate thumbprint claim",
+			claims:                    viewer,
+			config:                    defaultAllowACL,
+			method:                    "GET",
+			path:                      "/app/viewer",
+			validateClientCertificate: true,
+			clientCertificate:         clientCert,
+			shouldErr:                 true,
+			err:                       errors.ErrClientCertificateClaimNotFound,
+		},
+		{
+			name:                      "certificate-bound token denied by access list",
+			claims:                    certBoundViewer,
+			config:                    defaultRolesDenyACL,
+			method:                    "GET",
+			path:                      "/app/viewer",
+			validateClientCertificate: true,
+			shouldErr:                 true,
+			err:                       errors.ErrAccessNotAllowed,
+		},
 	}
 
 	for _, tc := range testcases {
@@ -985,6 +1284,12 @@ func TestAuthorize(t *testing.T) {
 				if tc.validateMethodPath {
 					opts.ValidateMethodPath = true
 				}
+				opts.ValidateAudience = tc.validateAudience
+				opts.ValidateIssuer = tc.validateIssuer
+				opts.TokenLeeway = tc.tokenLeeway
+				opts.TokenMaxAge = tc.tokenMaxAge
+				opts.RequiredClaims = tc.requiredClaims
+				opts.ValidateClientCertificate = tc.validateClientCertificate
 			}
 
 			if len(tc.config) > 0 {
@@ -1085,6 +1390,10 @@ func TestAuthorize(t *testing.T) {
 				req.Header.Set("X-Real-Ip", tc.sourceAddress)
 			}
 
+			if tc.clientCertificate != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.clientCertificate}}
+			}
+
 			w := httptest.NewRecorder()
 			handler(w, req)
 			w.Result()
@@ -1261,10 +1570,16 @@ func TestSetSourcePriority(t *testing.T) {
 			err:       errors.ErrInvalidSourcePriority,
 		},
 		{
-			name:      "allowed token sources slice exceeds three values",
+			name:      "allowed token sources slice has header source without header name",
+			sources:   []string{"header", "header:"},
 			shouldErr: true,
-			sources:   []string{"foo", "foo", "foo", "foo"},
-			err:       errors.ErrInvalidSourcePriority,
+			err:       errors.ErrInvalidSourceConfig.WithArgs("header:", errors.ErrTokenSourceArgNotFound.WithArgs("header name")),
+		},
+		{
+			name:      "allowed token sources slice has source with unsupported argument",
+			sources:   []string{"cookie:session"},
+			shouldErr: true,
+			err:       errors.ErrInvalidSourceName.WithArgs("cookie:session"),
 		},
 		{
 			name:      "allowed token sources slice has invalid source",
@@ -1285,6 +1600,13 @@ func TestSetSourcePriority(t *testing.T) {
 				"sources": []string{"header", "cookie", "query"},
 			},
 		},
+		{
+			name:    "custom token sources",
+			sources: []string{"header", "header:X-Auth-Token", "form:access_token", "websocket", "cookie", "query"},
+			want: map[string]interface{}{
+				"sources": []string{"header", "header:X-Auth-Token", "form:access_token", "websocket", "cookie", "query"},
+			},
+		},
 	}
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1299,3 +1621,114 @@ func TestSetSourcePriority(t *testing.T) {
 		})
 	}
 }
+
+func TestOidcIssuer(t *testing.T) {
+	ctx := context.Background()
+	signKeyConfigs, err := kms.ParseCryptoKeyConfigs(
+		"crypto key kid1 sign-verify from file ./../../testdata/rskeys/test_2_pri.pem\n" +
+			"crypto key kid2 sign-verify from file ./../../testdata/ecdsakeys/test_1_pri.pem",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKeys, err := kms.GetKeysFromConfigs(signKeyConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The provider signs its tokens with the first key. The second key is
+	// a static key of the same context.
+	oidcSignKey, staticKey := signKeys[0], signKeys[1]
+	signKeyStore := kms.NewCryptoKeyStore()
+	if err := signKeyStore.AddKey(oidcSignKey); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := json.Marshal(signKeyStore.GetJSONWebKeySet())
+		w.Write(b)
+	})
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := json.Marshal(map[string]interface{}{
+			"issuer":   "http://" + r.Host,
+			"jwks_uri": "http://" + r.Host + "/jwks",
+		})
+		w.Write(b)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	configs, err := kms.ParseCryptoKeyConfigs("crypto key verify from oidc " + ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := kms.GetKeysFromConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, staticKey)
+	v := NewTokenValidator()
+	if err := v.Configure(ctx, keys, testutils.NewTestGuestAccessList(), options.NewTokenValidatorOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		name      string
+		key       *kms.CryptoKey
+		issuer    string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:   "token issued by discovered provider",
+			key:    oidcSignKey,
+			issuer: ts.URL,
+		},
+		{
+			name:      "token signed by provider key with another issuer",
+			key:       oidcSignKey,
+			issuer:    "https://auth.example.com",
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidToken.WithArgs(errors.ErrCryptoKeyStoreParseTokenFailed),
+		},
+		{
+			name:      "token signed by provider key without issuer",
+			key:       oidcSignKey,
+			shouldErr: true,
+			err:       errors.ErrValidatorInvalidToken.WithArgs(errors.ErrCryptoKeyStoreParseTokenFailed),
+		},
+		{
+			name:   "token signed by static key with another issuer",
+			key:    staticKey,
+			issuer: "https://auth.example.com",
+		},
+		{
+			name: "token signed by static key without issuer",
+			key:  staticKey,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs := []string{fmt.Sprintf("test name: %s", tc.name)}
+			m := map[string]interface{}{
+				"exp":   time.Now().Add(10 * time.Minute).Unix(),
+				"sub":   "smithj@outlook.com",
+				"roles": []string{"guest"},
+			}
+			if tc.issuer != "" {
+				m["iss"] = tc.issuer
+			}
+			usr, err := user.NewUser(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.key.SignToken(nil, usr); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/protected/path", nil)
+			r.Header.Set("Authorization", "access_token="+usr.Token)
+			_, err = v.Authorize(ctx, r)
+			tests.EvalErrWithLog(t, err, "authorize", tc.shouldErr, tc.err, msgs)
+		})
+	}
+}
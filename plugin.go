@@ -47,6 +47,7 @@ func (AuthMiddleware) CaddyModule() caddy.ModuleInfo {
 func (m *AuthMiddleware) Provision(ctx caddy.Context) error {
 	opts := make(map[string]interface{})
 	opts["logger"] = ctx.Logger(m)
+	opts["storage"] = ctx.Storage()
 	return m.Authorizer.Provision(opts)
 }
 
@@ -68,6 +69,11 @@ func (m *AuthMiddleware) Validate() error {
 	return m.Authorizer.Validate()
 }
 
+// Cleanup implements caddy.CleanerUpper.
+func (m *AuthMiddleware) Cleanup() error {
+	return m.Authorizer.Cleanup()
+}
+
 // Authenticate authorizes access based on the presense and content of JWT token.
 func (m AuthMiddleware) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
 	reqID := GetRequestID(r)
@@ -97,6 +103,7 @@ func (m AuthMiddleware) Authenticate(w http.ResponseWriter, r *http.Request) (ca
 var (
 	_ caddy.Provisioner       = (*AuthMiddleware)(nil)
 	_ caddy.Validator         = (*AuthMiddleware)(nil)
+	_ caddy.CleanerUpper      = (*AuthMiddleware)(nil)
 	_ caddyauth.Authenticator = (*AuthMiddleware)(nil)
 	_ caddyfile.Unmarshaler   = (*AuthMiddleware)(nil)
 )
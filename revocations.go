@@ -0,0 +1,131 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authorize
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/greenpau/caddy-authorize/pkg/authz"
+	"github.com/greenpau/caddy-authorize/pkg/validator"
+	"net/http"
+)
+
+const maxRevocationRequestSize = 1 << 20
+
+func init() {
+	caddy.RegisterModule(RevocationHandler{})
+	httpcaddyfile.RegisterHandlerDirective("authorize_revocations", getRevocationHandlerFromParseCaddyfile)
+}
+
+// RevocationHandler is the admin endpoint for the list of revoked tokens of
+// the primary authorization instance of a context. The GET requests return
+// the revoked tokens, and the POST requests with JSON array of the revoked
+// tokens add them to the list. The endpoint must be protected, e.g. by an
+// authorization instance allowing the administrators only.
+type RevocationHandler struct {
+	Context string `json:"context,omitempty" xml:"context,omitempty" yaml:"context,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (RevocationHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.authorize_revocations",
+		New: func() caddy.Module { return new(RevocationHandler) },
+	}
+}
+
+// Provision provisions revocation handler.
+func (h *RevocationHandler) Provision(ctx caddy.Context) error {
+	if h.Context == "" {
+		h.Context = "default"
+	}
+	return nil
+}
+
+// ServeHTTP serves the list of revoked tokens of the context.
+func (h RevocationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := authz.AuthManager.GetRevokedTokens(h.Context)
+		if err != nil {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		b, err := json.Marshal(entries)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(b)
+		return err
+	case http.MethodPost:
+		var entries []*validator.RevokedToken
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRevocationRequestSize)).Decode(&entries); err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		for _, entry := range entries {
+			if err := entry.Validate(); err != nil {
+				return caddyhttp.Error(http.StatusBadRequest, err)
+			}
+		}
+		if err := authz.AuthManager.RevokeTokens(h.Context, entries); err != nil {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	w.Header().Set("Allow", "GET, POST")
+	return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+}
+
+// UnmarshalCaddyfile sets up revocation handler. Syntax:
+//
+//     authorize_revocations [<context>]
+//
+func (h *RevocationHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		args := d.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			h.Context = args[0]
+		default:
+			return d.ArgErr()
+		}
+		if d.NextBlock(0) {
+			return d.Err("authorize_revocations directive does not support blocks")
+		}
+	}
+	return nil
+}
+
+func getRevocationHandlerFromParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := &RevocationHandler{}
+	if err := m.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*RevocationHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RevocationHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*RevocationHandler)(nil)
+)
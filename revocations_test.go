@@ -0,0 +1,146 @@
+// Copyright 2020 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authorize
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/greenpau/caddy-authorize/internal/testutils"
+	"github.com/greenpau/caddy-authorize/pkg/validator"
+)
+
+func TestRevocationHandler(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	baseURL := "https://127.0.0.1:3443"
+	tmpDir, err := ioutil.TempDir("", "revocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filePath := filepath.Join(tmpDir, "revoked_tokens.json")
+	if err := ioutil.WriteFile(filePath, []byte("[]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rawConfig := `
+	{
+	  local_certs
+	  http_port     3080
+	  https_port    3443
+	}
+
+	127.0.0.1, localhost {
+	  route /admin/revocations {
+	    authorize_revocations
+	  }
+	  route /app* {
+	    authorize {
+	      primary yes
+	      crypto key verify ` + testutils.GetSharedKey() + `
+	      allow roles anonymous guest admin
+	    }
+	    respond * "app" 200
+	  }
+	  route /api* {
+	    authorize {
+	      revocation file ` + filePath + `
+	    }
+	    respond * "api" 200
+	  }
+	}
+	`
+	tester.InitServer(rawConfig, "caddyfile")
+
+	usr := testutils.NewTestUser()
+	if err := testutils.NewTestCryptoKeyStore().SignToken("access_token", "HS512", usr); err != nil {
+		t.Fatal(err)
+	}
+	getApp := func(path string) int {
+		req, err := http.NewRequest("GET", baseURL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "access_token="+usr.Token)
+		resp, err := tester.Client.Transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	postRevocations := func(body string) int {
+		resp, err := tester.Client.Post(baseURL+"/admin/revocations", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, path := range []string{"/app", "/api"} {
+		if code := getApp(path); code != 200 {
+			t.Fatalf("unexpected status code prior to revocation: %s: %d", path, code)
+		}
+	}
+	if code := postRevocations(`[{"token_id": "a1"}, {}]`); code != 400 {
+		t.Fatalf("unexpected status code for empty entry: %d", code)
+	}
+	if code := postRevocations(`[{"subject": "` + usr.Claims.Subject + `"}]`); code != 204 {
+		t.Fatalf("unexpected status code for revocation: %d", code)
+	}
+	for _, path := range []string{"/app", "/api"} {
+		if code := getApp(path); code != 302 {
+			t.Fatalf("unexpected status code after revocation: %s: %d", path, code)
+		}
+	}
+
+	// The revocations pushed to the context are retained upon the reload.
+	time.Sleep(1500 * time.Millisecond)
+	tester.InitServer(rawConfig, "caddyfile")
+	for _, path := range []string{"/app", "/api"} {
+		if code := getApp(path); code != 302 {
+			t.Fatalf("unexpected status code after reload: %s: %d", path, code)
+		}
+	}
+
+	resp, err := tester.Client.Get(baseURL + "/admin/revocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*validator.RevokedToken
+	if err := json.Unmarshal(b, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Subject != usr.Claims.Subject {
+		t.Fatalf("unexpected revoked tokens: %s", b)
+	}
+
+	time.Sleep(1 * time.Second)
+}